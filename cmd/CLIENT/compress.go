@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"sync"
+
+	db "torrentium/internal/db"
+	"torrentium/internal/logging"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressionZstd marks a PIECE_CHUNK whose payload is zstd-compressed.
+const CompressionZstd = "zstd"
+
+const (
+	compressionSampleSize = 64 << 10 // bytes of the first served piece we try to compress
+	compressionMaxRatio   = 0.9      // compress a file only if its sample shrinks below this
+)
+
+// EncodeAll and DecodeAll are safe for concurrent use, so one encoder and
+// decoder serve all transfers. Neither constructor can fail with these
+// options.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(MaxChunk), zstd.WithDecoderConcurrency(0))
+)
+
+// compressionConfig controls whether we compress the pieces we serve.
+type compressionConfig struct {
+	Enabled bool
+}
+
+// loadCompressionConfig reads TORRENTIUM_COMPRESSION (default true).
+func loadCompressionConfig() compressionConfig {
+	cfg := compressionConfig{Enabled: true}
+	if v := os.Getenv("TORRENTIUM_COMPRESSION"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			logger.Warn("invalid TORRENTIUM_COMPRESSION", "value", v, logging.KeyErr, err)
+		} else {
+			cfg.Enabled = enabled
+		}
+	}
+	return cfg
+}
+
+// compressibility remembers, per CID, whether a sample of the file
+// compressed well. Media, archives and encrypted shares do not and are sent
+// as is without spending CPU on every chunk.
+type compressibility struct {
+	mu sync.Mutex
+	m  map[string]bool
+}
+
+// check samples the start of piece, read from r, the first time cidStr is
+// served.
+func (c *compressibility) check(cidStr string, r io.ReaderAt, piece db.Piece) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ok, seen := c.m[cidStr]; seen {
+		return ok
+	}
+	if c.m == nil {
+		c.m = make(map[string]bool)
+	}
+	sample := make([]byte, min(piece.Size, compressionSampleSize))
+	if _, err := r.ReadAt(sample, piece.Offset); err != nil {
+		return false // try again next time
+	}
+	ok := len(sample) > 0 && float64(len(zstdEncoder.EncodeAll(sample, nil))) < compressionMaxRatio*float64(len(sample))
+	c.m[cidStr] = ok
+	transferLog.Debug("sampled compressibility", logging.KeyCID, cidStr, "compress", ok)
+	return ok
+}
+
+// compressChunks reports whether the chunks of a piece of cidStr should be
+// compressed for a peer with the given session.
+func (c *Client) compressChunks(session *peerSession, cidStr string, r io.ReaderAt, piece db.Piece) bool {
+	return c.compression.Enabled && session.has(FeatureZstd) && c.compressible.check(cidStr, r, piece)
+}
+
+// compressChunk returns the zstd encoding of chunk, appended to dst[:0], if
+// it is smaller.
+func compressChunk(dst, chunk []byte) ([]byte, bool) {
+	out := zstdEncoder.EncodeAll(chunk, dst[:0])
+	if len(out) >= len(chunk) {
+		return chunk, false
+	}
+	return out, true
+}
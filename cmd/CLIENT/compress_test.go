@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestDecodeCompressedChunk(t *testing.T) {
+	pieces := testManifest(DefaultPieceSize).Pieces
+	want := bytes.Repeat([]byte("2024-01-01,ok\n"), MaxChunk/14+1)[:MaxChunk]
+	out, ok := compressChunk(nil, want)
+	if !ok {
+		t.Fatal("repetitive chunk was not compressed")
+	}
+	msg := controlMessage{Index: 0, TotalChunks: chunkCount(DefaultPieceSize), Compression: CompressionZstd, Payload: hex.EncodeToString(out)}
+	got, err := decodeChunk(msg, pieces)
+	if err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("decodeChunk = %d bytes, %v", len(got), err)
+	}
+
+	short, _ := compressChunk(nil, want[:MaxChunk-1])
+	for name, m := range map[string]controlMessage{
+		"wrong length": {Compression: CompressionZstd, Payload: hex.EncodeToString(short)},
+		"garbage":      {Compression: CompressionZstd, Payload: "deadbeef"},
+		"unknown":      {Compression: "lzma", Payload: hex.EncodeToString(out)},
+	} {
+		m.TotalChunks = msg.TotalChunks
+		if _, err := decodeChunk(m, pieces); err == nil {
+			t.Errorf("%s: chunk accepted", name)
+		}
+	}
+}
+
+func TestCompressibleTransfer(t *testing.T) {
+	tn := newTestNetwork(t, 2)
+	seeder, leecher := tn.nodes[0], tn.nodes[1]
+
+	var csv bytes.Buffer
+	for i := 0; csv.Len() < testFileSize; i++ {
+		fmt.Fprintf(&csv, "%d,sensor-%d,%d.%d\n", i, i%16, i%100, i%7)
+	}
+	want := csv.Bytes()
+	random := make([]byte, testFileSize)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+
+	var compressed, raw atomic.Int32
+	seeder.hooks.beforeSendChunk = func(_ peer.ID, msg *controlMessage) bool {
+		if msg.Compression == CompressionZstd {
+			compressed.Add(1)
+		} else {
+			raw.Add(1)
+		}
+		return true
+	}
+
+	cidStr, _ := shareExisting(tn, seeder, "readings.csv", want)
+	if got := tn.download(leecher, cidStr, downloadOptions{}); !bytes.Equal(got, want) {
+		t.Fatal("downloaded content differs from the shared file")
+	}
+	if compressed.Load() == 0 || raw.Load() != 0 {
+		t.Fatalf("sent %d compressed and %d raw chunks of a CSV file", compressed.Load(), raw.Load())
+	}
+
+	compressed.Store(0)
+	cidStr, _ = shareExisting(tn, seeder, "random.bin", random)
+	if got := tn.download(leecher, cidStr, downloadOptions{}); !bytes.Equal(got, random) {
+		t.Fatal("downloaded content differs from the shared file")
+	}
+	if compressed.Load() != 0 {
+		t.Fatalf("sent %d compressed chunks of incompressible data", compressed.Load())
+	}
+}
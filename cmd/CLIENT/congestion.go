@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	webRTC "torrentium/internal/client"
+	"torrentium/internal/logging"
+	"torrentium/internal/metrics"
+
+	"github.com/dustin/go-humanize"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Bounds of the per-peer sending window, in payload bytes.
+const (
+	InitialWindow = 4 * DefaultPieceSize
+	MinWindow     = DefaultPieceSize
+	MaxWindow     = 64 << 20
+)
+
+// MinPieceAckTimeout is how long we wait at least for a PIECE_ACK before
+// counting the piece as lost. The timeout grows with the measured round trip.
+const MinPieceAckTimeout = 30 * time.Second
+
+// pieceKey identifies a piece in flight to one peer.
+type pieceKey struct {
+	cid   string
+	index int64
+}
+
+type sentPiece struct {
+	size  int
+	at    time.Time
+	gen   uint64
+	timer *time.Timer
+}
+
+// congestionWindow paces the pieces we send to one peer with AIMD: the
+// window grows by one piece per acknowledged window (doubling in slow start)
+// and is halved, at most once per round trip, when a PIECE_ACK does not
+// arrive in time. Round trip times run from sending a piece to its
+// PIECE_ACK, so they include the transfer of the piece itself.
+type congestionWindow struct {
+	mu           sync.Mutex
+	cwnd         float64
+	ssthresh     float64
+	inflight     int
+	sent         map[pieceKey]sentPiece
+	gen          uint64
+	srtt         time.Duration
+	rttvar       time.Duration
+	minRTT       time.Duration
+	lastDecrease time.Time
+	rate         float64 // smoothed delivery rate in bytes per second
+	rateStart    time.Time
+	rateBytes    int
+	changed      chan struct{} // closed and replaced whenever room may have opened
+}
+
+func newCongestionWindow() *congestionWindow {
+	return &congestionWindow{
+		cwnd:     InitialWindow,
+		ssthresh: MaxWindow,
+		sent:     make(map[pieceKey]sentPiece),
+		changed:  make(chan struct{}),
+	}
+}
+
+func (w *congestionWindow) notifyLocked() {
+	close(w.changed)
+	w.changed = make(chan struct{})
+}
+
+// releaseLocked stops tracking a piece.
+func (w *congestionWindow) releaseLocked(key pieceKey, p sentPiece) {
+	p.timer.Stop()
+	delete(w.sent, key)
+	w.inflight -= p.size
+	w.notifyLocked()
+}
+
+// acquire waits until size more bytes fit in the window and records the
+// piece as in flight. A single piece is always let through on an idle
+// window. Sending a piece again replaces the earlier transmission.
+func (w *congestionWindow) acquire(key pieceKey, size int, closed <-chan struct{}) error {
+	for {
+		w.mu.Lock()
+		if old, ok := w.sent[key]; ok {
+			w.releaseLocked(key, old)
+		}
+		if w.inflight == 0 || float64(w.inflight+size) <= w.cwnd {
+			w.gen++
+			gen := w.gen
+			timeout := max(MinPieceAckTimeout, w.srtt+4*w.rttvar)
+			w.inflight += size
+			w.sent[key] = sentPiece{
+				size:  size,
+				at:    time.Now(),
+				gen:   gen,
+				timer: time.AfterFunc(timeout, func() { w.onTimeout(key, gen) }),
+			}
+			w.mu.Unlock()
+			return nil
+		}
+		changed := w.changed
+		w.mu.Unlock()
+		select {
+		case <-changed:
+		case <-closed:
+			return fmt.Errorf("connection closed")
+		}
+	}
+}
+
+// onAck releases an acknowledged piece and opens the window.
+func (w *congestionWindow) onAck(key pieceKey) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	p, ok := w.sent[key]
+	if !ok {
+		return // already timed out
+	}
+	w.releaseLocked(key, p)
+	now := time.Now()
+	w.sampleRTT(now.Sub(p.at))
+	w.sampleRate(now, p.size)
+
+	if w.cwnd < w.ssthresh {
+		w.cwnd += float64(p.size)
+	} else {
+		w.cwnd += float64(DefaultPieceSize) * float64(p.size) / w.cwnd
+	}
+	w.cwnd = min(w.cwnd, MaxWindow)
+}
+
+// onTimeout releases a piece whose acknowledgement did not arrive in time
+// and shrinks the window.
+func (w *congestionWindow) onTimeout(key pieceKey, gen uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	p, ok := w.sent[key]
+	if !ok || p.gen != gen {
+		return
+	}
+	w.releaseLocked(key, p)
+	metrics.PieceAckTimeouts.Inc()
+	if now := time.Now(); now.Sub(w.lastDecrease) > w.srtt {
+		w.ssthresh = max(w.cwnd/2, MinWindow)
+		w.cwnd = w.ssthresh
+		w.lastDecrease = now
+	}
+}
+
+// release stops tracking a piece whose sending was abandoned. Nothing was
+// lost in transit, so the window keeps its size.
+func (w *congestionWindow) release(key pieceKey) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if p, ok := w.sent[key]; ok {
+		w.releaseLocked(key, p)
+	}
+}
+
+// stop cancels the timers of all pieces in flight.
+func (w *congestionWindow) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for key, p := range w.sent {
+		w.releaseLocked(key, p)
+	}
+}
+
+// sampleRTT updates the smoothed round trip time as in RFC 6298.
+func (w *congestionWindow) sampleRTT(rtt time.Duration) {
+	if w.srtt == 0 {
+		w.srtt, w.rttvar, w.minRTT = rtt, rtt/2, rtt
+		return
+	}
+	diff := w.srtt - rtt
+	if diff < 0 {
+		diff = -diff
+	}
+	w.rttvar = (3*w.rttvar + diff) / 4
+	w.srtt = (7*w.srtt + rtt) / 8
+	w.minRTT = min(w.minRTT, rtt)
+}
+
+// sampleRate measures acknowledged bytes over intervals of at least one
+// round trip and smooths the result.
+func (w *congestionWindow) sampleRate(now time.Time, size int) {
+	if w.rateStart.IsZero() {
+		w.rateStart = now
+	}
+	w.rateBytes += size
+	elapsed := now.Sub(w.rateStart)
+	if elapsed < max(w.srtt, 100*time.Millisecond) {
+		return
+	}
+	sample := float64(w.rateBytes) / elapsed.Seconds()
+	if w.rate == 0 {
+		w.rate = sample
+	} else {
+		w.rate = 0.75*w.rate + 0.25*sample
+	}
+	w.rateStart, w.rateBytes = now, 0
+}
+
+func (w *congestionWindow) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return fmt.Sprintf("window %s, RTT %v, %s/s", humanize.IBytes(uint64(w.cwnd)), w.srtt.Round(time.Millisecond), humanize.Bytes(uint64(w.rate)))
+}
+
+// peerWindows holds the sending window of every peer we upload to.
+type peerWindows struct {
+	mu sync.Mutex
+	m  map[peer.ID]*congestionWindow
+}
+
+func (p *peerWindows) get(pid peer.ID) *congestionWindow {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.m == nil {
+		p.m = make(map[peer.ID]*congestionWindow)
+	}
+	w, ok := p.m[pid]
+	if !ok {
+		w = newCongestionWindow()
+		p.m[pid] = w
+	}
+	return w
+}
+
+// lookup returns the window of pid without creating one.
+func (p *peerWindows) lookup(pid peer.ID) *congestionWindow {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.m[pid]
+}
+
+func (p *peerWindows) drop(pid peer.ID) {
+	p.mu.Lock()
+	w := p.m[pid]
+	delete(p.m, pid)
+	p.mu.Unlock()
+	if w != nil {
+		w.stop()
+	}
+}
+
+// ackChunk acknowledges a received chunk. Peers that negotiated piece-ack get
+// one PIECE_ACK after the last chunk of a piece, which the ordered channel
+// delivers last; older peers expect a CHUNK_ACK for every chunk and resend
+// chunks until they get one.
+func (c *Client) ackChunk(ctrl controlMessage, p *webRTC.SimpleWebRTCPeer) {
+	ack := controlMessage{Command: "CHUNK_ACK", CID: ctrl.CID, Index: ctrl.Index, Sequence: ctrl.Sequence}
+	if c.sessions.get(p.GetSignalingStream().Conn().RemotePeer()).has(FeaturePieceAck) {
+		if ctrl.ChunkIndex != ctrl.TotalChunks-1 {
+			return
+		}
+		ack = controlMessage{Command: "PIECE_ACK", CID: ctrl.CID, Index: ctrl.Index}
+	}
+	if err := p.SendJSONReliable(ack); err != nil {
+		transferLog.Warn("failed to send ACK", "command", ack.Command, logging.KeyCID, ctrl.CID, logging.KeyPiece, ctrl.Index, logging.KeyErr, err)
+	}
+}
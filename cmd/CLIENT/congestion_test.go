@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCongestionWindowAIMD(t *testing.T) {
+	w := newCongestionWindow()
+	defer w.stop()
+	closed := make(chan struct{})
+
+	// Slow start: a fully acknowledged window doubles it.
+	var keys []pieceKey
+	for i := 0; i < InitialWindow/DefaultPieceSize; i++ {
+		k := pieceKey{"cid", int64(i)}
+		if err := w.acquire(k, DefaultPieceSize, closed); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, k)
+	}
+	for _, k := range keys {
+		w.onAck(k)
+	}
+	if w.cwnd != 2*InitialWindow {
+		t.Fatalf("window after slow start round = %v, want %v", w.cwnd, 2*InitialWindow)
+	}
+
+	// A timeout halves the window; a second one within the same round trip
+	// does not.
+	w.acquire(pieceKey{"cid", 10}, DefaultPieceSize, closed)
+	w.acquire(pieceKey{"cid", 11}, DefaultPieceSize, closed)
+	w.srtt = time.Hour
+	w.onTimeout(pieceKey{"cid", 10}, w.sent[pieceKey{"cid", 10}].gen)
+	w.onTimeout(pieceKey{"cid", 11}, w.sent[pieceKey{"cid", 11}].gen)
+	if w.cwnd != InitialWindow {
+		t.Fatalf("window after timeout = %v, want %v", w.cwnd, InitialWindow)
+	}
+	if w.inflight != 0 {
+		t.Fatalf("timed out pieces still count %d bytes in flight", w.inflight)
+	}
+
+	// Congestion avoidance: one window of ACKs grows it by about one piece.
+	before := w.cwnd
+	keys = keys[:0]
+	for i := 0; i < int(before)/DefaultPieceSize; i++ {
+		k := pieceKey{"cid", int64(20 + i)}
+		w.acquire(k, DefaultPieceSize, closed)
+		keys = append(keys, k)
+	}
+	for _, k := range keys {
+		w.onAck(k)
+	}
+	if grown := w.cwnd - before; grown < 0.9*DefaultPieceSize || grown > DefaultPieceSize {
+		t.Fatalf("window grew by %v in congestion avoidance, want about %d", grown, DefaultPieceSize)
+	}
+}
+
+func TestCongestionWindowBlocksWhenFull(t *testing.T) {
+	w := newCongestionWindow()
+	defer w.stop()
+	closed := make(chan struct{})
+	for i := 0; i < InitialWindow/DefaultPieceSize; i++ {
+		w.acquire(pieceKey{"cid", int64(i)}, DefaultPieceSize, closed)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- w.acquire(pieceKey{"cid", 100}, DefaultPieceSize, closed) }()
+	select {
+	case <-done:
+		t.Fatal("acquire did not wait for room in a full window")
+	case <-time.After(50 * time.Millisecond):
+	}
+	w.onAck(pieceKey{"cid", 0})
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// Resending a piece replaces its earlier transmission.
+	inflight := w.inflight
+	w.acquire(pieceKey{"cid", 100}, DefaultPieceSize, closed)
+	if w.inflight != inflight {
+		t.Fatalf("resent piece counted twice: %d bytes in flight, want %d", w.inflight, inflight)
+	}
+
+	go func() { done <- w.acquire(pieceKey{"cid", 200}, MaxWindow, closed) }()
+	close(closed)
+	if err := <-done; err == nil {
+		t.Fatal("acquire succeeded on a closed connection")
+	}
+}
+
+func TestCongestionWindowReleaseKeepsSize(t *testing.T) {
+	w := newCongestionWindow()
+	defer w.stop()
+	closed := make(chan struct{})
+	for i := 0; i < InitialWindow/DefaultPieceSize; i++ {
+		w.acquire(pieceKey{"cid", int64(i)}, DefaultPieceSize, closed)
+	}
+
+	// A piece that was never sent in full frees its room at once, and the
+	// window does not shrink as it would after a timeout.
+	done := make(chan error, 1)
+	go func() { done <- w.acquire(pieceKey{"cid", 100}, DefaultPieceSize, closed) }()
+	w.release(pieceKey{"cid", 0})
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("acquire still waiting after a piece was released")
+	}
+	if w.cwnd != InitialWindow || w.inflight != InitialWindow {
+		t.Fatalf("after release: cwnd %v, %d bytes in flight", w.cwnd, w.inflight)
+	}
+	w.release(pieceKey{"cid", 0}) // no longer tracked
+	if w.inflight != InitialWindow {
+		t.Fatalf("releasing twice freed %d bytes", InitialWindow-w.inflight)
+	}
+}
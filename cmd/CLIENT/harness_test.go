@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	webRTC "torrentium/internal/client"
+	db "torrentium/internal/db"
+	"torrentium/internal/logging"
+	"torrentium/internal/naming"
+	p2p "torrentium/internal/p2p"
+
+	"github.com/ipfs/go-cid"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/multiformats/go-multihash"
+)
+
+const (
+	testTransferTimeout = 2 * time.Minute
+	testSettleTimeout   = 10 * time.Second
+)
+
+func TestMain(m *testing.M) {
+	// Peers talk over loopback only: no STUN, no relay, no bootstrap nodes.
+	webRTC.ConfigureICE(webRTC.ICEConfig{IncludeLoopback: true})
+	if err := logging.Configure(os.Stderr, "text", envOr("TORRENTIUM_LOG_LEVEL", "error")); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// testNetwork is an in-process swarm of clients connected over libp2p's
+// mocknet. Every node runs a DHT server and has its own in-memory database
+// and download directory.
+type testNetwork struct {
+	t     *testing.T
+	mn    mocknet.Mocknet
+	nodes []*testNode
+}
+
+type testNode struct {
+	*Client
+	dir string
+}
+
+func newTestNetwork(t *testing.T, n int) *testNetwork {
+	t.Helper()
+	tn := newUnconnectedTestNetwork(t, n)
+	if err := tn.mn.LinkAll(); err != nil {
+		t.Fatalf("failed to link peers: %v", err)
+	}
+	if err := tn.mn.ConnectAllButSelf(); err != nil {
+		t.Fatalf("failed to connect peers: %v", err)
+	}
+	waitFor(t, 30*time.Second, "DHT routing tables to fill", func() bool {
+		for _, node := range tn.nodes {
+			if node.dht.RoutingTable().Size() < n-1 {
+				return false
+			}
+		}
+		return true
+	})
+	return tn
+}
+
+// newUnconnectedTestNetwork is like newTestNetwork, but the nodes cannot
+// reach each other until the test links them.
+func newUnconnectedTestNetwork(t *testing.T, n int) *testNetwork {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	mn := mocknet.New()
+	tn := &testNetwork{t: t, mn: mn}
+	t.Cleanup(cancel)
+
+	for i := 0; i < n; i++ {
+		h, err := mn.GenPeer()
+		if err != nil {
+			t.Fatalf("failed to create mock host: %v", err)
+		}
+		d, err := dht.New(ctx, h, dht.Mode(dht.ModeServer))
+		if err != nil {
+			t.Fatalf("failed to create DHT: %v", err)
+		}
+		names, err := naming.NewDHT(ctx, h)
+		if err != nil {
+			t.Fatalf("failed to create name DHT: %v", err)
+		}
+		name := strings.NewReplacer("/", "_", " ", "_").Replace(t.Name())
+		sqlDB, err := db.Open(fmt.Sprintf("file:%s-%d?mode=memory&cache=shared", name, i))
+		if err != nil {
+			t.Fatalf("failed to open database: %v", err)
+		}
+		// A shared-cache memory database lives as long as one connection does;
+		// a single connection also avoids "table is locked" errors.
+		sqlDB.SetMaxOpenConns(1)
+		t.Cleanup(func() { sqlDB.Close() })
+
+		c := NewClient(h, d, names, db.NewRepository(sqlDB), p2p.NewGater())
+		c.output = outputConfig{Dir: t.TempDir(), OnConflict: ConflictRename}
+		c.seeding = seedingConfig{}
+		c.storage = storageConfig{GCInterval: DefaultGCInterval}
+		c.shares = shareConfig{EncryptedDir: t.TempDir()}
+		c.policy = peerPolicy{}
+		c.compression = compressionConfig{Enabled: true}
+		c.dataChannels = DefaultDataChannels
+		p2p.RegisterSignalingProtocol(h, c.handleWebRTCOffer)
+		tn.nodes = append(tn.nodes, &testNode{Client: c, dir: t.TempDir()})
+	}
+	// Registered last so that it runs before the databases and directories
+	// the nodes use are cleaned up.
+	t.Cleanup(func() {
+		tn.settle()
+		for _, node := range tn.nodes {
+			_ = node.dht.Close()
+			_ = node.names.Close()
+		}
+		_ = mn.Close()
+	})
+
+	return tn
+}
+
+// newOfflineClient returns a client with only an in-memory database and no
+// network, for testing bookkeeping that does not talk to peers.
+func newOfflineClient(t *testing.T, quota int64) *Client {
+	t.Helper()
+	sqlDB, err := db.Open("file:" + t.Name() + "?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+	return &Client{
+		db:              db.NewRepository(sqlDB),
+		activeDownloads: make(map[string]*DownloadState),
+		storage:         storageConfig{Quota: quota, GCInterval: DefaultGCInterval},
+	}
+}
+
+// shareFile writes size random bytes to a file owned by node and shares it.
+func (tn *testNetwork) shareFile(node *testNode, name string, size int) (string, []byte) {
+	tn.t.Helper()
+	data := make([]byte, size)
+	if _, err := io.ReadFull(rand.Reader, data); err != nil {
+		tn.t.Fatal(err)
+	}
+	path := writeTestFile(tn.t, node.dir, name, data)
+	if err := node.addFile(context.Background(), path, addOptions{}); err != nil {
+		tn.t.Fatalf("addFile: %v", err)
+	}
+	return rawCID(tn.t, data), data
+}
+
+// download fetches cidStr, a CID or share link, on node and returns the downloaded content.
+func (tn *testNetwork) download(node *testNode, cidStr string, opts downloadOptions) []byte {
+	tn.t.Helper()
+	errCh := make(chan error, 1)
+	go func() { errCh <- node.downloadFile(cidStr, opts) }()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			tn.t.Fatalf("download failed: %v", err)
+		}
+	case <-time.After(testTransferTimeout):
+		tn.t.Fatalf("download of %s did not finish within %v", cidStr, testTransferTimeout)
+	}
+	id, _ := splitShareLink(cidStr)
+	d, err := node.db.GetDownloadByCID(context.Background(), id)
+	if err != nil {
+		tn.t.Fatalf("no download record: %v", err)
+	}
+	if d.Status != db.DownloadStatusCompleted {
+		tn.t.Fatalf("download status = %q, want %q", d.Status, db.DownloadStatusCompleted)
+	}
+	data, err := os.ReadFile(d.DownloadPath)
+	if err != nil {
+		tn.t.Fatal(err)
+	}
+	return data
+}
+
+// webRTCPeer returns node's WebRTC connection to pid, if any.
+func (n *testNode) webRTCPeer(pid peer.ID) *webRTC.SimpleWebRTCPeer {
+	n.peersMux.RLock()
+	defer n.peersMux.RUnlock()
+	return n.webRTCPeers[pid]
+}
+
+func (n *testNode) webRTCPeerCount() int {
+	n.peersMux.RLock()
+	defer n.peersMux.RUnlock()
+	return len(n.webRTCPeers)
+}
+
+// settle closes every WebRTC connection and waits for the downloads and peer
+// handlers using them to return, so that nothing touches the DHTs, the
+// mocknet or the databases while they are being closed.
+func (tn *testNetwork) settle() {
+	deadline := time.Now().Add(testSettleTimeout)
+	for {
+		busy := false
+		for _, node := range tn.nodes {
+			node.closePeers()
+			node.peersMux.RLock()
+			busy = busy || len(node.webRTCPeers) > 0
+			node.peersMux.RUnlock()
+			node.downloadsMux.RLock()
+			busy = busy || len(node.activeDownloads) > 0
+			node.downloadsMux.RUnlock()
+		}
+		if !busy {
+			return
+		}
+		if time.Now().After(deadline) {
+			tn.t.Logf("peers still busy %v after the test", testSettleTimeout)
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (n *testNode) closePeers() {
+	n.peersMux.RLock()
+	peers := make([]*webRTC.SimpleWebRTCPeer, 0, len(n.webRTCPeers))
+	for _, p := range n.webRTCPeers {
+		peers = append(peers, p)
+	}
+	n.peersMux.RUnlock()
+	for _, p := range peers {
+		p.Close()
+	}
+}
+
+func rawCID(t *testing.T, data []byte) string {
+	t.Helper()
+	mh, err := multihash.Sum(data, multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cid.NewCidV1(cid.Raw, mh).String()
+}
+
+func writeTestFile(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func mustDecodeCID(t *testing.T, s string) cid.Cid {
+	t.Helper()
+	c, err := cid.Decode(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
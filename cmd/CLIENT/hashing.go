@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// hashMemory bounds the piece buffers hashFile keeps in flight.
+const hashMemory = 64 << 20
+
+// fileHashes are the digests addFile needs: the SHA-256 of the whole file,
+// which makes up its CID, and the hex SHA-256 of every piece.
+type fileHashes struct {
+	file   []byte
+	pieces []string
+}
+
+// hashBlock is one piece read from disk, hashed by a piece worker and by
+// the whole-file hasher before its buffer is reused.
+type hashBlock struct {
+	index int
+	buf   []byte
+	refs  atomic.Int32
+}
+
+// hashFile reads r once, piece by piece, and hashes the pieces on all cores
+// while a single goroutine feeds them in order into the whole-file hash.
+// At most two blocks per worker, and no more than about hashMemory, are held
+// in memory. progress is called with the number of bytes added to the
+// whole-file hash.
+func hashFile(ctx context.Context, r io.Reader, size, pieceSize int64, progress func(int)) (fileHashes, error) {
+	numPieces := int((size + pieceSize - 1) / pieceSize)
+	workers := max(1, min(runtime.GOMAXPROCS(0), numPieces))
+	blocks := max(1, min(2*workers, int(hashMemory/pieceSize), numPieces))
+	free := make(chan *hashBlock, blocks)
+	for i := 0; i < cap(free); i++ {
+		free <- &hashBlock{buf: make([]byte, pieceSize)}
+	}
+	release := func(b *hashBlock) {
+		if b.refs.Add(-1) == 0 {
+			free <- b
+		}
+	}
+
+	result := fileHashes{pieces: make([]string, numPieces)}
+	ordered := make(chan *hashBlock, cap(free))
+	work := make(chan *hashBlock, cap(free))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		h := sha256.New()
+		for b := range ordered {
+			h.Write(b.buf)
+			n := len(b.buf)
+			release(b)
+			if progress != nil {
+				progress(n)
+			}
+		}
+		result.file = h.Sum(nil)
+	}()
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range work {
+				sum := sha256.Sum256(b.buf)
+				result.pieces[b.index] = hex.EncodeToString(sum[:])
+				release(b)
+			}
+		}()
+	}
+
+	var err error
+	for idx := 0; idx < numPieces; idx++ {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		var b *hashBlock
+		select {
+		case b = <-free:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if err != nil {
+			break
+		}
+		n := min64(pieceSize, size-int64(idx)*pieceSize)
+		b.index, b.buf = idx, b.buf[:n]
+		if _, err = io.ReadFull(r, b.buf); err != nil {
+			err = fmt.Errorf("failed to read piece %d: %w", idx, err)
+			break
+		}
+		b.refs.Store(2)
+		ordered <- b
+		work <- b
+	}
+	close(ordered)
+	close(work)
+	wg.Wait()
+	if err != nil {
+		return fileHashes{}, err
+	}
+	return result, nil
+}
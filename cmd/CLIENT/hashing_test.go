@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestHashFile(t *testing.T) {
+	const pieceSize = 64 << 10
+	for _, size := range []int{0, 1000, pieceSize, 10*pieceSize + 123} {
+		data := make([]byte, size)
+		rand.Read(data)
+		var progress int
+		got, err := hashFile(context.Background(), bytes.NewReader(data), int64(size), pieceSize, func(n int) { progress += n })
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sum := sha256.Sum256(data); !bytes.Equal(got.file, sum[:]) {
+			t.Errorf("size %d: wrong file hash", size)
+		}
+		if progress != size {
+			t.Errorf("size %d: progress reported %d bytes", size, progress)
+		}
+		if want := (size + pieceSize - 1) / pieceSize; len(got.pieces) != want {
+			t.Fatalf("size %d: %d piece hashes, want %d", size, len(got.pieces), want)
+		}
+		for i, h := range got.pieces {
+			sum := sha256.Sum256(data[i*pieceSize : min((i+1)*pieceSize, size)])
+			if h != hex.EncodeToString(sum[:]) {
+				t.Errorf("size %d: wrong hash for piece %d", size, i)
+			}
+		}
+	}
+}
+
+func TestHashFileCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	data := make([]byte, 1<<20)
+	if _, err := hashFile(ctx, bytes.NewReader(data), int64(len(data)), 64<<10, nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	webRTC "torrentium/internal/client"
+	"torrentium/internal/logging"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Range of protocol versions this client speaks. Bump ProtocolVersion on any
+// wire change and MinProtocolVersion when support for an old one is dropped.
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+)
+
+// Optional protocol features announced in HELLO. A feature is only used with
+// a peer that announced it too.
+const (
+	FeatureRequestIDs = "request-ids" // responses echo the request_id of their request
+	FeatureEncryption = "encryption"  // encrypted shares and share links
+	FeatureZstd       = "zstd"        // zstd-compressed chunk payloads
+	FeaturePieceAck   = "piece-ack"   // pieces are acknowledged whole instead of per chunk
+
+	FeatureManifestPages = "manifest-pages" // compact manifests with paged piece hashes
+)
+
+// ErrCodeIncompatible and ErrCodeUnsupported are sent in ERROR replies when
+// the protocol versions do not overlap or a request needs a feature the peer
+// did not announce.
+const (
+	ErrCodeIncompatible = "INCOMPATIBLE"
+	ErrCodeUnsupported  = "UNSUPPORTED"
+)
+
+// incompatibleCloseDelay gives an INCOMPATIBLE reply time to leave before we
+// hang up.
+const incompatibleCloseDelay = time.Second
+
+// clientVersion is reported to peers in HELLO. Release builds set it with
+// -ldflags "-X main.clientVersion=...".
+var clientVersion = "torrentium/dev"
+
+// supportedFeatures lists the features we announce.
+var supportedFeatures = []string{FeatureRequestIDs, FeatureEncryption, FeatureZstd, FeaturePieceAck, FeatureManifestPages}
+
+// DefaultDataChannels is the size of the bulk data channel pool we ask for.
+const DefaultDataChannels = 4
+
+// loadDataChannels reads TORRENTIUM_DATA_CHANNELS (default 4, at most 16):
+// how many data channels pieces are spread over. The smaller of the two
+// peers' values is used.
+func loadDataChannels() int {
+	n := DefaultDataChannels
+	if v := os.Getenv("TORRENTIUM_DATA_CHANNELS"); v != "" {
+		i, err := strconv.Atoi(v)
+		if err != nil || i < 1 || i > webRTC.MaxDataChannels {
+			logger.Warn("invalid TORRENTIUM_DATA_CHANNELS", "value", v)
+		} else {
+			n = i
+		}
+	}
+	return n
+}
+
+// peerSession is what a HELLO exchange settled with one peer.
+type peerSession struct {
+	Version      int
+	Client       string
+	Features     []string // features both sides support
+	MaxPieceSize int64    // largest piece both sides accept
+	DataChannels int      // size of the data channel pool
+}
+
+func (s *peerSession) has(feature string) bool {
+	return s != nil && slices.Contains(s.Features, feature)
+}
+
+// helloMessage returns our HELLO.
+func helloMessage(dataChannels int) controlMessage {
+	return controlMessage{
+		Command:      "HELLO",
+		Version:      ProtocolVersion,
+		MinVersion:   MinProtocolVersion,
+		Client:       clientVersion,
+		Features:     supportedFeatures,
+		MaxPieceSize: MaxPieceSize,
+		DataChannels: dataChannels,
+	}
+}
+
+// negotiate settles the session with a peer from its HELLO and the number of
+// data channels we want. It fails if the version ranges of the two sides do
+// not overlap.
+func negotiate(hello controlMessage, dataChannels int) (*peerSession, error) {
+	minVersion := max(hello.MinVersion, MinProtocolVersion)
+	version := min(hello.Version, ProtocolVersion)
+	if hello.Version <= 0 || version < minVersion {
+		return nil, fmt.Errorf("peer speaks protocol %d-%d, we speak %d-%d", hello.MinVersion, hello.Version, MinProtocolVersion, ProtocolVersion)
+	}
+	s := &peerSession{Version: version, Client: hello.Client, MaxPieceSize: MaxPieceSize}
+	for _, f := range supportedFeatures {
+		if slices.Contains(hello.Features, f) {
+			s.Features = append(s.Features, f)
+		}
+	}
+	if hello.MaxPieceSize > 0 && hello.MaxPieceSize < s.MaxPieceSize {
+		s.MaxPieceSize = hello.MaxPieceSize
+	}
+	// Peers that do not send a count only know the one "data" channel.
+	s.DataChannels = max(1, min(hello.DataChannels, dataChannels))
+	return s, nil
+}
+
+// peerSessions holds the negotiated session of every peer that sent HELLO.
+// Peers without one predate the handshake and get no optional features.
+type peerSessions struct {
+	mu sync.RWMutex
+	m  map[peer.ID]*peerSession
+}
+
+func (s *peerSessions) get(pid peer.ID) *peerSession {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.m[pid]
+}
+
+func (s *peerSessions) set(pid peer.ID, session *peerSession) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.m == nil {
+		s.m = make(map[peer.ID]*peerSession)
+	}
+	s.m[pid] = session
+}
+
+func (s *peerSessions) drop(pid peer.ID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.m, pid)
+}
+
+// sendHello announces our protocol version and features to a peer. It must
+// be sent before any request so that the peer knows what we support.
+func (c *Client) sendHello(p *webRTC.SimpleWebRTCPeer) {
+	if err := p.SendJSONReliable(helloMessage(c.dataChannels)); err != nil {
+		transferLog.Debug("failed to send HELLO", logging.KeyPeer, p.GetSignalingStream().Conn().RemotePeer(), logging.KeyErr, err)
+	}
+}
+
+// handleHello records the session with a peer, or tells it that we cannot
+// talk to each other and hangs up.
+func (c *Client) handleHello(ctrl controlMessage, p *webRTC.SimpleWebRTCPeer) {
+	pid := p.GetSignalingStream().Conn().RemotePeer()
+	session, err := negotiate(ctrl, c.dataChannels)
+	if err != nil {
+		transferLog.Warn("incompatible peer", logging.KeyPeer, pid, "client", ctrl.Client, logging.KeyErr, err)
+		replyError(p, ctrl, ErrCodeIncompatible)
+		time.AfterFunc(incompatibleCloseDelay, p.Close)
+		return
+	}
+	c.sessions.set(pid, session)
+	transferLog.Debug("negotiated protocol", logging.KeyPeer, pid, "client", session.Client, "version", session.Version, "features", session.Features, "data_channels", session.DataChannels)
+	if p.IsOfferer() && session.DataChannels > 1 {
+		if err := p.GrowDataChannels(session.DataChannels); err != nil {
+			transferLog.Warn("failed to open data channels", logging.KeyPeer, pid, logging.KeyErr, err)
+		}
+	}
+}
+
+// checkManifestSupported reports whether the peer can handle the manifest we
+// are about to send it.
+func checkManifestSupported(session *peerSession, manifest controlMessage) error {
+	if manifest.Encrypted && !session.has(FeatureEncryption) {
+		return fmt.Errorf("peer does not support encrypted shares")
+	}
+	if session == nil {
+		return nil
+	}
+	for _, p := range manifest.Pieces {
+		if p.Size > session.MaxPieceSize {
+			return fmt.Errorf("piece of %d bytes exceeds the peer's limit of %d", p.Size, session.MaxPieceSize)
+		}
+	}
+	return nil
+}
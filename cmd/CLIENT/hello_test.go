@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/test"
+)
+
+func TestNegotiate(t *testing.T) {
+	s, err := negotiate(controlMessage{
+		Command:      "HELLO",
+		Version:      ProtocolVersion + 3,
+		MinVersion:   MinProtocolVersion,
+		Client:       "torrentium/future",
+		Features:     []string{FeatureEncryption, "teleportation"},
+		MaxPieceSize: 4 << 20,
+		DataChannels: 8,
+	}, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Version != ProtocolVersion {
+		t.Errorf("version = %d, want %d", s.Version, ProtocolVersion)
+	}
+	if !slices.Equal(s.Features, []string{FeatureEncryption}) {
+		t.Errorf("features = %v, want only %s", s.Features, FeatureEncryption)
+	}
+	if s.MaxPieceSize != 4<<20 {
+		t.Errorf("max piece size = %d, want %d", s.MaxPieceSize, 4<<20)
+	}
+	if s.DataChannels != 4 {
+		t.Errorf("data channels = %d, want 4", s.DataChannels)
+	}
+	if legacy, err := negotiate(controlMessage{Version: ProtocolVersion}, 4); err != nil || legacy.DataChannels != 1 {
+		t.Errorf("peer without a channel count: %+v, %v", legacy, err)
+	}
+
+	if _, err := negotiate(controlMessage{Version: ProtocolVersion + 2, MinVersion: ProtocolVersion + 1}, 1); err == nil {
+		t.Error("negotiated with a peer that dropped our version")
+	}
+	if _, err := negotiate(controlMessage{}, 1); err == nil {
+		t.Error("negotiated with a HELLO without a version")
+	}
+}
+
+func TestPendingRequestsAcceptLegacyResponse(t *testing.T) {
+	var pr pendingRequests
+	pid := test.RandPeerIDFatal(t)
+	_, chA := pr.add(pid, "a")
+	_, chB := pr.add(pid, "b")
+	if !pr.deliver(pid, controlMessage{Command: "MANIFEST", CID: "b"}) {
+		t.Fatal("response without a request ID was not delivered")
+	}
+	select {
+	case <-chB:
+	case <-chA:
+		t.Fatal("response went to the request for another CID")
+	}
+}
+
+func TestHelloEstablishesSession(t *testing.T) {
+	tn := newTestNetwork(t, 2)
+	a, b := tn.nodes[0], tn.nodes[1]
+	if _, err := a.initiateWebRTCConnectionWithRetry(b.host.ID(), 1); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 10*time.Second, "HELLO exchange", func() bool {
+		return a.sessions.get(b.host.ID()) != nil && b.sessions.get(a.host.ID()) != nil
+	})
+	for _, s := range []*peerSession{a.sessions.get(b.host.ID()), b.sessions.get(a.host.ID())} {
+		if s.Version != ProtocolVersion || s.Client != clientVersion || !s.has(FeatureEncryption) {
+			t.Fatalf("unexpected session %+v", s)
+		}
+	}
+
+	a.closePeers()
+	waitFor(t, 10*time.Second, "session cleanup", func() bool {
+		return a.sessions.get(b.host.ID()) == nil
+	})
+}
+
+func TestEncryptedManifestNeedsEncryptionFeature(t *testing.T) {
+	tn := newTestNetwork(t, 2)
+	seeder, leecher := tn.nodes[0], tn.nodes[1]
+	cidStr, _ := sharePrivate(tn, seeder, "secret.bin", make([]byte, testFileSize), addOptions{Encrypt: true})
+
+	conn, err := leecher.initiateWebRTCConnectionWithRetry(seeder.host.ID(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 10*time.Second, "HELLO exchange", func() bool {
+		return seeder.sessions.get(leecher.host.ID()) != nil
+	})
+	// Pretend the leecher is an older client that cannot decrypt.
+	seeder.sessions.set(leecher.host.ID(), &peerSession{Version: ProtocolVersion, MaxPieceSize: MaxPieceSize})
+
+	_, err = leecher.requestManifest(conn, cidStr)
+	var re *remoteError
+	if !errors.As(err, &re) || re.Code != ErrCodeUnsupported {
+		t.Fatalf("err = %v, want %s", err, ErrCodeUnsupported)
+	}
+}
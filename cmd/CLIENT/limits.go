@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	webRTC "torrentium/internal/client"
+	"torrentium/internal/logging"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/time/rate"
+)
+
+// Per-peer limits on the work a remote peer can make us do.
+const (
+	ManifestRequestRate      = 2 // sustained manifest requests per second
+	ManifestRequestBurst     = 10
+	MaxUploadsPerPeer        = 4    // pieces read and sent concurrently
+	MaxQueuedRequestsPerPeer = 1024 // piece requests waiting for an upload slot
+	MaxMalformedMessages     = 3    // malformed messages before we hang up
+	MalformedMessageScore    = -5.0
+	RequestFloodScore        = -1.0
+)
+
+// peerLimiter holds the request budget of one connected peer.
+type peerLimiter struct {
+	manifests *rate.Limiter
+	uploads   chan struct{}
+	queued    atomic.Int32
+	malformed atomic.Int32
+}
+
+type peerLimiters struct {
+	mu sync.Mutex
+	m  map[peer.ID]*peerLimiter
+}
+
+func (l *peerLimiters) get(pid peer.ID) *peerLimiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.m == nil {
+		l.m = make(map[peer.ID]*peerLimiter)
+	}
+	pl, ok := l.m[pid]
+	if !ok {
+		pl = &peerLimiter{
+			manifests: rate.NewLimiter(ManifestRequestRate, ManifestRequestBurst),
+			uploads:   make(chan struct{}, MaxUploadsPerPeer),
+		}
+		l.m[pid] = pl
+	}
+	return pl
+}
+
+func (l *peerLimiters) drop(pid peer.ID) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.m, pid)
+}
+
+// unshareSignals tells piece requests waiting for an upload slot that their
+// CID is no longer shared. Only CIDs with waiting requests have an entry.
+type unshareSignals struct {
+	mu sync.Mutex
+	m  map[string]*unshareSignal
+}
+
+type unshareSignal struct {
+	ch      chan struct{}
+	waiters int
+}
+
+// watch returns a channel that is closed when cidStr is unshared, and a
+// function to call once the caller stops waiting on it.
+func (s *unshareSignals) watch(cidStr string) (<-chan struct{}, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.m == nil {
+		s.m = make(map[string]*unshareSignal)
+	}
+	sig, ok := s.m[cidStr]
+	if !ok {
+		sig = &unshareSignal{ch: make(chan struct{})}
+		s.m[cidStr] = sig
+	}
+	sig.waiters++
+	return sig.ch, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if sig.waiters--; sig.waiters == 0 && s.m[cidStr] == sig {
+			delete(s.m, cidStr)
+		}
+	}
+}
+
+// fire wakes every request waiting on cidStr.
+func (s *unshareSignals) fire(cidStr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sig, ok := s.m[cidStr]; ok {
+		close(sig.ch)
+		delete(s.m, cidStr)
+	}
+}
+
+// allowManifestRequest rate limits manifest requests, which cost a database
+// lookup and a large reply each. Floods lower the peer's reputation.
+func (c *Client) allowManifestRequest(pid peer.ID) bool {
+	if c.limiters.get(pid).manifests.Allow() {
+		return true
+	}
+	transferLog.Debug("dropped manifest request over rate limit", logging.KeyPeer, pid)
+	go c.adjustPeerScore(pid, RequestFloodScore, "manifest request flood")
+	return false
+}
+
+// queuePieceRequest serves a piece request once one of the peer's upload
+// slots is free. When too many requests are already waiting, or the CID is
+// unshared while the request waits, the peer is told the piece is
+// unavailable, so that it asks someone else or retries later.
+func (c *Client) queuePieceRequest(ctx context.Context, ctrl controlMessage, p *webRTC.SimpleWebRTCPeer) {
+	pl := c.limiters.get(p.GetSignalingStream().Conn().RemotePeer())
+	if pl.queued.Add(1) > MaxQueuedRequestsPerPeer {
+		pl.queued.Add(-1)
+		_ = p.SendJSONReliable(controlMessage{Command: "PIECE_UNAVAILABLE", CID: ctrl.CID, Index: ctrl.Index})
+		return
+	}
+	unshared, stopWatching := c.unshared.watch(ctrl.CID)
+	go func() {
+		defer pl.queued.Add(-1)
+		defer stopWatching()
+		select {
+		case pl.uploads <- struct{}{}:
+		case <-p.WaitForCloseChannel():
+			return
+		case <-unshared:
+			_ = p.SendJSONReliable(controlMessage{Command: "PIECE_UNAVAILABLE", CID: ctrl.CID, Index: ctrl.Index})
+			return
+		}
+		defer func() { <-pl.uploads }()
+		c.handlePieceRequest(ctx, ctrl, p)
+	}()
+}
+
+// rejectMalformed lowers the reputation of a peer that sent an invalid
+// message and hangs up after MaxMalformedMessages of them.
+func (c *Client) rejectMalformed(p *webRTC.SimpleWebRTCPeer, err error) {
+	pid := p.GetSignalingStream().Conn().RemotePeer()
+	transferLog.Warn("rejected message from peer", logging.KeyPeer, pid, logging.KeyErr, err)
+	go c.adjustPeerScore(pid, MalformedMessageScore, "malformed message")
+	if c.limiters.get(pid).malformed.Add(1) >= MaxMalformedMessages {
+		transferLog.Warn("disconnecting peer after repeated malformed messages", logging.KeyPeer, pid)
+		go p.Close()
+	}
+}
@@ -3,21 +3,26 @@ package main
 import (
 	"bufio"
 	"context"
-	"crypto/sha256"
+	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	webRTC "torrentium/internal/client"
+	"torrentium/internal/crypt"
 	db "torrentium/internal/db"
+	"torrentium/internal/logging"
+	"torrentium/internal/metrics"
+	"torrentium/internal/naming"
 	p2p "torrentium/internal/p2p"
 
 	"github.com/dustin/go-humanize"
@@ -36,37 +41,65 @@ import (
 	"github.com/multiformats/go-multihash"
 )
 
+var (
+	logger      = logging.Logger("cli")
+	transferLog = logging.Logger("transfer")
+	dhtLog      = logging.Logger("dht")
+	storageLog  = logging.Logger("storage")
+	httpLog     = logging.Logger("http")
+	watchLog    = logging.Logger("watch")
+)
+
 const (
 	DefaultPieceSize       = 1 << 20 // 1 MiB pieces
 	MaxProviders           = 10
 	MaxChunk               = 16 * 1024 // 16KiB chunks
 	MaxParallelDownloads   = 3
 	PieceTimeout           = 300 * time.Second // Timeout for downloading a single piece
-	RetransmissionTimeout  = 5 * time.Second
 	KeepAliveInterval      = 15 * time.Second
 	PingInterval           = 10 * time.Second
-	MaxRTT                 = 500 * time.Millisecond
-	MinDelay               = 0
-	MaxDelay               = 100 * time.Millisecond
 	ExponentialBackoffBase = 1 * time.Second
 	MaxBackoff             = 32 * time.Second
 )
 
 type Client struct {
-	host             host.Host
-	dht              *dht.IpfsDHT
-	webRTCPeers      map[peer.ID]*webRTC.SimpleWebRTCPeer
-	peersMux         sync.RWMutex
-	sharingFiles     map[string]*FileInfo
-	activeDownloads  map[string]*DownloadState
-	downloadsMux     sync.RWMutex
-	db               *db.Repository
-	unackedChunks    map[string]map[int64]map[int]controlMessage
-	unackedChunksMux sync.RWMutex
-	congestionCtrl   map[peer.ID]time.Duration
-	pingTimes        map[peer.ID]time.Time
-	rttMeasurements  map[peer.ID][]time.Duration
-	rttMux           sync.Mutex
+	host            host.Host
+	dht             *dht.IpfsDHT
+	names           *dht.IpfsDHT // name records; see internal/naming
+	webRTCPeers     map[peer.ID]*webRTC.SimpleWebRTCPeer
+	peersMux        sync.RWMutex
+	sharingFiles    map[string]*FileInfo
+	sharingMux      sync.RWMutex
+	activeDownloads map[string]*DownloadState
+	downloadsMux    sync.RWMutex
+	db              *db.Repository
+	windows         peerWindows
+	pieceTimeout    time.Duration // re-request a piece that has not arrived after this long
+	dataChannels    int           // data channels we ask peers to spread pieces over
+	pingTimes       map[peer.ID]time.Time
+	rttMux          sync.Mutex
+	storage         storageConfig
+	seeding         seedingConfig
+	output          outputConfig
+	shares          shareConfig
+	gater           *p2p.Gater
+	policy          peerPolicy
+	limiters        peerLimiters
+	unshared        unshareSignals
+	pending         pendingRequests
+	sessions        peerSessions
+	compression     compressionConfig
+	compressible    compressibility
+	httpServer      *streamServer
+	hooks           transferHooks
+}
+
+// transferHooks let tests inject faults into transfers. They are all nil in
+// normal operation.
+type transferHooks struct {
+	// beforeSendChunk may modify an outgoing chunk; returning false drops
+	// it, simulating a chunk that never arrives.
+	beforeSendChunk func(to peer.ID, msg *controlMessage) bool
 }
 
 type FileInfo struct {
@@ -92,6 +125,22 @@ type controlMessage struct {
 	TotalChunks int        `json:"total_chunks,omitempty"`
 	Payload     string     `json:"payload,omitempty"`
 	Sequence    int        `json:"sequence,omitempty"`
+	Compression string     `json:"compression,omitempty"` // encoding of Payload before hex, empty if raw
+	Encrypted   bool       `json:"encrypted,omitempty"`   // content and filename are encrypted with a share key
+	Restricted  bool       `json:"restricted,omitempty"`  // served only to peers on the seeder's allowlist
+	RequestID   uint64     `json:"request_id,omitempty"`  // pairs a response with its request
+	Error       string     `json:"error,omitempty"`       // error code of an ERROR response
+	PiecesRoot  string     `json:"pieces_root,omitempty"` // SHA-256 of the binary piece hashes of a compact manifest
+	Count       int        `json:"count,omitempty"`       // number of piece hashes asked for
+	Hashes      []byte     `json:"hashes,omitempty"`      // binary piece hashes of a PIECE_HASHES page
+
+	// HELLO fields
+	Version      int      `json:"version,omitempty"`
+	MinVersion   int      `json:"min_version,omitempty"`
+	Client       string   `json:"client,omitempty"`
+	Features     []string `json:"features,omitempty"`
+	MaxPieceSize int64    `json:"max_piece_size,omitempty"`
+	DataChannels int      `json:"data_channels,omitempty"`
 }
 
 type DownloadState struct {
@@ -103,43 +152,98 @@ type DownloadState struct {
 	Progress        *progressbar.ProgressBar
 	PieceStatus     []bool // true if piece is downloaded
 	PieceAssignees  map[int]peer.ID
-	pieceBuffers    map[int][][]byte // Buffer to reassemble chunks into pieces
+	received        map[int]*pieceProgress // chunks written so far of pieces in progress
 	mu              sync.Mutex
 	completedPieces int
 	pieceTimers     map[int]*time.Timer // Timers for each piece
 	retryCounts     map[int]int         // Retry counts for exponential backoff
+	Shareable       bool                // serve verified pieces to other peers while downloading
+	Path            string              // partial .download file
+	Sequential      bool                // fetch pieces in playback order from the read cursor
+	cursor          int
+	changed         chan struct{}            // closed and replaced on every state change
+	lacking         map[peer.ID]map[int]bool // pieces a partial seeder reported it does not have
+	done            chan struct{}            // closed when downloadFile returns
+	err             error                    // why the download stopped early, set before done is closed
 }
 
-var (
-	manifestWaiters = make(map[string]chan controlMessage)
-	manifestChMu    sync.Mutex
-)
-
 func setupGracefulShutdown(h host.Host) {
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
-		<-ch
-		log.Println("Shutting down gracefully...")
+		for sig := range ch {
+			if sig == syscall.SIGINT && foreground.interrupt() {
+				fmt.Println("\nCancelling... (press Ctrl-C again to quit)")
+				continue
+			}
+			break
+		}
+		logger.Info("shutting down gracefully")
 		_ = h.Close()
 		os.Exit(0)
 	}()
 }
 
-func NewClient(h host.Host, d *dht.IpfsDHT, repo *db.Repository) *Client {
+// foregroundCommand lets Ctrl-C cancel the long-running command in the REPL
+// instead of quitting the client.
+type foregroundCommand struct {
+	mu     sync.Mutex
+	cancel context.CancelFunc
+}
+
+var foreground foregroundCommand
+
+// start returns the context of a new foreground command and the function
+// that ends it.
+func (f *foregroundCommand) start() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	f.mu.Lock()
+	f.cancel = cancel
+	f.mu.Unlock()
+	return ctx, func() {
+		f.mu.Lock()
+		f.cancel = nil
+		f.mu.Unlock()
+		cancel()
+	}
+}
+
+// interrupt cancels the running foreground command, if any, and reports
+// whether there was one.
+func (f *foregroundCommand) interrupt() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cancel == nil {
+		return false
+	}
+	f.cancel()
+	f.cancel = nil
+	return true
+}
+
+func NewClient(h host.Host, d, names *dht.IpfsDHT, repo *db.Repository, gater *p2p.Gater) *Client {
 	c := &Client{
 		host:            h,
 		dht:             d,
+		names:           names,
 		webRTCPeers:     make(map[peer.ID]*webRTC.SimpleWebRTCPeer),
 		sharingFiles:    make(map[string]*FileInfo),
 		activeDownloads: make(map[string]*DownloadState),
 		db:              repo,
-		unackedChunks:   make(map[string]map[int64]map[int]controlMessage),
-		congestionCtrl:  make(map[peer.ID]time.Duration),
 		pingTimes:       make(map[peer.ID]time.Time),
-		rttMeasurements: make(map[peer.ID][]time.Duration),
-	}
-	go c.monitorCongestion()
+		pieceTimeout:    PieceTimeout,
+		dataChannels:    loadDataChannels(),
+		storage:         loadStorageConfig(),
+		seeding:         loadSeedingConfig(),
+		output:          loadOutputConfig(),
+		shares:          loadShareConfig(),
+		gater:           gater,
+		policy:          loadPeerPolicy(),
+		compression:     loadCompressionConfig(),
+	}
+	c.loadPeerRules()
+	c.httpServer = newStreamServer(c)
+	go c.pingPeers()
 	return c
 }
 
@@ -148,36 +252,63 @@ func main() {
 	defer cancel()
 
 	if err := godotenv.Load(); err != nil {
-		log.Printf("Warning: Could not load .env file: %v", err)
+		logger.Warn("could not load .env file", logging.KeyErr, err)
+	}
+	if err := logging.Init(); err != nil {
+		logger.Warn("invalid logging configuration, using defaults", logging.KeyErr, err)
 	}
 
 	DB := db.InitDB()
 	if DB == nil {
-		log.Fatal("Database initialization failed")
+		logger.Error("database initialization failed")
+		os.Exit(1)
 	}
 
+	repo := db.NewRepository(DB)
+	gater := p2p.NewGater()
 	h, d, err := p2p.NewHost(
 		ctx,
 		"/ip4/0.0.0.0/tcp/0",
+		gater,
 		nil, // temporarily, if you don’t have client yet
 	)
 	if err != nil {
-		log.Fatal("Failed to create libp2p host:", err)
+		logger.Error("failed to create libp2p host", logging.KeyErr, err)
+		os.Exit(1)
 	}
 	defer h.Close()
 
 	go func() {
 		if err := p2p.Bootstrap(ctx, h, d); err != nil {
-			log.Printf("Error bootstrapping DHT: %v", err)
+			dhtLog.Error("bootstrapping DHT failed", logging.KeyErr, err)
 		}
 	}()
 
+	names, err := naming.NewDHT(ctx, h)
+	if err != nil {
+		logger.Error("failed to create name DHT", logging.KeyErr, err)
+		os.Exit(1)
+	}
+
 	setupGracefulShutdown(h)
 
-	repo := db.NewRepository(DB)
-	client := NewClient(h, d, repo)
+	client := NewClient(h, d, names, repo, gater)
 	client.startDHTMaintenance()
+	client.startGarbageCollector()
+	client.startSeedLimitEnforcer()
+	client.startReprovider()
+	client.startMetrics()
+	if os.Getenv("TORRENTIUM_HTTP_ADDR") != "" {
+		if err := client.httpServer.start(); err != nil {
+			httpLog.Warn("HTTP server not started", logging.KeyErr, err)
+		}
+	}
 	p2p.RegisterSignalingProtocol(h, client.handleWebRTCOffer)
+	if cfg := loadWatchConfig(); len(cfg.Dirs) > 0 {
+		if _, err := client.startWatching(cfg); err != nil {
+			watchLog.Warn("not watching folders", logging.KeyErr, err)
+		}
+	}
 
 	client.commandLoop()
 }
@@ -200,10 +331,50 @@ func (c *Client) commandLoop() {
 		case "help":
 			c.printInstructions()
 		case "add":
+			path, opts, perr := parseAddArgs(args)
+			if perr != nil {
+				fmt.Println("Usage: add [--encrypt] [--allow <peer>[,<peer>...]] [--piece-size <size>] <path>")
+				err = perr
+			} else {
+				ctx, done := foreground.start()
+				err = c.addFile(ctx, path, opts)
+				done()
+			}
+		case "remove":
+			if len(args) != 1 {
+				fmt.Println("Usage: remove <cid> | remove --missing")
+			} else if args[0] == "--missing" {
+				err = c.removeMissing()
+			} else {
+				err = c.removeFile(args[0])
+			}
+		case "allow", "revoke":
+			if len(args) != 2 {
+				fmt.Printf("Usage: %s <cid> <peer>\n", cmd)
+			} else if cmd == "allow" {
+				err = c.allowPeer(args[0], args[1])
+			} else {
+				err = c.revokePeer(args[0], args[1])
+			}
+		case "block", "unblock", "trust":
+			if len(args) < 1 || (cmd != "block" && len(args) != 1) {
+				fmt.Printf("Usage: %s <peer>\n", cmd)
+			} else {
+				err = c.setPeerRule(cmd, args[0], strings.Join(args[1:], " "))
+			}
+		case "rules":
+			err = c.listPeerRules()
+		case "acl":
 			if len(args) != 1 {
-				fmt.Println("Usage: add <path>")
+				fmt.Println("Usage: acl <cid>")
 			} else {
-				err = c.addFile(args[0])
+				err = c.showACL(args[0])
+			}
+		case "unrestrict":
+			if len(args) != 1 {
+				fmt.Println("Usage: unrestrict <cid>")
+			} else {
+				err = c.unrestrict(args[0])
 			}
 		case "list":
 			c.listLocalFiles()
@@ -219,11 +390,53 @@ func (c *Client) commandLoop() {
 				}
 			}
 		case "download":
+			if len(args) < 1 {
+				fmt.Println("Usage: download <cid|peer/name|torrentium:URI>[#<key>] [--key <key>] [--out <path>] [--on-conflict rename|overwrite|skip] [--no-seed] [--seed-ratio <r>] [--seed-time <duration>]")
+			} else {
+				var opts downloadOptions
+				var target string
+				if opts, err = parseDownloadArgs(args[1:]); err == nil {
+					if target, err = c.resolveTarget(args[0], &opts); err == nil {
+						err = c.downloadFile(target, opts)
+					}
+				}
+			}
+		case "stream":
+			if len(args) < 1 {
+				fmt.Println("Usage: stream <cid|peer/name|torrentium:URI> [download options]")
+			} else {
+				var opts downloadOptions
+				var target string
+				if opts, err = parseDownloadArgs(args[1:]); err == nil {
+					if target, err = c.resolveTarget(args[0], &opts); err == nil {
+						err = c.streamFile(target, opts)
+					}
+				}
+			}
+		case "share":
 			if len(args) != 1 {
-				fmt.Println("Usage: download <cid>")
+				fmt.Println("Usage: share <cid>")
+			} else {
+				err = c.printShareURI(args[0])
+			}
+		case "publish":
+			if len(args) != 2 {
+				fmt.Println("Usage: publish <name> <cid>")
 			} else {
-				err = c.downloadFile(args[0])
+				err = c.publishName(args[0], args[1])
 			}
+		case "seeds":
+			err = c.listSeeds()
+		case "pin", "unpin":
+			if len(args) != 1 {
+				fmt.Printf("Usage: %s <cid>\n", cmd)
+			} else {
+				err = c.setPinned(args[0], cmd == "pin")
+			}
+		case "gc":
+			err = c.runGC()
+		case "storage":
+			err = c.showStorage()
 		case "peers":
 			c.listConnectedPeers()
 		case "connect":
@@ -253,7 +466,7 @@ func (c *Client) commandLoop() {
 			fmt.Println("Unknown command. Type 'help' for available commands.")
 		}
 		if err != nil {
-			log.Printf("Error: %v", err)
+			fmt.Printf("Error: %v\n", err)
 		}
 	}
 }
@@ -261,13 +474,30 @@ func (c *Client) commandLoop() {
 func (c *Client) printInstructions() {
 	fmt.Println("\n=== Decentralized P2P File Sharing ===")
 	fmt.Println("Commands:")
-	fmt.Println(" add <path>           - Share a file on the network")
+	fmt.Println(" add <path>           - Share a file on the network (--encrypt, --allow <peer>,..., --piece-size)")
 	fmt.Println(" list                 - List your shared files")
+	fmt.Println(" share <cid>          - Print a torrentium: URI that lists us as a provider")
+	fmt.Println(" remove <cid>         - Stop sharing a file (--missing: all files deleted from disk)")
 	fmt.Println(" search <cid|text>    - Search by CID or filename text")
-	fmt.Println(" download <cid>       - Download a file by CID")
+	fmt.Println(" download <cid>       - Download a file by CID, share link, torrentium: URI or peer/name (--key, --out, --on-conflict, --no-seed, --seed-ratio, --seed-time)")
+	fmt.Println(" stream <cid>         - Download in playback order and serve it over local HTTP")
+	fmt.Println(" allow <cid> <peer>   - Serve a shared file only to listed peers")
+	fmt.Println(" revoke <cid> <peer>  - Remove a peer from a file's allowlist")
+	fmt.Println(" acl <cid>            - Show the allowlist of a shared file")
+	fmt.Println(" unrestrict <cid>     - Serve a restricted file to anyone again")
+	fmt.Println(" seeds                - Show completed downloads being seeded")
+	fmt.Println(" pin <cid>            - Never evict a downloaded file")
+	fmt.Println(" unpin <cid>          - Allow a downloaded file to be evicted")
+	fmt.Println(" storage              - Show storage usage and downloads")
+	fmt.Println(" gc                   - Enforce storage quota and prune orphaned data")
 	fmt.Println(" peers                - Show connected peers")
+	fmt.Println(" block <peer> [why]   - Refuse all connections from a peer")
+	fmt.Println(" unblock <peer>       - Lift a block and reset the peer's score")
+	fmt.Println(" trust <peer>         - Never ban a peer (required with TORRENTIUM_TRUSTED_ONLY)")
+	fmt.Println(" rules                - Show blocked and trusted peers")
 	fmt.Println(" connect <multiaddr>  - Manually connect to a peer")
 	fmt.Println(" announce <cid>       - Re-announce a file to DHT")
+	fmt.Println(" publish <name> <cid> - Point <your peer ID>/<name> at a CID")
 	fmt.Println(" health               - Check connection health")
 	fmt.Println(" nettest              - Perform comprehensive network diagnostics")
 	fmt.Println(" localtest            - Test local WebRTC functionality")
@@ -299,6 +529,8 @@ func (c *Client) debugNetworkStatus() {
 	routingTableSize := c.dht.RoutingTable().Size()
 	fmt.Printf("\nDHT Routing Table Size: %d\n", routingTableSize)
 
+	c.sharingMux.RLock()
+	defer c.sharingMux.RUnlock()
 	fmt.Printf("\nShared Files (%d):\n", len(c.sharingFiles))
 	for cid, fileInfo := range c.sharingFiles {
 		fmt.Printf(" CID: %s\n", cid)
@@ -315,7 +547,7 @@ func (c *Client) announceFile(cidStr string) error {
 	fmt.Printf("Re-announcing CID %s to DHT...\n", cidStr)
 	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
 	defer cancel()
-	if err := c.dht.Provide(ctx, fileCID, true); err != nil {
+	if err := c.provide(ctx, fileCID); err != nil {
 		return fmt.Errorf("failed to announce: %w", err)
 	}
 	fmt.Println(" - Successfully announced to DHT")
@@ -327,12 +559,12 @@ func (c *Client) startDHTMaintenance() {
 		ticker := time.NewTicker(10 * time.Minute)
 		defer ticker.Stop()
 		for range ticker.C {
-			log.Println("Performing DHT maintenance...")
+			dhtLog.Debug("performing DHT maintenance")
 			c.dht.RefreshRoutingTable()
 			peers := c.host.Network().Peers()
-			log.Printf("Connected to %d peers", len(peers))
+			dhtLog.Info("DHT maintenance", "peers", len(peers))
 			if len(peers) < 5 {
-				log.Println("Low peer count; re-bootstrapping...")
+				dhtLog.Warn("low peer count, re-bootstrapping", "peers", len(peers))
 				ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
 				_ = p2p.Bootstrap(ctx, c.host, c.dht)
 				cancel()
@@ -428,7 +660,7 @@ func (c *Client) performLocalWebRTCTest() {
 
 	// Create a simple WebRTC peer for testing
 	testPeer, err := webRTC.NewSimpleWebRTCPeer(func(msg webrtc.DataChannelMessage, peer *webRTC.SimpleWebRTCPeer) {
-		log.Printf("Test received message: %s", string(msg.Data))
+		logger.Info("test received message", "data", string(msg.Data))
 	}, func(peerID peer.ID) {
 		// No-op for this test
 	})
@@ -455,86 +687,183 @@ func (c *Client) performLocalWebRTCTest() {
 	fmt.Println("If downloads still fail, the issue is likely in the peer-to-peer signaling")
 }
 
-func (c *Client) addFile(filePath string) error {
-	ctx := context.Background()
+// addFile shares the file at filePath and prints how to fetch it. Cancelling
+// ctx stops hashing it; nothing is recorded for a file until all of it has
+// been hashed.
+func (c *Client) addFile(ctx context.Context, filePath string, opts addOptions) error {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to get file info: %w", err)
+	}
+	// Fail before encrypting or hashing; shareFile checks the final size again.
+	if opts.PieceSize > 0 {
+		if err := checkPieceCount(info.Size(), opts.PieceSize); err != nil {
+			return err
+		}
+	}
+	bar := progressbar.DefaultBytes(info.Size(), "hashing...")
+	shared, err := c.shareFile(ctx, filePath, opts, func(n int) { _ = bar.Add(n) })
+	_ = bar.Finish()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("✓ File '%s' is now being shared\n", shared.Info.Name)
+	fmt.Printf(" CID: %s\n", shared.CID)
+	fmt.Printf(" Hash: %s\n", shared.Info.Hash)
+	fmt.Printf(" Size: %s\n", humanize.Bytes(uint64(shared.Info.Size)))
+	if shared.Key != nil {
+		fmt.Printf(" Share link: %s#%s\n", shared.CID, crypt.EncodeKey(shared.Key))
+		fmt.Println(" Only holders of the share link can read the file.")
+	}
+	if len(opts.Allow) > 0 {
+		fmt.Printf(" Allowed peers: %d\n", len(opts.Allow))
+	}
+	if u, err := c.shareURI(ctx, shared.CID.String()); err == nil {
+		fmt.Printf(" Share URI: %s\n", u)
+	}
+	return nil
+}
+
+// sharedFile is a file that shareFile has recorded and announced.
+type sharedFile struct {
+	CID  cid.Cid
+	Info FileInfo
+	Key  []byte // set for encrypted shares
+}
+
+// shareFile hashes, records and announces the file at filePath. progress,
+// if set, is called with the number of bytes hashed.
+func (c *Client) shareFile(ctx context.Context, filePath string, opts addOptions, progress func(int)) (_ sharedFile, err error) {
+	name := filepath.Base(filePath)
+	var key []byte
+	if opts.Encrypt {
+		// Everything below works on the ciphertext: peers and the DHT never
+		// see the plaintext or its hash.
+		encPath, k, err := c.encryptForSharing(filePath)
+		if err != nil {
+			return sharedFile{}, err
+		}
+		filePath, key = encPath, k
+	}
+	// A failed share leaves nothing behind: not the ciphertext of an
+	// encrypted share, and not the records of a CID we did not share before.
+	var recorded string
+	defer func() {
+		if err == nil {
+			return
+		}
+		if opts.Encrypt {
+			os.Remove(filePath)
+		}
+		if recorded != "" {
+			if err := c.db.DeleteShare(context.WithoutCancel(ctx), recorded); err != nil {
+				storageLog.Warn("failed to clean up records of failed share", logging.KeyCID, recorded, logging.KeyErr, err)
+			}
+		}
+	}()
 	f, err := os.Open(filePath)
 	if err != nil {
-		return fmt.Errorf("failed to open file: %w", err)
+		return sharedFile{}, fmt.Errorf("failed to open file: %w", err)
 	}
 	defer f.Close()
 
 	info, err := f.Stat()
 	if err != nil {
-		return fmt.Errorf("failed to get file info: %w", err)
+		return sharedFile{}, fmt.Errorf("failed to get file info: %w", err)
 	}
 
-	hasher := sha256.New()
-	if _, err := io.Copy(hasher, f); err != nil {
-		return fmt.Errorf("failed to calculate hash: %w", err)
+	pieceSz := opts.PieceSize
+	if pieceSz == 0 {
+		pieceSz = choosePieceSize(info.Size())
+	} else if err := checkPieceCount(info.Size(), pieceSz); err != nil {
+		return sharedFile{}, err
 	}
 
-	fileHashBytes := hasher.Sum(nil)
-	fileHashStr := hex.EncodeToString(fileHashBytes)
-	mhash, err := multihash.Encode(fileHashBytes, multihash.SHA2_256)
+	// One pass over the file yields both the file hash, which makes up the
+	// CID, and the piece hashes.
+	hashes, err := hashFile(ctx, f, info.Size(), pieceSz, progress)
 	if err != nil {
-		return fmt.Errorf("failed to create multihash: %w", err)
+		if errors.Is(err, context.Canceled) {
+			return sharedFile{}, fmt.Errorf("add cancelled")
+		}
+		return sharedFile{}, fmt.Errorf("failed to calculate hash: %w", err)
+	}
+
+	fileHashStr := hex.EncodeToString(hashes.file)
+	mhash, err := multihash.Encode(hashes.file, multihash.SHA2_256)
+	if err != nil {
+		return sharedFile{}, fmt.Errorf("failed to create multihash: %w", err)
 	}
 
 	fileCID := cid.NewCidV1(cid.Raw, mhash)
+	if opts.Encrypt {
+		encPath := filepath.Join(c.shares.EncryptedDir, fileCID.String()+".enc")
+		if err := os.Rename(filePath, encPath); err != nil {
+			return sharedFile{}, fmt.Errorf("failed to store encrypted file: %w", err)
+		}
+		filePath = encPath
+	}
 
-	// Create pieces manifest
-	pieceSz := int64(DefaultPieceSize)
-	numPieces := (info.Size() + pieceSz - 1) / pieceSz
-	if _, err := f.Seek(0, io.SeekStart); err != nil {
-		return err
+	// Once hashed, the file is recorded even if ctx is cancelled meanwhile;
+	// only the announcement below can still be interrupted.
+	storeCtx := context.WithoutCancel(ctx)
+	pieces := make([]db.Piece, len(hashes.pieces))
+	for idx, ph := range hashes.pieces {
+		offset := int64(idx) * pieceSz
+		pieces[idx] = db.Piece{Index: int64(idx), Offset: offset, Size: min64(pieceSz, info.Size()-offset), Hash: ph}
+	}
+	if _, err := c.db.GetLocalFileByCID(storeCtx, fileCID.String()); errors.Is(err, sql.ErrNoRows) {
+		recorded = fileCID.String()
+	}
+	if err := c.db.AddPieces(storeCtx, fileCID.String(), pieces, true); err != nil {
+		return sharedFile{}, fmt.Errorf("failed to store pieces: %w", err)
 	}
 
-	for idx := int64(0); idx < numPieces; idx++ {
-		offset := idx * pieceSz
-		size := min64(pieceSz, info.Size()-offset)
-		h := sha256.New()
-		if _, err := io.CopyN(h, f, size); err != nil {
-			return err
-		}
-		ph := hex.EncodeToString(h.Sum(nil))
-		if err := c.db.UpsertPiece(ctx, fileCID.String(), idx, offset, size, ph, true); err != nil {
-			return err
+	if err := c.db.AddLocalFile(storeCtx, fileCID.String(), name, info.Size(), filePath, fileHashStr, pieceSz); err != nil {
+		return sharedFile{}, fmt.Errorf("failed to store file metadata: %w", err)
+	}
+	if key != nil {
+		if err := c.db.SetShareKey(storeCtx, fileCID.String(), crypt.EncodeKey(key)); err != nil {
+			return sharedFile{}, fmt.Errorf("failed to store share key: %w", err)
 		}
 	}
-
-	if err := c.db.AddLocalFile(ctx, fileCID.String(), info.Name(), info.Size(), filePath, fileHashStr); err != nil {
-		return fmt.Errorf("failed to store file metadata: %w", err)
+	if err := c.db.SetFileModTime(storeCtx, fileCID.String(), info.ModTime().UnixNano()); err != nil {
+		return sharedFile{}, fmt.Errorf("failed to store modification time: %w", err)
+	}
+	for _, pid := range opts.Allow {
+		if err := c.db.AllowPeer(storeCtx, fileCID.String(), pid.String()); err != nil {
+			return sharedFile{}, fmt.Errorf("failed to store allowlist: %w", err)
+		}
 	}
 
-	c.sharingFiles[fileCID.String()] = &FileInfo{
+	fi := FileInfo{
 		FilePath: filePath,
 		Hash:     fileHashStr,
 		Size:     info.Size(),
-		Name:     info.Name(),
+		Name:     name,
 		PieceSz:  pieceSz,
 	}
+	c.sharingMux.Lock()
+	c.sharingFiles[fileCID.String()] = &fi
+	c.sharingMux.Unlock()
 
-	log.Printf("Announcing file %s with CID %s to DHT...", info.Name(), fileCID.String())
+	dhtLog.Info("announcing file", "name", name, logging.KeyCID, fileCID)
 	provideCtx, cancel := context.WithTimeout(ctx, 60*time.Second)
 	defer cancel()
-	if err := c.dht.Provide(provideCtx, fileCID, true); err != nil {
-		log.Printf(" - Warning: Failed to announce to DHT: %v", err)
+	if err := c.provide(provideCtx, fileCID); err != nil {
+		dhtLog.Warn("failed to announce file", logging.KeyCID, fileCID, logging.KeyErr, err)
 	} else {
-		log.Println(" - Successfully announced file to DHT")
+		dhtLog.Info("announced file", logging.KeyCID, fileCID)
 	}
-
-	fmt.Printf("✓ File '%s' is now being shared\n", info.Name())
-	fmt.Printf(" CID: %s\n", fileCID.String())
-	fmt.Printf(" Hash: %s\n", fileHashStr)
-	fmt.Printf(" Size: %s\n", humanize.Bytes(uint64(info.Size())))
-	return nil
+	return sharedFile{CID: fileCID, Info: fi, Key: key}, nil
 }
 
 func (c *Client) listLocalFiles() {
 	ctx := context.Background()
 	files, err := c.db.GetLocalFiles(ctx)
 	if err != nil {
-		log.Printf("Error retrieving files: %v", err)
+		fmt.Printf("Error retrieving files: %v\n", err)
 		return
 	}
 	if len(files) == 0 {
@@ -547,6 +876,14 @@ func (c *Client) listLocalFiles() {
 		fmt.Printf(" CID: %s\n", file.CID)
 		fmt.Printf(" Size: %s\n", humanize.Bytes(uint64(file.FileSize)))
 		fmt.Printf(" Path: %s\n", file.FilePath)
+		if file.ShareKey != "" {
+			fmt.Printf(" Share link: %s#%s\n", file.CID, file.ShareKey)
+		}
+		if file.Restricted {
+			if peers, err := c.db.GetAllowedPeers(ctx, file.CID); err == nil {
+				fmt.Printf(" Allowed peers: %d\n", len(peers))
+			}
+		}
 		fmt.Println(" ---")
 	}
 }
@@ -606,6 +943,8 @@ func (c *Client) enhancedSearchByCID(cidStr string) error {
 func (c *Client) findProvidersWithTimeout(id cid.Cid, timeout time.Duration, maxProviders int) ([]peer.AddrInfo, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
+	start := time.Now()
+	defer func() { metrics.DHTFindProvidersDuration.Observe(time.Since(start).Seconds()) }()
 	providersChan := c.dht.FindProvidersAsync(ctx, id, maxProviders)
 	var providers []peer.AddrInfo
 	var totalFound int
@@ -671,24 +1010,128 @@ func (c *Client) listConnectedPeers() {
 		if len(conn) > 0 {
 			fmt.Printf("Peer: %s\n", peerID)
 			fmt.Printf(" Address: %s\n", conn[0].RemoteMultiaddr())
+			if s := c.sessions.get(peerID); s != nil {
+				fmt.Printf(" Client: %s (protocol %d, %d data channels)\n", s.Client, s.Version, s.DataChannels)
+				if len(s.Features) > 0 {
+					fmt.Printf(" Features: %s\n", strings.Join(s.Features, ", "))
+				}
+			}
+			if w := c.windows.lookup(peerID); w != nil {
+				fmt.Printf(" Upload: %s\n", w)
+			}
+		}
+	}
+}
+
+// downloadOptions are the per-download flags accepted by the download command.
+type downloadOptions struct {
+	Out        string
+	OnConflict string
+	NoSeed     bool
+	SeedRatio  float64
+	SeedTime   time.Duration
+	Stream     bool
+	Key        string          // share key of an encrypted share
+	Hints      []peer.AddrInfo // providers from a share URI, tried before the DHT
+	Size       int64           // expected file size from a share URI
+	PiecesRoot string          // expected pieces root from a share URI
+}
+
+func parseDownloadArgs(args []string) (downloadOptions, error) {
+	var opts downloadOptions
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--out":
+			if i+1 >= len(args) {
+				return opts, fmt.Errorf("--out requires a path")
+			}
+			i++
+			opts.Out = args[i]
+		case "--on-conflict":
+			if i+1 >= len(args) {
+				return opts, fmt.Errorf("--on-conflict requires a policy")
+			}
+			i++
+			if !validConflictPolicy(args[i]) {
+				return opts, fmt.Errorf("invalid conflict policy %q (use rename, overwrite or skip)", args[i])
+			}
+			opts.OnConflict = args[i]
+		case "--key":
+			if i+1 >= len(args) {
+				return opts, fmt.Errorf("--key requires a share key")
+			}
+			i++
+			opts.Key = args[i]
+		case "--no-seed":
+			opts.NoSeed = true
+		case "--seed-ratio":
+			if i+1 >= len(args) {
+				return opts, fmt.Errorf("--seed-ratio requires a value")
+			}
+			i++
+			ratio, err := strconv.ParseFloat(args[i], 64)
+			if err != nil || ratio <= 0 {
+				return opts, fmt.Errorf("invalid seed ratio %q", args[i])
+			}
+			opts.SeedRatio = ratio
+		case "--seed-time":
+			if i+1 >= len(args) {
+				return opts, fmt.Errorf("--seed-time requires a value")
+			}
+			i++
+			d, err := time.ParseDuration(args[i])
+			if err != nil || d <= 0 {
+				return opts, fmt.Errorf("invalid seed time %q", args[i])
+			}
+			opts.SeedTime = d
+		default:
+			return opts, fmt.Errorf("unknown download option %q", args[i])
 		}
 	}
+	return opts, nil
 }
 
-func (c *Client) downloadFile(cidStr string) error {
+func (c *Client) downloadFile(cidStr string, opts downloadOptions) error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	cidStr, linkKey := splitShareLink(cidStr)
+	if opts.Key == "" {
+		opts.Key = linkKey
+	}
 	fileCID, err := cid.Decode(cidStr)
 	if err != nil {
 		return fmt.Errorf("invalid CID: %w", err)
 	}
+	var key []byte
+	if opts.Key != "" {
+		if key, err = crypt.DecodeKey(opts.Key); err != nil {
+			return err
+		}
+	}
 
-	fmt.Printf("Looking for providers of CID: %s\n", fileCID.String())
-	providers, err := c.findProvidersWithTimeout(fileCID, 60*time.Second, MaxProviders)
-	if err != nil {
-		return fmt.Errorf("provider search failed: %w", err)
+	var providers []peer.AddrInfo
+	if len(opts.Hints) > 0 {
+		providers = c.dialHints(ctx, opts.Hints)
+		fmt.Printf("Reached %d of %d hinted providers\n", len(providers), len(opts.Hints))
 	}
+	if len(providers) == 0 {
+		fmt.Printf("Looking for providers of CID: %s\n", fileCID.String())
+		if providers, err = c.findProvidersWithTimeout(fileCID, 60*time.Second, MaxProviders); err != nil {
+			return fmt.Errorf("provider search failed: %w", err)
+		}
+	}
+
+	allowed := providers[:0]
+	for _, p := range providers {
+		if c.peerAllowed(p.ID) {
+			allowed = append(allowed, p)
+		}
+	}
+	if len(allowed) == 0 && len(providers) > 0 {
+		return fmt.Errorf("no providers found: all %d providers are blocked or untrusted", len(providers))
+	}
+	providers = allowed
 
 	if len(providers) == 0 {
 		return fmt.Errorf("no providers found")
@@ -699,34 +1142,35 @@ func (c *Client) downloadFile(cidStr string) error {
 
 	var manifest controlMessage
 	var firstPeer *webRTC.SimpleWebRTCPeer
+	denied := false
 
 	for _, p := range providers {
 		// Try direct connection first
 		peerConn, err := c.initiateWebRTCConnectionWithRetry(p.ID, 1)
 		if err != nil {
 			// Fallback: relay connection
-			log.Println("🔁 Direct connection failed, trying relay...")
+			transferLog.Info("direct connection failed, trying relay", logging.KeyPeer, p.ID, logging.KeyErr, err)
 
 			// Build circuit address
 			circuitStr := fmt.Sprintf("%s/p2p-circuit/p2p/%s", relayAddrStr, p.ID.String())
 			circuitMaddr, err := multiaddr.NewMultiaddr(circuitStr)
 			if err != nil {
-				log.Printf("Invalid circuit multiaddr: %v", err)
+				transferLog.Warn("invalid circuit multiaddr", "addr", circuitStr, logging.KeyErr, err)
 				continue
 			}
 			targetInfo := peer.AddrInfo{ID: p.ID, Addrs: []multiaddr.Multiaddr{circuitMaddr}}
 
 			if err := c.host.Connect(ctx, targetInfo); err != nil {
-				log.Printf("❌ Relay dial failed: %v", err)
+				transferLog.Warn("relay dial failed", logging.KeyPeer, p.ID, logging.KeyErr, err)
 				continue
 			}
 
-			log.Printf("✅ Relay dial to %s successful", p.ID)
+			transferLog.Info("relay dial successful", logging.KeyPeer, p.ID)
 
 			// Now perform WebRTC handshake
 			peerConn, err = c.initiateWebRTCConnectionWithRetry(p.ID, 1)
 			if err != nil {
-				log.Printf("⚠ WebRTC connection via relay failed: %v", err)
+				transferLog.Warn("WebRTC connection via relay failed", logging.KeyPeer, p.ID, logging.KeyErr, err)
 				continue
 			}
 		}
@@ -734,32 +1178,86 @@ func (c *Client) downloadFile(cidStr string) error {
 		// If WebRTC connected, fetch manifest
 		if peerConn != nil {
 			manifest, err = c.requestManifest(peerConn, cidStr)
+			if err == nil {
+				if err = checkManifestHints(manifest, opts); err != nil {
+					transferLog.Warn("manifest does not match share URI", logging.KeyPeer, p.ID, logging.KeyCID, cidStr, logging.KeyErr, err)
+				}
+			}
 			if err == nil {
 				firstPeer = peerConn
 				break
 			}
+			denied = denied || errors.Is(err, errAccessDenied)
 			peerConn.Close()
 		}
 	}
 
 	if firstPeer == nil {
+		if denied {
+			return fmt.Errorf("%w: this peer is not on the allowlist of %s", errAccessDenied, cidStr)
+		}
 		return fmt.Errorf("failed to connect to any provider to get manifest")
 	}
 
-	// Store pieces in the database
-	for _, piece := range manifest.Pieces {
-		if err := c.db.UpsertPiece(ctx, cidStr, piece.Index, piece.Offset, piece.Size, piece.Hash, false); err != nil {
-			log.Printf("Failed to store piece info for download: %v", err)
+	if manifest.Encrypted {
+		if key == nil {
+			firstPeer.Close()
+			return fmt.Errorf("%s is an encrypted share: use its share link or --key", cidStr)
+		}
+		if opts.Stream {
+			firstPeer.Close()
+			return fmt.Errorf("encrypted shares cannot be streamed")
+		}
+		if manifest.Filename, err = crypt.OpenName(key, manifest.Filename); err != nil {
+			firstPeer.Close()
+			return fmt.Errorf("wrong share key for %s", cidStr)
 		}
 	}
+	// Private content must not spread beyond the peers it was given to.
+	private := manifest.Encrypted || manifest.Restricted
 
-	downloadPath := fmt.Sprintf("%s.download", manifest.Filename)
-	finalPath := manifest.Filename
-	localFile, err := os.Create(downloadPath)
+	// The filename comes from the remote peer; never trust it as a path.
+	manifest.Filename = sanitizeFilename(manifest.Filename, cidStr)
+	policy := c.output.OnConflict
+	if opts.OnConflict != "" {
+		policy = opts.OnConflict
+	}
+	finalPath, err := resolveOutputPath(c.output.Dir, opts.Out, manifest.Filename, cidStr)
+	if err != nil {
+		firstPeer.Close()
+		return err
+	}
+	if absPath, err := filepath.Abs(finalPath); err == nil {
+		finalPath = absPath
+	}
+	finalPath, localFile, err := reserveOutputPath(finalPath, policy)
 	if err != nil {
 		firstPeer.Close()
+		if errors.Is(err, errDownloadSkipped) {
+			fmt.Printf("Skipping download: %v\n", err)
+			return nil
+		}
 		return fmt.Errorf("failed to create file: %w", err)
 	}
+	downloadPath := finalPath + partialSuffix
+
+	if err := c.ensureSpace(ctx, manifest.TotalSize); err != nil {
+		localFile.Close()
+		os.Remove(downloadPath)
+		firstPeer.Close()
+		return err
+	}
+	if err := c.db.StartDownload(ctx, cidStr, manifest.Filename, manifest.TotalSize, downloadPath, manifest.HashHex); err != nil {
+		localFile.Close()
+		os.Remove(downloadPath)
+		firstPeer.Close()
+		return fmt.Errorf("failed to record download: %w", err)
+	}
+
+	// Store pieces in the database
+	if err := c.db.AddPieces(ctx, cidStr, manifest.Pieces, false); err != nil {
+		logger.Error("failed to store piece info for download", logging.KeyCID, cidStr, logging.KeyErr, err)
+	}
 
 	pieces, _ := c.db.GetPieces(ctx, cidStr)
 	if len(pieces) == 0 {
@@ -775,14 +1273,32 @@ func (c *Client) downloadFile(cidStr string) error {
 		Progress:        progressbar.DefaultBytes(manifest.TotalSize, "downloading..."),
 		PieceStatus:     make([]bool, int(manifest.NumPieces)),
 		PieceAssignees:  make(map[int]peer.ID),
-		pieceBuffers:    make(map[int][][]byte),
+		received:        make(map[int]*pieceProgress),
 		completedPieces: 0,
 		pieceTimers:     make(map[int]*time.Timer),
 		retryCounts:     make(map[int]int),
+		Shareable:       c.seeding.Enabled && !opts.NoSeed && !private,
+		Path:            downloadPath,
+		Sequential:      opts.Stream,
+		changed:         make(chan struct{}),
+		lacking:         make(map[peer.ID]map[int]bool),
+		done:            make(chan struct{}),
 	}
 	c.downloadsMux.Lock()
 	c.activeDownloads[cidStr] = state
 	c.downloadsMux.Unlock()
+	metrics.ActiveDownloads.Inc()
+	defer func() {
+		c.downloadsMux.Lock()
+		delete(c.activeDownloads, cidStr)
+		c.downloadsMux.Unlock()
+		close(state.done)
+		metrics.ActiveDownloads.Dec()
+	}()
+
+	if state.Shareable {
+		go c.announcePartial(fileCID)
+	}
 
 	// Parallel downloads
 	var wg sync.WaitGroup
@@ -809,23 +1325,91 @@ func (c *Client) downloadFile(cidStr string) error {
 				var connErr error
 				peerConn, connErr = c.initiateWebRTCConnectionWithRetry(peerInfo.ID, 2)
 				if connErr != nil {
-					log.Printf("Chunk peer connect failed: %v", connErr)
+					transferLog.Warn("chunk peer connect failed", logging.KeyPeer, peerInfo.ID, logging.KeyErr, connErr)
+					if !state.Sequential {
+						// Hand this peer's share to the peers we are connected to.
+						state.mu.Lock()
+						for i := startPiece; i < endPiece; i++ {
+							if !state.PieceStatus[i] {
+								go c.reRequestPiece(state, i)
+							}
+						}
+						state.mu.Unlock()
+					}
 					return
 				}
 				defer peerConn.Close()
 			}
-			c.downloadChunksFromPeer(peerConn, state, startPiece, endPiece)
+			if state.Sequential {
+				c.streamPiecesFromPeer(peerConn, state)
+			} else {
+				c.downloadChunksFromPeer(peerConn, state, startPiece, endPiece)
+				// Keep the connection open until the requested pieces arrived.
+				state.waitForCompletion(peerConn.WaitForCloseChannel())
+			}
 		}(p, start, end)
 	}
 
-	<-state.Completed
+	// Every worker returns once its peer is gone, so if all of them are done
+	// before the last piece arrived nobody is left to send it.
+	workersDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(workersDone)
+	}()
+	select {
+	case <-state.Completed:
+	case <-workersDone:
+		state.mu.Lock()
+		complete := state.completedPieces == state.TotalPieces
+		if !complete {
+			state.err = errors.New("all providers disconnected")
+		}
+		err := state.err
+		state.mu.Unlock()
+		if !complete {
+			localFile.Close()
+			return fmt.Errorf("download of %s failed: %w", cidStr, err)
+		}
+	}
 	localFile.Close()
 
-	if err := os.Rename(downloadPath, finalPath); err != nil {
+	if err := verifyDownloadedFile(downloadPath, fileCID, manifest.HashHex); err != nil {
+		return fmt.Errorf("download verification failed: %w", err)
+	}
+
+	if _, err := os.Lstat(finalPath); err == nil && policy == ConflictRename {
+		// Another process created the target while we were downloading.
+		newPath, placeholder, err := reserveOutputPath(finalPath, policy)
+		if err != nil {
+			return err
+		}
+		placeholder.Close()
+		defer os.Remove(newPath + partialSuffix)
+		finalPath = newPath
+	}
+	size := manifest.TotalSize
+	if manifest.Encrypted {
+		if err := decryptDownload(downloadPath, finalPath, key); err != nil {
+			return fmt.Errorf("failed to decrypt download: %w", err)
+		}
+		if info, err := os.Stat(finalPath); err == nil {
+			size = info.Size()
+		}
+	} else if err := os.Rename(downloadPath, finalPath); err != nil {
 		return fmt.Errorf("failed to rename file: %w", err)
 	}
+	if err := c.db.AddDownload(ctx, cidStr, manifest.Filename, size, finalPath); err != nil {
+		logger.Error("failed to record completed download", logging.KeyCID, cidStr, logging.KeyErr, err)
+	}
 
 	fmt.Printf("\n✅ Download complete. File saved as %s\n", finalPath)
+
+	if c.seeding.Enabled && !opts.NoSeed && !private {
+		if err := c.seedDownload(ctx, fileCID, finalPath, manifest, opts); err != nil {
+			storageLog.Error("failed to seed downloaded file", logging.KeyCID, cidStr, logging.KeyErr, err)
+		}
+	}
 	return nil
 }
 
@@ -847,89 +1431,128 @@ func (c *Client) downloadChunksFromPeer(peer *webRTC.SimpleWebRTCPeer, state *Do
 
 		// New: Add piece timeout
 		state.mu.Lock()
-		state.pieceTimers[i] = time.AfterFunc(PieceTimeout, func() {
-			log.Printf("Piece %d timed out, re-requesting...", i)
+		state.pieceTimers[i] = time.AfterFunc(c.pieceTimeout, func() {
+			transferLog.Warn("piece timed out, re-requesting", logging.KeyCID, state.Manifest.CID, logging.KeyPiece, i)
 			c.reRequestPiece(state, i)
 		})
 		state.mu.Unlock()
 
 		if err := peer.SendJSONReliable(req); err != nil {
-			log.Printf("Failed to request piece %d from %s: %v", i, peer.GetSignalingStream().Conn().RemotePeer(), err)
+			transferLog.Warn("failed to request piece", logging.KeyPeer, peer.GetSignalingStream().Conn().RemotePeer(), logging.KeyPiece, i, logging.KeyErr, err)
 			return
 		}
 	}
 }
 
+// reRequestPiece asks a connected peer for a piece again after a backoff.
+// It must not be called with state.mu held.
 func (c *Client) reRequestPiece(state *DownloadState, pieceIndex int) {
 	// Re-assign to another peer with backoff
+	state.mu.Lock()
 	retryCount := state.retryCounts[pieceIndex]
-	backoff := ExponentialBackoffBase * time.Duration(1<<retryCount)
-	if backoff > MaxBackoff {
-		backoff = MaxBackoff
+	state.retryCounts[pieceIndex]++
+	state.mu.Unlock()
+	backoff := MaxBackoff
+	if retryCount < 6 {
+		backoff = ExponentialBackoffBase * time.Duration(1<<retryCount)
 	}
 	time.AfterFunc(backoff, func() {
-		// For simplicity, we'll just re-request from any connected peer.
-		// A more advanced implementation would select a new peer.
-		for _, p := range c.webRTCPeers {
-			req := controlMessage{
-				Command: "REQUEST_PIECE",
-				CID:     state.Manifest.CID,
-				Index:   int64(pieceIndex),
+		// Ask a connected peer that has not told us it lacks the piece, or
+		// any peer if they all did: a busy seeder may have it by now.
+		state.mu.Lock()
+		if state.PieceStatus[pieceIndex] {
+			state.mu.Unlock()
+			return
+		}
+		var preferred, fallback []*webRTC.SimpleWebRTCPeer
+		c.peersMux.RLock()
+		for pid, p := range c.webRTCPeers {
+			if state.lacking[pid][pieceIndex] {
+				fallback = append(fallback, p)
+			} else {
+				preferred = append(preferred, p)
 			}
+		}
+		c.peersMux.RUnlock()
+		state.mu.Unlock()
+		req := controlMessage{
+			Command: "REQUEST_PIECE",
+			CID:     state.Manifest.CID,
+			Index:   int64(pieceIndex),
+		}
+		for _, p := range append(preferred, fallback...) {
 			if err := p.SendJSONReliable(req); err == nil {
-				log.Printf("Re-requested piece %d from a different peer.", pieceIndex)
+				transferLog.Debug("re-requested piece", logging.KeyCID, state.Manifest.CID, logging.KeyPiece, pieceIndex)
 				return
 			}
 		}
-		log.Printf("Failed to re-request piece %d: no available peers.", pieceIndex)
+		transferLog.Warn("failed to re-request piece: no available peers", logging.KeyCID, state.Manifest.CID, logging.KeyPiece, pieceIndex)
 	})
-	state.retryCounts[pieceIndex]++
+}
+
+// waitForCompletion blocks until every piece has been downloaded or closed
+// is closed.
+func (s *DownloadState) waitForCompletion(closed <-chan struct{}) {
+	for {
+		s.mu.Lock()
+		done := s.completedPieces == s.TotalPieces
+		changed := s.changed
+		s.mu.Unlock()
+		if done {
+			return
+		}
+		select {
+		case <-changed:
+		case <-closed:
+			return
+		}
+	}
 }
 
 func (c *Client) requestManifest(peer *webRTC.SimpleWebRTCPeer, cidStr string) (controlMessage, error) {
-	req := controlMessage{Command: "REQUEST_MANIFEST", CID: cidStr}
-	if err := peer.SendJSONReliable(req); err != nil {
+	manifest, err := c.request(peer, controlMessage{Command: "REQUEST_MANIFEST", CID: cidStr}, ManifestTimeout)
+	if err != nil {
 		return controlMessage{}, err
 	}
-
-	manifestCh := make(chan controlMessage, 1)
-	manifestChMu.Lock()
-	manifestWaiters[cidStr] = manifestCh
-	manifestChMu.Unlock()
-
-	defer func() {
-		manifestChMu.Lock()
-		delete(manifestWaiters, cidStr)
-		manifestChMu.Unlock()
-	}()
-
-	select {
-	case manifest := <-manifestCh:
-		return manifest, nil
-	case <-time.After(30 * time.Second):
-		return controlMessage{}, fmt.Errorf("timed out waiting for manifest")
+	if manifest.PiecesRoot != "" && len(manifest.Pieces) == 0 {
+		if err := validateManifestHeader(manifest); err != nil {
+			c.rejectMalformed(peer, err)
+			return controlMessage{}, err
+		}
+		if manifest.Pieces, err = c.fetchPieces(peer, manifest); err != nil {
+			if errors.As(err, new(errMalformed)) {
+				c.rejectMalformed(peer, err)
+			}
+			return controlMessage{}, err
+		}
+	}
+	if err := validateManifest(manifest, cidStr); err != nil {
+		c.rejectMalformed(peer, err)
+		return controlMessage{}, err
+	}
+	if err := checkManifestCID(manifest, cidStr); err != nil {
+		c.rejectMalformed(peer, err)
+		return controlMessage{}, err
 	}
+	return manifest, nil
 }
 
 func (c *Client) initiateWebRTCConnectionWithRetry(targetPeerID peer.ID, maxRetries int) (*webRTC.SimpleWebRTCPeer, error) {
 
 	// First, test ICE connectivity
-	log.Printf("Testing ICE connectivity before attempting WebRTC connection...")
+	transferLog.Debug("testing ICE connectivity before attempting WebRTC connection")
 	if err := webRTC.TestICEConnectivity(); err != nil {
-		log.Printf("ICE connectivity test failed: %v", err)
-		log.Printf("Warning: WebRTC connections may fail due to network restrictions")
+		transferLog.Warn("ICE connectivity test failed, WebRTC connections may fail due to network restrictions", logging.KeyErr, err)
 	} else {
-		log.Printf("ICE connectivity test passed")
+		transferLog.Debug("ICE connectivity test passed")
 	}
 
 	var lastErr error
 	for attempt := 1; attempt <= maxRetries; attempt++ {
 		if attempt > 1 {
-			log.Printf("debug 1.1")
 			backoff := time.Duration(1<<uint(attempt-1)) * time.Second
 			fmt.Printf("Retrying in %v (attempt %d/%d)...\n", backoff, attempt, maxRetries)
 			time.Sleep(backoff)
-			log.Printf("debug 2")
 		}
 
 		ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
@@ -945,22 +1568,18 @@ func (c *Client) initiateWebRTCConnectionWithRetry(targetPeerID peer.ID, maxRetr
 		}
 
 		if len(info.Addrs) == 0 {
-			log.Printf("debug 5")
 			lastErr = fmt.Errorf("peer %s has no known multiaddrs", targetPeerID)
 			continue
 		}
 
 		c.host.Peerstore().AddAddrs(info.ID, info.Addrs, time.Hour)
-		fmt.Println("relay ddebugging 1")
-		fmt.Println(c.host.Peerstore())
-		fmt.Println("relays debugging 2")
 
 		if c.host.Network().Connectedness(info.ID) != network.Connected {
 			connectCtx, connectCancel := context.WithTimeout(context.Background(), 20*time.Second)
 			err := c.host.Connect(connectCtx, info)
 			connectCancel()
 			if err != nil {
-				log.Printf("failed to connect to peer %s: %v", info.ID, err)
+				transferLog.Warn("failed to connect to peer", logging.KeyPeer, info.ID, logging.KeyErr, err)
 				fmt.Printf("DHT lookup failed: %v. This could be a network issue now trying connection using relays.\n", err)
 				return nil, err
 			}
@@ -1043,6 +1662,10 @@ func (c *Client) initiateWebRTCConnectionWithRetry(targetPeerID peer.ID, maxRetr
 			continue
 		}
 
+		// The reliable channel is ordered, so the seeder sees our HELLO before
+		// any request we make.
+		c.sendHello(webrtcPeer)
+
 		fmt.Printf("WebRTC connection established with %s\n", targetPeerID)
 		c.peersMux.Lock()
 		c.webRTCPeers[targetPeerID] = webrtcPeer
@@ -1058,6 +1681,10 @@ func (c *Client) handleWebRTCOffer(offer, remotePeerID string, s network.Stream)
 	if err != nil {
 		return "", fmt.Errorf("invalid peer ID: %w", err)
 	}
+	if !c.peerAllowed(peerID) {
+		transferLog.Info("refused WebRTC offer", logging.KeyPeer, peerID)
+		return "", errPeerRefused
+	}
 
 	webrtcPeer, err := webRTC.NewSimpleWebRTCPeer(c.onDataChannelMessage, c.onWebRTCPeerClose)
 	if err != nil {
@@ -1076,18 +1703,30 @@ func (c *Client) handleWebRTCOffer(offer, remotePeerID string, s network.Stream)
 	c.webRTCPeers[peerID] = webrtcPeer
 	c.peersMux.Unlock()
 
+	go func() {
+		select {
+		case <-webrtcPeer.ReliableOpen():
+			c.sendHello(webrtcPeer)
+		case <-webrtcPeer.WaitForCloseChannel():
+		}
+	}()
+
 	return answer, nil
 }
 
 func (c *Client) onDataChannelMessage(msg webrtc.DataChannelMessage, peer *webRTC.SimpleWebRTCPeer) {
 	if !msg.IsString {
-		log.Printf("Received unexpected binary message, expecting JSON.")
+		transferLog.Warn("received unexpected binary message, expecting JSON", logging.KeyPeer, peer.GetSignalingStream().Conn().RemotePeer())
 		return
 	}
 	// Robustness: Handle empty messages that might be causing "Unknown control command: "
 	if len(msg.Data) == 0 {
 		return
 	}
+	if len(msg.Data) > MaxControlMessageSize {
+		c.rejectMalformed(peer, malformedf("message of %d bytes", len(msg.Data)))
+		return
+	}
 	var ctrl controlMessage
 	if err := json.Unmarshal(msg.Data, &ctrl); err != nil {
 		var ping map[string]string
@@ -1102,7 +1741,7 @@ func (c *Client) onDataChannelMessage(msg webrtc.DataChannelMessage, peer *webRT
 				return
 			}
 		}
-		log.Printf("Failed to unmarshal control message: %v. Raw message: %s", err, string(msg.Data))
+		c.rejectMalformed(peer, malformedf("invalid JSON: %v", err))
 		return
 	}
 	c.handleControlMessage(ctrl, peer)
@@ -1110,21 +1749,38 @@ func (c *Client) onDataChannelMessage(msg webrtc.DataChannelMessage, peer *webRT
 
 func (c *Client) handleControlMessage(ctrl controlMessage, peer *webRTC.SimpleWebRTCPeer) {
 	ctx := context.Background()
+	if pid := peer.GetSignalingStream().Conn().RemotePeer(); !c.peerAllowed(pid) {
+		transferLog.Debug("dropped control message from refused peer", logging.KeyPeer, pid, "command", ctrl.Command)
+		return
+	}
 	switch ctrl.Command {
+	case "HELLO":
+		c.handleHello(ctrl, peer)
 	case "REQUEST_MANIFEST":
-		c.handleManifestRequest(ctx, ctrl, peer)
-	case "MANIFEST":
-		manifestChMu.Lock()
-		if ch, ok := manifestWaiters[ctrl.CID]; ok {
-			ch <- ctrl
+		if c.allowManifestRequest(peer.GetSignalingStream().Conn().RemotePeer()) {
+			c.handleManifestRequest(ctx, ctrl, peer)
+		} else {
+			replyError(peer, ctrl, ErrCodeBusy)
 		}
-		manifestChMu.Unlock()
+	case "REQUEST_PIECE_HASHES":
+		c.handlePieceHashesRequest(ctx, ctrl, peer)
+	case "MANIFEST", "PIECE_HASHES", "ERROR":
+		c.handleResponse(ctrl, peer)
+	case "ACCESS_DENIED":
+		// A piece request was refused: fetch the piece elsewhere.
+		go c.handlePieceUnavailable(ctrl, peer)
 	case "REQUEST_PIECE":
-		go c.handlePieceRequest(ctx, ctrl, peer)
+		c.queuePieceRequest(ctx, ctrl, peer)
 	case "PIECE_CHUNK":
 		c.handlePieceChunk(ctrl, peer)
+	case "PIECE_UNAVAILABLE":
+		go c.handlePieceUnavailable(ctrl, peer)
+	case "PIECE_ACK":
+		if w := c.windows.lookup(peer.GetSignalingStream().Conn().RemotePeer()); w != nil {
+			w.onAck(pieceKey{ctrl.CID, ctrl.Index})
+		}
 	case "CHUNK_ACK":
-		c.handleChunkAck(ctrl)
+		// Sent by peers that predate PIECE_ACK; the channel is reliable.
 	default:
 		// log.Printf("Unknown control command: %s", ctrl.Command)
 	}
@@ -1138,139 +1794,181 @@ func (c *Client) handlePieceChunk(ctrl controlMessage, peer *webRTC.SimpleWebRTC
 		return
 	}
 
-	// Send an ACK back to the sender using reliable channel
-	ackMsg := controlMessage{
-		Command:  "CHUNK_ACK",
-		CID:      ctrl.CID,
-		Index:    ctrl.Index,
-		Sequence: ctrl.Sequence,
-	}
-	if err := peer.SendJSONReliable(ackMsg); err != nil {
-		log.Printf("Failed to send ACK for chunk %d of piece %d: %v", ctrl.Sequence, ctrl.Index, err)
+	chunkData, err := decodeChunk(ctrl, state.Pieces)
+	if err != nil {
+		c.rejectMalformed(peer, err)
+		return
 	}
 
-	state.mu.Lock()
-	defer state.mu.Unlock()
+	c.ackChunk(ctrl, peer)
+
+	idx := int(ctrl.Index)
+	piece := state.Pieces[idx]
+	pid := peer.GetSignalingStream().Conn().RemotePeer()
 
-	if state.PieceStatus[ctrl.Index] {
+	// Chunks go straight to their offset in the partial file. The write
+	// happens under the lock so that nothing lands in a piece once it is
+	// being verified or done.
+	state.mu.Lock()
+	if state.PieceStatus[idx] {
+		state.mu.Unlock()
 		return // Already have this piece
 	}
-
-	if state.pieceBuffers[int(ctrl.Index)] == nil {
-		state.pieceBuffers[int(ctrl.Index)] = make([][]byte, ctrl.TotalChunks)
+	progress := state.received[idx]
+	if progress == nil {
+		progress = newPieceProgress(ctrl.TotalChunks)
+		state.received[idx] = progress
 	}
-
-	chunkData, err := hex.DecodeString(ctrl.Payload)
-	if err != nil {
-		log.Printf("Failed to decode chunk payload: %v", err)
+	if progress.verifying {
+		state.mu.Unlock()
 		return
 	}
-
-	state.pieceBuffers[int(ctrl.Index)][ctrl.ChunkIndex] = chunkData
-	_ = state.Progress.Add(len(chunkData))
-
-	// Check if piece is complete
-	isComplete := true
-	var pieceSize int
-	for _, chunk := range state.pieceBuffers[int(ctrl.Index)] {
-		if chunk == nil {
-			isComplete = false
-			break
-		}
-		pieceSize += len(chunk)
+	if _, err := state.File.WriteAt(chunkData, piece.Offset+int64(ctrl.ChunkIndex)*MaxChunk); err != nil {
+		state.mu.Unlock()
+		transferLog.Error("failed to write chunk to file", logging.KeyCID, ctrl.CID, logging.KeyPiece, ctrl.Index, logging.KeyErr, err)
+		return
 	}
+	metrics.BytesReceived.WithLabelValues(pid.String()).Add(float64(len(chunkData)))
+	if progress.set(ctrl.ChunkIndex) {
+		_ = state.Progress.Add(len(chunkData))
+	}
+	if !progress.complete() {
+		state.mu.Unlock()
+		return
+	}
+	progress.verifying = true
+	// Stop the timer for this piece
+	if timer, ok := state.pieceTimers[idx]; ok {
+		timer.Stop()
+		delete(state.pieceTimers, idx)
+	}
+	state.mu.Unlock()
 
-	if isComplete {
-		// Stop the timer for this piece
-		if timer, ok := state.pieceTimers[int(ctrl.Index)]; ok {
-			timer.Stop()
-			delete(state.pieceTimers, int(ctrl.Index))
-		}
-
-		// Reassemble and write piece
-		pieceData := make([]byte, 0, pieceSize)
-		for _, chunk := range state.pieceBuffers[int(ctrl.Index)] {
-			pieceData = append(pieceData, chunk...)
-		}
-
-		// Verify piece hash
-		h := sha256.New()
-		h.Write(pieceData)
-		hash := hex.EncodeToString(h.Sum(nil))
+	c.verifyPiece(state, idx, pid)
+}
 
-		if hash != state.Pieces[ctrl.Index].Hash {
-			log.Printf("Piece %d hash mismatch", ctrl.Index)
-			state.pieceBuffers[int(ctrl.Index)] = nil // Clear buffer to retry
-			return
+// verifyPiece hashes a piece whose chunks have all been written and marks it
+// as downloaded, or discards it and asks for it again.
+func (c *Client) verifyPiece(state *DownloadState, idx int, pid peer.ID) {
+	cidStr := state.Manifest.CID
+	p := state.Pieces[idx]
+	hash, err := hashPiece(state.File, p)
+	if err != nil {
+		transferLog.Error("failed to read back piece", logging.KeyCID, cidStr, logging.KeyPiece, idx, logging.KeyErr, err)
+	}
+	if hash != p.Hash {
+		if err == nil {
+			transferLog.Warn("piece hash mismatch", logging.KeyPeer, pid, logging.KeyCID, cidStr, logging.KeyPiece, idx)
+			metrics.PiecesFailed.Inc()
+			go c.adjustPeerScore(pid, BadPieceScore, "corrupt piece")
 		}
-
-		if _, err := state.File.WriteAt(pieceData, state.Pieces[ctrl.Index].Offset); err != nil {
-			log.Printf("Failed to write piece %d to file: %v", ctrl.Index, err)
-			return
+		state.mu.Lock()
+		delete(state.received, idx) // start the piece over
+		state.mu.Unlock()
+		if state.Sequential {
+			go state.releasePiece(idx)
+		} else {
+			go c.reRequestPiece(state, idx)
 		}
+		return
+	}
 
-		state.PieceStatus[ctrl.Index] = true
-		state.completedPieces++
-		delete(state.pieceBuffers, int(ctrl.Index))
+	if err := c.db.UpsertPiece(context.Background(), cidStr, p.Index, p.Offset, p.Size, p.Hash, true); err != nil {
+		transferLog.Error("failed to mark piece as downloaded", logging.KeyCID, cidStr, logging.KeyPiece, idx, logging.KeyErr, err)
+	}
 
-		if state.completedPieces == state.TotalPieces {
-			state.Completed <- true
-		}
+	metrics.PiecesVerified.Inc()
+	go c.adjustPeerScore(pid, GoodPieceScore, "")
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	delete(state.received, idx)
+	if state.PieceStatus[idx] {
+		return
 	}
-}
+	state.PieceStatus[idx] = true
+	state.completedPieces++
+	delete(state.PieceAssignees, idx)
+	state.notifyLocked()
 
-func (c *Client) handleChunkAck(ctrl controlMessage) {
-	c.unackedChunksMux.Lock()
-	defer c.unackedChunksMux.Unlock()
-	if _, ok := c.unackedChunks[ctrl.CID]; ok {
-		if _, ok := c.unackedChunks[ctrl.CID][ctrl.Index]; ok {
-			delete(c.unackedChunks[ctrl.CID][ctrl.Index], ctrl.Sequence)
-			if len(c.unackedChunks[ctrl.CID][ctrl.Index]) == 0 {
-				delete(c.unackedChunks[ctrl.CID], ctrl.Index)
-			}
-		}
-		if len(c.unackedChunks[ctrl.CID]) == 0 {
-			delete(c.unackedChunks, ctrl.CID)
-		}
+	if state.completedPieces == state.TotalPieces {
+		state.Completed <- true
 	}
 }
 
 func (c *Client) handlePieceRequest(ctx context.Context, ctrl controlMessage, peer *webRTC.SimpleWebRTCPeer) {
-	pieces, err := c.db.GetPieces(ctx, ctrl.CID)
-	if err != nil || int(ctrl.Index) >= len(pieces) {
-		log.Printf("Invalid piece request for CID %s, index %d", ctrl.CID, ctrl.Index)
+	if !c.authorize(ctx, ctrl.CID, peer.GetSignalingStream().Conn().RemotePeer()) {
+		c.denyAccess(ctrl, peer)
 		return
 	}
+	metrics.ActiveUploads.Inc()
+	defer metrics.ActiveUploads.Dec()
 
-	fileInfo, err := c.db.GetLocalFileByCID(ctx, ctrl.CID)
-	if err != nil {
-		log.Printf("File not found for piece request: %s", ctrl.CID)
+	pieces, err := c.db.GetPieces(ctx, ctrl.CID)
+	if err == nil && len(pieces) == 0 {
+		// Not shared (any more), e.g. removed while the peer was downloading.
+		_ = peer.SendJSONReliable(controlMessage{Command: "PIECE_UNAVAILABLE", CID: ctrl.CID, Index: ctrl.Index})
 		return
 	}
-
-	file, err := os.Open(fileInfo.FilePath)
-	if err != nil {
-		log.Printf("Failed to open file for piece request: %v", err)
+	if err != nil || ctrl.Index < 0 || ctrl.Index >= int64(len(pieces)) {
+		transferLog.Warn("invalid piece request", logging.KeyCID, ctrl.CID, logging.KeyPiece, ctrl.Index)
 		return
 	}
-	defer file.Close()
 
 	piece := pieces[ctrl.Index]
-	pieceBuffer := make([]byte, piece.Size)
-	_, err = file.ReadAt(pieceBuffer, piece.Offset)
+	path, err := c.pieceSourcePath(ctx, ctrl.CID, piece)
+	if errors.Is(err, errPieceUnavailable) || errors.Is(err, errNotShared) {
+		_ = peer.SendJSONReliable(controlMessage{Command: "PIECE_UNAVAILABLE", CID: ctrl.CID, Index: ctrl.Index})
+		return
+	} else if err != nil {
+		transferLog.Warn("cannot serve piece", logging.KeyCID, ctrl.CID, logging.KeyPiece, ctrl.Index, logging.KeyErr, err)
+		return
+	}
+
+	file, err := os.Open(path)
 	if err != nil {
-		log.Printf("Failed to read piece %d: %v", ctrl.Index, err)
+		transferLog.Error("failed to open file for piece request", logging.KeyCID, ctrl.CID, logging.KeyErr, err)
+		_ = peer.SendJSONReliable(controlMessage{Command: "PIECE_UNAVAILABLE", CID: ctrl.CID, Index: ctrl.Index})
 		return
 	}
+	defer file.Close()
+
+	_ = c.db.TouchDownload(ctx, ctrl.CID)
 
-	totalChunks := (len(pieceBuffer) + MaxChunk - 1) / MaxChunk
+	pid := peer.GetSignalingStream().Conn().RemotePeer()
+	session := c.sessions.get(pid)
+	sentAll := false
+	if session.has(FeaturePieceAck) {
+		key := pieceKey{ctrl.CID, ctrl.Index}
+		window := c.windows.get(pid)
+		if err := window.acquire(key, int(piece.Size), peer.WaitForCloseChannel()); err != nil {
+			return
+		}
+		// A piece that is not sent in full will never be acknowledged; free
+		// its room in the window instead of waiting for it to time out.
+		defer func() {
+			if !sentAll {
+				window.release(key)
+			}
+		}()
+	}
+	compress := c.compressChunks(session, ctrl.CID, file, piece)
+	ch := peer.NextDataChannel()
+
+	// Chunks are read from disk one at a time into pooled buffers; the hex
+	// payload is the only per-chunk allocation.
+	buf, zbuf := getChunkBuf(), getChunkBuf()
+	defer putChunkBuf(buf)
+	defer putChunkBuf(zbuf)
+	totalChunks := int((piece.Size + MaxChunk - 1) / MaxChunk)
+	dropped := false
 	for i := 0; i < totalChunks; i++ {
-		start := i * MaxChunk
-		end := start + MaxChunk
-		if end > len(pieceBuffer) {
-			end = len(pieceBuffer)
+		start := int64(i) * MaxChunk
+		chunk := (*buf)[:min64(MaxChunk, piece.Size-start)]
+		if _, err := file.ReadAt(chunk, piece.Offset+start); err != nil {
+			transferLog.Error("failed to read piece", logging.KeyCID, ctrl.CID, logging.KeyPiece, ctrl.Index, logging.KeyErr, err)
+			_ = peer.SendJSONReliable(controlMessage{Command: "PIECE_UNAVAILABLE", CID: ctrl.CID, Index: ctrl.Index})
+			return
 		}
-		chunk := pieceBuffer[start:end]
 
 		chunkMsg := controlMessage{
 			Command:     "PIECE_CHUNK",
@@ -1278,102 +1976,115 @@ func (c *Client) handlePieceRequest(ctx context.Context, ctrl controlMessage, pe
 			Index:       ctrl.Index,
 			ChunkIndex:  i,
 			TotalChunks: totalChunks,
-			Payload:     hex.EncodeToString(chunk),
 			Sequence:    i,
 		}
-
-		// Store the sent chunk and start a retransmission timer
-		c.unackedChunksMux.Lock()
-		if c.unackedChunks[ctrl.CID] == nil {
-			c.unackedChunks[ctrl.CID] = make(map[int64]map[int]controlMessage)
-		}
-		if c.unackedChunks[ctrl.CID][ctrl.Index] == nil {
-			c.unackedChunks[ctrl.CID][ctrl.Index] = make(map[int]controlMessage)
+		payload := chunk
+		if compress {
+			if out, ok := compressChunk(*zbuf, chunk); ok {
+				payload = out
+				chunkMsg.Compression = CompressionZstd
+			}
 		}
-		c.unackedChunks[ctrl.CID][ctrl.Index][i] = chunkMsg
-		c.unackedChunksMux.Unlock()
-		time.AfterFunc(RetransmissionTimeout, func() { c.retransmitChunk(peer, chunkMsg) })
+		chunkMsg.Payload = hex.EncodeToString(payload)
 
-		if err := peer.SendJSON(chunkMsg); err != nil {
-			log.Printf("Failed to send chunk %d of piece %d: %v", i, ctrl.Index, err)
+		if err := peer.WaitSendBuffer(ch); err != nil {
 			return
 		}
-		delay := c.congestionCtrl[peer.GetSignalingStream().Conn().RemotePeer()]
-		time.Sleep(delay)
-	}
-}
 
-func (c *Client) retransmitChunk(peer *webRTC.SimpleWebRTCPeer, chunkMsg controlMessage) {
-	c.unackedChunksMux.RLock()
-	defer c.unackedChunksMux.RUnlock()
-	if _, ok := c.unackedChunks[chunkMsg.CID]; ok {
-		if _, ok := c.unackedChunks[chunkMsg.CID][chunkMsg.Index]; ok {
-			if _, ok := c.unackedChunks[chunkMsg.CID][chunkMsg.Index][chunkMsg.Sequence]; ok {
-				log.Printf("Retransmitting chunk %d of piece %d", chunkMsg.Sequence, chunkMsg.Index)
-				if err := peer.SendJSON(chunkMsg); err != nil {
-					log.Printf("Failed to retransmit chunk %d of piece %d: %v", chunkMsg.Sequence, chunkMsg.Index, err)
-				}
-				// Reset timer
-				time.AfterFunc(RetransmissionTimeout, func() { c.retransmitChunk(peer, chunkMsg) })
-			}
+		out := chunkMsg
+		if hook := c.hooks.beforeSendChunk; hook != nil && !hook(pid, &out) {
+			dropped = true
+			continue
 		}
+		if err := peer.SendJSONOn(ch, out); err != nil {
+			transferLog.Warn("failed to send chunk", logging.KeyCID, ctrl.CID, logging.KeyPiece, ctrl.Index, logging.KeyChunk, i, logging.KeyErr, err)
+			return
+		}
+		metrics.BytesSent.WithLabelValues(pid.String()).Add(float64(len(chunk)))
 	}
+	sentAll = !dropped
+	_ = c.db.AddSeedUpload(ctx, ctrl.CID, piece.Size)
 }
 
 func (c *Client) handleManifestRequest(ctx context.Context, ctrl controlMessage, peer *webRTC.SimpleWebRTCPeer) {
-	localFile, err := c.db.GetLocalFileByCID(ctx, ctrl.CID)
-	if err != nil {
-		log.Printf("File not found for manifest: %s", ctrl.CID)
+	pid := peer.GetSignalingStream().Conn().RemotePeer()
+	if !c.authorize(ctx, ctrl.CID, pid) {
+		transferLog.Info("denied manifest request from peer not on allowlist", logging.KeyPeer, pid, logging.KeyCID, ctrl.CID)
+		replyError(peer, ctrl, ErrCodeAccessDenied)
 		return
 	}
-
-	pieces, err := c.db.GetPieces(ctx, ctrl.CID)
-	if err != nil {
-		log.Printf("Error getting pieces: %v", err)
+	manifest, err := c.buildManifest(ctx, ctrl.CID)
+	if errors.Is(err, errNotFound) {
+		transferLog.Debug("manifest requested for unknown file", logging.KeyPeer, pid, logging.KeyCID, ctrl.CID)
+		replyError(peer, ctrl, ErrCodeNotFound)
+		return
+	} else if err != nil {
+		transferLog.Warn("cannot serve manifest", logging.KeyCID, ctrl.CID, logging.KeyErr, err)
+		replyError(peer, ctrl, ErrCodeInternal)
 		return
 	}
 
-	manifest := controlMessage{
-		Command:   "MANIFEST",
-		CID:       ctrl.CID,
-		TotalSize: localFile.FileSize,
-		HashHex:   localFile.FileHash,
-		NumPieces: int64(len(pieces)),
-		Pieces:    pieces,
-		Filename:  localFile.Filename,
-		// From:      string(c.host.ID()),
-		// Target:    ctrl.From,
+	if err := checkManifestSupported(c.sessions.get(pid), manifest); err != nil {
+		transferLog.Info("cannot serve manifest to peer", logging.KeyPeer, pid, logging.KeyCID, ctrl.CID, logging.KeyErr, err)
+		replyError(peer, ctrl, ErrCodeUnsupported)
+		return
 	}
 
+	if c.sessions.get(pid).has(FeatureManifestPages) && manifest.NumPieces > 0 {
+		if manifest, err = compactManifest(manifest); err != nil {
+			transferLog.Warn("cannot serve manifest", logging.KeyCID, ctrl.CID, logging.KeyErr, err)
+			replyError(peer, ctrl, ErrCodeInternal)
+			return
+		}
+	}
+	manifest.RequestID = ctrl.RequestID
 	if err := peer.SendJSONReliable(manifest); err != nil {
-		log.Printf("Error sending manifest: %v", err)
+		transferLog.Warn("failed to send manifest", logging.KeyCID, ctrl.CID, logging.KeyErr, err)
 	}
 }
 
 // MODIFIED: Added a log message for better debugging
 func (c *Client) onWebRTCPeerClose(peerID peer.ID) {
-	log.Printf("WebRTC peer disconnected: %s", peerID)
+	transferLog.Info("WebRTC peer disconnected", logging.KeyPeer, peerID)
 	c.peersMux.Lock()
 	delete(c.webRTCPeers, peerID)
 	c.peersMux.Unlock()
+	c.limiters.drop(peerID)
+	c.sessions.drop(peerID)
+	c.windows.drop(peerID)
+	metrics.ForgetPeer(peerID.String())
 
 	// Handle download resumption logic
 	c.downloadsMux.Lock()
 	defer c.downloadsMux.Unlock()
 
 	for cid, state := range c.activeDownloads {
+		if state.Sequential {
+			// Streaming workers pick released pieces up themselves.
+			state.mu.Lock()
+			for pieceIndex, assignee := range state.PieceAssignees {
+				if assignee == peerID {
+					delete(state.PieceAssignees, pieceIndex)
+				}
+			}
+			state.notifyLocked()
+			state.mu.Unlock()
+			continue
+		}
+		state.mu.Lock()
 		for pieceIndex, assignee := range state.PieceAssignees {
-			if assignee == peerID {
-				log.Printf("Peer %s disconnected, re-requesting piece %d for download %s", peerID, pieceIndex, cid)
+			if assignee == peerID && !state.PieceStatus[pieceIndex] {
+				transferLog.Info("peer disconnected, re-requesting piece", logging.KeyPeer, peerID, logging.KeyCID, cid, logging.KeyPiece, pieceIndex)
 				// Re-queue the piece for download
 				go c.reRequestPiece(state, pieceIndex)
 			}
 		}
+		state.mu.Unlock()
 	}
 }
 
 func (c *Client) handleFileRequest(ctx context.Context, ctrl controlMessage, peer *webRTC.SimpleWebRTCPeer) {
-	log.Printf("Note: handleFileRequest is deprecated in favor of piece-based transfers.")
+	transferLog.Debug("handleFileRequest is deprecated in favor of piece-based transfers")
 }
 
 func min64(a, b int64) int64 {
@@ -1383,14 +2094,18 @@ func min64(a, b int64) int64 {
 	return b
 }
 
-// New: monitorCongestion
-func (c *Client) monitorCongestion() {
+// pingPeers measures the round trip time to connected peers for the
+// peer_rtt_seconds metric. Pacing uses the RTT of piece acknowledgements
+// (PIECE_ACK) instead.
+func (c *Client) pingPeers() {
 	ticker := time.NewTicker(PingInterval)
 	for range ticker.C {
 		c.peersMux.RLock()
 		for pid, peer := range c.webRTCPeers {
 			if connState := peer.GetConnectionState(); connState == webRTC.ConnectionStateConnected {
+				c.rttMux.Lock()
 				c.pingTimes[pid] = time.Now()
+				c.rttMux.Unlock()
 				ping := map[string]string{"type": "ping"}
 				peer.SendJSONReliable(ping)
 			}
@@ -1400,29 +2115,10 @@ func (c *Client) monitorCongestion() {
 }
 
 func (c *Client) handlePong(pid peer.ID) {
+	c.rttMux.Lock()
+	defer c.rttMux.Unlock()
 	if start, ok := c.pingTimes[pid]; ok {
-		rtt := time.Since(start)
-		c.rttMux.Lock()
-		if _, ok := c.rttMeasurements[pid]; !ok {
-			c.rttMeasurements[pid] = []time.Duration{}
-		}
-		c.rttMeasurements[pid] = append(c.rttMeasurements[pid], rtt)
-		if len(c.rttMeasurements[pid]) > 10 {
-			c.rttMeasurements[pid] = c.rttMeasurements[pid][1:]
-		}
-		avgRTT := time.Duration(0)
-		for _, d := range c.rttMeasurements[pid] {
-			avgRTT += d
-		}
-		avgRTT /= time.Duration(len(c.rttMeasurements[pid]))
-		var delay time.Duration = MinDelay
-		if avgRTT > MaxRTT {
-			delay = MaxDelay
-		} else if avgRTT > MaxRTT/2 {
-			delay = (MaxDelay - MinDelay) / 2
-		}
-		c.congestionCtrl[pid] = delay
-		c.rttMux.Unlock()
+		metrics.PeerRTT.Observe(time.Since(start).Seconds())
 		delete(c.pingTimes, pid)
 	}
 }
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	webRTC "torrentium/internal/client"
+	db "torrentium/internal/db"
+	"torrentium/internal/logging"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+// ManifestPageSize is how many piece hashes one PIECE_HASHES message carries:
+// 32 KiB of hashes, well below the message size every WebRTC stack accepts.
+const ManifestPageSize = 1024
+
+// Peers that announced FeatureManifestPages get a compact manifest: a MANIFEST
+// header without the piece list, whose pieces follow from piece_size and
+// total_size, and whose hashes are fetched in pages with
+// REQUEST_PIECE_HASHES. The header's pieces_root, the SHA-256 of all binary
+// piece hashes in order, ties the pages together.
+
+// piecesRoot returns the pieces_root of a piece list.
+func piecesRoot(pieces []db.Piece) (string, error) {
+	h := sha256.New()
+	for _, p := range pieces {
+		b, err := hex.DecodeString(p.Hash)
+		if err != nil || len(b) != sha256.Size {
+			return "", fmt.Errorf("piece %d has an invalid hash", p.Index)
+		}
+		h.Write(b)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// compactManifest returns the header of a manifest built by buildManifest.
+func compactManifest(m controlMessage) (controlMessage, error) {
+	root, err := piecesRoot(m.Pieces)
+	if err != nil {
+		return controlMessage{}, err
+	}
+	m.PiecesRoot = root
+	m.Pieces = nil
+	return m, nil
+}
+
+// handlePieceHashesRequest answers a REQUEST_PIECE_HASHES with up to Count
+// binary piece hashes starting at piece Index. Pages are cheap range reads
+// and are not counted against the manifest rate limit.
+func (c *Client) handlePieceHashesRequest(ctx context.Context, ctrl controlMessage, peer *webRTC.SimpleWebRTCPeer) {
+	pid := peer.GetSignalingStream().Conn().RemotePeer()
+	if !c.authorize(ctx, ctrl.CID, pid) {
+		replyError(peer, ctrl, ErrCodeAccessDenied)
+		return
+	}
+	if ctrl.Index < 0 || ctrl.Count <= 0 || ctrl.Count > ManifestPageSize {
+		c.rejectMalformed(peer, malformedf("piece hashes %d+%d requested", ctrl.Index, ctrl.Count))
+		return
+	}
+	hashes, err := c.db.GetPieceHashes(ctx, ctrl.CID, ctrl.Index, int64(ctrl.Count))
+	if err != nil {
+		transferLog.Warn("cannot serve piece hashes", logging.KeyCID, ctrl.CID, logging.KeyErr, err)
+		replyError(peer, ctrl, ErrCodeInternal)
+		return
+	}
+	if len(hashes) == 0 {
+		replyError(peer, ctrl, ErrCodeNotFound)
+		return
+	}
+	page := make([]byte, 0, len(hashes)*sha256.Size)
+	for _, s := range hashes {
+		b, err := hex.DecodeString(s)
+		if err != nil || len(b) != sha256.Size {
+			transferLog.Warn("stored piece hash is invalid", logging.KeyCID, ctrl.CID)
+			replyError(peer, ctrl, ErrCodeInternal)
+			return
+		}
+		page = append(page, b...)
+	}
+	resp := controlMessage{Command: "PIECE_HASHES", CID: ctrl.CID, Index: ctrl.Index, Hashes: page, RequestID: ctrl.RequestID}
+	if err := peer.SendJSONReliable(resp); err != nil {
+		transferLog.Warn("failed to send piece hashes", logging.KeyCID, ctrl.CID, logging.KeyErr, err)
+	}
+}
+
+// validateManifestHeader checks a compact manifest header before its piece
+// hashes are fetched.
+func validateManifestHeader(m controlMessage) error {
+	if m.PieceSize <= 0 || m.PieceSize > MaxPieceSize || m.TotalSize < 0 {
+		return malformedf("manifest header with piece size %d and size %d", m.PieceSize, m.TotalSize)
+	}
+	if want := (m.TotalSize + m.PieceSize - 1) / m.PieceSize; m.NumPieces != want || m.NumPieces > MaxManifestPieces {
+		return malformedf("manifest header lists %d pieces, size implies %d", m.NumPieces, want)
+	}
+	if !validHash(m.PiecesRoot) {
+		return malformedf("invalid pieces root")
+	}
+	return nil
+}
+
+// expandPieces lays out the pieces of a compact manifest with the given
+// hex piece hashes.
+func expandPieces(m controlMessage, hashes []string) []db.Piece {
+	pieces := make([]db.Piece, len(hashes))
+	for i, h := range hashes {
+		offset := int64(i) * m.PieceSize
+		pieces[i] = db.Piece{CID: m.CID, Index: int64(i), Offset: offset, Size: min64(m.PieceSize, m.TotalSize-offset), Hash: h}
+	}
+	return pieces
+}
+
+// fetchPieces fills in the piece list of a compact manifest. Pieces already
+// stored for the CID, from an earlier attempt at the download or a partial
+// copy, are used when they match pieces_root; otherwise the hashes are
+// fetched from peer page by page.
+func (c *Client) fetchPieces(peer *webRTC.SimpleWebRTCPeer, m controlMessage) ([]db.Piece, error) {
+	if stored, err := c.db.GetPieces(context.Background(), m.CID); err == nil && int64(len(stored)) == m.NumPieces {
+		if root, err := piecesRoot(stored); err == nil && root == m.PiecesRoot {
+			transferLog.Debug("using stored piece list", logging.KeyCID, m.CID)
+			return stored, nil
+		}
+	}
+
+	hashes := make([]string, 0, m.NumPieces)
+	for start := int64(0); start < m.NumPieces; start += ManifestPageSize {
+		count := min64(ManifestPageSize, m.NumPieces-start)
+		page, err := c.request(peer, controlMessage{Command: "REQUEST_PIECE_HASHES", CID: m.CID, Index: start, Count: int(count)}, ManifestTimeout)
+		if err != nil {
+			return nil, err
+		}
+		if page.Index != start || int64(len(page.Hashes)) != count*sha256.Size {
+			return nil, malformedf("page of %d hash bytes at piece %d, asked for %d at %d", len(page.Hashes), page.Index, count, start)
+		}
+		for i := 0; i < len(page.Hashes); i += sha256.Size {
+			hashes = append(hashes, hex.EncodeToString(page.Hashes[i:i+sha256.Size]))
+		}
+	}
+	pieces := expandPieces(m, hashes)
+	if root, _ := piecesRoot(pieces); root != m.PiecesRoot {
+		return nil, malformedf("piece hashes do not match the pieces root")
+	}
+	return pieces, nil
+}
+
+// checkManifestCID verifies that the file hash in a manifest is the digest
+// the CID is made of, so a peer cannot hand out a manifest for other content.
+func checkManifestCID(m controlMessage, cidStr string) error {
+	fileCID, err := cid.Decode(cidStr)
+	if err != nil {
+		return err
+	}
+	decoded, err := multihash.Decode(fileCID.Hash())
+	if err != nil {
+		return fmt.Errorf("failed to decode CID multihash: %w", err)
+	}
+	if decoded.Code != multihash.SHA2_256 {
+		return nil // only SHA-256 CIDs can be checked against the file hash
+	}
+	if !strings.EqualFold(hex.EncodeToString(decoded.Digest), m.HashHex) {
+		return malformedf("manifest hash %s does not match CID %s", m.HashHex, cidStr)
+	}
+	return nil
+}
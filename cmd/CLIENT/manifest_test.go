@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	db "torrentium/internal/db"
+)
+
+func TestFetchPiecesInPages(t *testing.T) {
+	tn := newTestNetwork(t, 2)
+	seeder, leecher := tn.nodes[0], tn.nodes[1]
+
+	// A manifest spanning three pages, stored without the file behind it.
+	const cidStr = "bafkreipages"
+	header := controlMessage{CID: cidStr, PieceSize: MinPieceSize, NumPieces: 2*ManifestPageSize + 10}
+	header.TotalSize = header.NumPieces*MinPieceSize - 1000
+	var want []string
+	for i := int64(0); i < header.NumPieces; i++ {
+		h := make([]byte, 32)
+		rand.Read(h)
+		want = append(want, hex.EncodeToString(h))
+	}
+	pieces := expandPieces(header, want)
+	for _, p := range pieces {
+		if err := seeder.db.UpsertPiece(context.Background(), cidStr, p.Index, p.Offset, p.Size, p.Hash, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root, err := piecesRoot(pieces)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header.PiecesRoot = root
+	if err := validateManifestHeader(header); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := leecher.initiateWebRTCConnectionWithRetry(seeder.host.ID(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 10*time.Second, "HELLO exchange", func() bool {
+		return seeder.sessions.get(leecher.host.ID()) != nil
+	})
+	got, err := leecher.fetchPieces(conn, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(pieces) || got[len(got)-1].Size != MinPieceSize-1000 {
+		t.Fatalf("got %d pieces, last of %d bytes", len(got), got[len(got)-1].Size)
+	}
+	if !slices.EqualFunc(got, pieces, func(a, b db.Piece) bool { return a.Hash == b.Hash && a.Offset == b.Offset }) {
+		t.Fatal("fetched pieces differ from the stored ones")
+	}
+
+	header.PiecesRoot = want[0]
+	if _, err := leecher.fetchPieces(conn, header); !errors.As(err, new(errMalformed)) {
+		t.Fatalf("pages not matching the pieces root: err = %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	webRTC "torrentium/internal/client"
+	"torrentium/internal/logging"
+	"torrentium/internal/metrics"
+
+	"github.com/ipfs/go-cid"
+)
+
+const MetricsUpdateInterval = 15 * time.Second
+
+// provide announces a CID on the DHT and records how long it took.
+func (c *Client) provide(ctx context.Context, id cid.Cid) error {
+	start := time.Now()
+	err := c.dht.Provide(ctx, id, true)
+	metrics.ObserveProvide(start, err)
+	return err
+}
+
+// startMetrics serves Prometheus metrics on TORRENTIUM_METRICS_ADDR (e.g.
+// "127.0.0.1:9102") and keeps the sampled gauges up to date. Nothing is
+// started when the variable is unset.
+func (c *Client) startMetrics() {
+	addr := os.Getenv("TORRENTIUM_METRICS_ADDR")
+	if addr == "" {
+		return
+	}
+	go func() {
+		if err := metrics.Serve(addr); err != nil {
+			logger.Error("metrics endpoint stopped", logging.KeyErr, err)
+		}
+	}()
+	go func() {
+		ticker := time.NewTicker(MetricsUpdateInterval)
+		defer ticker.Stop()
+		for {
+			c.updateSampledMetrics()
+			<-ticker.C
+		}
+	}()
+}
+
+// updateSampledMetrics refreshes gauges that are read from current state
+// rather than updated as events happen.
+func (c *Client) updateSampledMetrics() {
+	metrics.DHTRoutingTableSize.Set(float64(c.dht.RoutingTable().Size()))
+
+	counts := make(map[webRTC.ConnectionState]int)
+	c.peersMux.RLock()
+	for _, p := range c.webRTCPeers {
+		counts[p.GetConnectionState()]++
+	}
+	c.peersMux.RUnlock()
+	for _, state := range []webRTC.ConnectionState{
+		webRTC.ConnectionStateNew,
+		webRTC.ConnectionStateConnecting,
+		webRTC.ConnectionStateConnected,
+		webRTC.ConnectionStateDisconnected,
+		webRTC.ConnectionStateFailed,
+		webRTC.ConnectionStateClosed,
+	} {
+		metrics.WebRTCPeers.WithLabelValues(state.String()).Set(float64(counts[state]))
+	}
+}
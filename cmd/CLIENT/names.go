@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"torrentium/internal/logging"
+	"torrentium/internal/naming"
+	"torrentium/internal/shareuri"
+
+	"github.com/ipfs/go-cid"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// NameRecordLifetime is how long a published name record stays valid. It is
+// re-signed with a fresh expiry every ReprovideInterval while we are online.
+const NameRecordLifetime = 48 * time.Hour
+
+// NameOwnerJoinTimeout is how long resolveName waits for a name's owner to
+// join the name DHT routing table after connecting to it.
+const NameOwnerJoinTimeout = 10 * time.Second
+
+// publishName points name at cidStr under our peer ID.
+func (c *Client) publishName(name, cidStr string) error {
+	if !naming.ValidName(name) {
+		return naming.ErrInvalidName
+	}
+	if _, err := cid.Decode(cidStr); err != nil {
+		return fmt.Errorf("invalid CID: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	seq := uint64(1)
+	prev, err := c.db.GetPublishedName(ctx, name)
+	if err == nil {
+		seq = prev.Seq + 1
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	// Record the sequence number first, so it is never reused even if the
+	// DHT put below fails.
+	if err := c.db.SetPublishedName(ctx, name, cidStr, seq); err != nil {
+		return fmt.Errorf("failed to store name: %w", err)
+	}
+	if err := c.putNameRecord(ctx, name, cidStr, seq); err != nil {
+		return fmt.Errorf("failed to publish name: %w", err)
+	}
+	fmt.Printf("✓ Published %s/%s -> %s\n", c.host.ID(), name, cidStr)
+	fmt.Printf(" Download the latest with: download %s/%s\n", c.host.ID(), name)
+	return nil
+}
+
+// putNameRecord signs a record with our identity key and stores it in the
+// name DHT. The record is always kept locally, where resolvers find it by
+// connecting to us; without Torrentium peers in the routing table it is only
+// stored there.
+func (c *Client) putNameRecord(ctx context.Context, name, cidStr string, seq uint64) error {
+	priv := c.host.Peerstore().PrivKey(c.host.ID())
+	if priv == nil {
+		return fmt.Errorf("no private key for %s", c.host.ID())
+	}
+	rec, err := naming.NewRecord(priv, name, cidStr, seq, time.Now().Add(NameRecordLifetime))
+	if err != nil {
+		return err
+	}
+	data, err := rec.Marshal()
+	if err != nil {
+		return err
+	}
+	err = c.names.PutValue(ctx, naming.Key(c.host.ID(), name), data)
+	if errors.Is(err, kb.ErrLookupFailure) {
+		dhtLog.Warn("no name DHT peers to replicate record to, serving it only from this node", "name", name, logging.KeyCID, cidStr)
+		return nil
+	}
+	return err
+}
+
+// resolveName looks up the CID that "<peer ID>/<name>" currently points at.
+func (c *Client) resolveName(ctx context.Context, s string) (string, error) {
+	owner, name, err := naming.ParseName(s)
+	if err != nil {
+		return "", err
+	}
+	if err := c.connectNameOwner(ctx, owner); err != nil {
+		dhtLog.Debug("name owner unreachable, asking the name DHT", logging.KeyPeer, owner, logging.KeyErr, err)
+	}
+	data, err := c.names.GetValue(ctx, naming.Key(owner, name))
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", s, err)
+	}
+	rec, err := naming.Unmarshal(data)
+	if err != nil {
+		return "", err
+	}
+	return rec.CID, nil
+}
+
+// connectNameOwner connects to the publisher of a name, which always holds
+// its own record, and waits for it to join the name DHT routing table. The
+// main DHT finds its addresses: the bootstrap and relay nodes we start from
+// do not take part in the name DHT.
+func (c *Client) connectNameOwner(ctx context.Context, owner peer.ID) error {
+	if owner == c.host.ID() {
+		return nil
+	}
+	if c.host.Network().Connectedness(owner) != network.Connected {
+		info, err := c.dht.FindPeer(ctx, owner)
+		if err != nil {
+			return fmt.Errorf("failed to find %s: %w", owner, err)
+		}
+		if err := c.host.Connect(ctx, info); err != nil {
+			return fmt.Errorf("failed to connect to %s: %w", owner, err)
+		}
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, NameOwnerJoinTimeout)
+	defer cancel()
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for c.names.RoutingTable().Find(owner) == "" {
+		select {
+		case <-ticker.C:
+		case <-waitCtx.Done():
+			return fmt.Errorf("%s does not serve the name DHT", owner)
+		}
+	}
+	return nil
+}
+
+// resolveTarget turns the argument of download or stream into a CID or share
+// link. Names are resolved to the CID they currently point at, and share
+// URIs add their provider hints to opts.
+func (c *Client) resolveTarget(s string, opts *downloadOptions) (string, error) {
+	if shareuri.IsURI(s) {
+		return applyShareURI(s, opts)
+	}
+	target, key := splitShareLink(s)
+	if !naming.IsName(target) {
+		return s, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	cidStr, err := c.resolveName(ctx, target)
+	if err != nil {
+		return "", err
+	}
+	fmt.Printf("Resolved %s to %s\n", target, cidStr)
+	if key != "" {
+		cidStr += "#" + key
+	}
+	return cidStr, nil
+}
+
+// republishNames re-signs our name records before they expire and puts them
+// back into the DHT, whose peers drop records after a day and a half.
+func (c *Client) republishNames(ctx context.Context) {
+	names, err := c.db.GetPublishedNames(ctx)
+	if err != nil {
+		dhtLog.Error("failed to load published names", logging.KeyErr, err)
+		return
+	}
+	for _, n := range names {
+		putCtx, cancel := context.WithTimeout(ctx, 60*time.Second)
+		err := c.putNameRecord(putCtx, n.Name, n.CID, n.Seq)
+		cancel()
+		if err != nil {
+			dhtLog.Warn("failed to republish name", "name", n.Name, logging.KeyCID, n.CID, logging.KeyErr, err)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+func TestPublishedNameFollowsLatestCID(t *testing.T) {
+	tn := newTestNetwork(t, 3)
+	publisher, teammate := tn.nodes[0], tn.nodes[1]
+	waitFor(t, 30*time.Second, "name DHT routing tables to fill", func() bool {
+		for _, node := range tn.nodes {
+			if node.names.RoutingTable().Size() < len(tn.nodes)-1 {
+				return false
+			}
+		}
+		return true
+	})
+	name := publisher.host.ID().String() + "/nightly"
+
+	cid1, want := tn.shareFile(publisher, "nightly-1.bin", testFileSize)
+	if err := publisher.publishName("nightly", cid1); err != nil {
+		t.Fatal(err)
+	}
+	target, err := teammate.resolveTarget(name, &downloadOptions{})
+	if err != nil || target != cid1 {
+		t.Fatalf("resolved %s to %s, %v; want %s", name, target, err, cid1)
+	}
+	if got := tn.download(teammate, target, downloadOptions{}); !bytes.Equal(got, want) {
+		t.Fatal("downloaded content differs from the published file")
+	}
+
+	cid2, _ := tn.shareFile(publisher, "nightly-2.bin", 1024)
+	if err := publisher.publishName("nightly", cid2); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := teammate.resolveTarget(name+"#key", &downloadOptions{}); err != nil || target != cid2+"#key" {
+		t.Fatalf("resolved %s to %s, %v; want %s", name, target, err, cid2)
+	}
+
+	// Republishing keeps the sequence number and the DHT accepts it.
+	publisher.republishNames(context.Background())
+	n, err := publisher.db.GetPublishedName(context.Background(), "nightly")
+	if err != nil || n.Seq != 2 || n.CID != cid2 {
+		t.Fatalf("stored name = %+v, %v", n, err)
+	}
+	if publisher.publishName("bad/name", cid2) == nil {
+		t.Fatal("published an invalid name")
+	}
+}
+
+func TestResolveNameWithoutPriorConnection(t *testing.T) {
+	tn := newUnconnectedTestNetwork(t, 2)
+	publisher, resolver := tn.nodes[0], tn.nodes[1]
+
+	// The two only share a bootstrap node that does not take part in the
+	// name DHT, as on a fresh client.
+	h, err := tn.mn.GenPeer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bootstrap, err := dht.New(context.Background(), h, dht.Mode(dht.ModeServer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bootstrap.Close() })
+	for _, node := range []*testNode{publisher, resolver} {
+		if _, err := tn.mn.LinkPeers(h.ID(), node.host.ID()); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tn.mn.ConnectPeers(h.ID(), node.host.ID()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, 30*time.Second, "bootstrap node to know both clients", func() bool {
+		return bootstrap.RoutingTable().Size() == 2
+	})
+
+	cidStr, want := tn.shareFile(publisher, "nightly.bin", testFileSize)
+	if err := publisher.publishName("nightly", cidStr); err != nil {
+		t.Fatalf("publishing without name DHT peers: %v", err)
+	}
+	if publisher.host.Network().Connectedness(resolver.host.ID()) == network.Connected {
+		t.Fatal("publisher and resolver are already connected")
+	}
+	// From here on they can dial each other, once they know how.
+	if _, err := tn.mn.LinkPeers(publisher.host.ID(), resolver.host.ID()); err != nil {
+		t.Fatal(err)
+	}
+	name := publisher.host.ID().String() + "/nightly"
+	target, err := resolver.resolveTarget(name, &downloadOptions{})
+	if err != nil || target != cidStr {
+		t.Fatalf("resolved %s to %s, %v; want %s", name, target, err, cidStr)
+	}
+	if got := tn.download(resolver, target, downloadOptions{}); !bytes.Equal(got, want) {
+		t.Fatal("downloaded content differs from the published file")
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	webRTC "torrentium/internal/client"
+	"torrentium/internal/crypt"
+	db "torrentium/internal/db"
+	"torrentium/internal/logging"
+
+	"github.com/ipfs/go-cid"
+)
+
+// announcePartial advertises an in-progress download on the DHT so that
+// other downloaders can fetch the pieces we already have.
+func (c *Client) announcePartial(fileCID cid.Cid) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	if err := c.provide(ctx, fileCID); err != nil {
+		dhtLog.Warn("failed to announce partial download", logging.KeyCID, fileCID, logging.KeyErr, err)
+		return
+	}
+	dhtLog.Info("announced partial download", logging.KeyCID, fileCID)
+}
+
+// partialDownload returns the stored download record for a CID that is being
+// downloaded right now and may be served to other peers.
+func (c *Client) partialDownload(ctx context.Context, cidStr string) (*db.Download, bool) {
+	c.downloadsMux.RLock()
+	state, ok := c.activeDownloads[cidStr]
+	c.downloadsMux.RUnlock()
+	if !ok || !state.Shareable {
+		return nil, false
+	}
+	d, err := c.db.GetDownloadByCID(ctx, cidStr)
+	if err != nil || d.Status != db.DownloadStatusDownloading {
+		return nil, false
+	}
+	return d, true
+}
+
+// buildManifest assembles the manifest for a CID, either from a shared local
+// file or from the stored manifest of a shareable in-progress download.
+func (c *Client) buildManifest(ctx context.Context, cidStr string) (controlMessage, error) {
+	manifest := controlMessage{Command: "MANIFEST", CID: cidStr}
+	if localFile, err := c.db.GetLocalFileByCID(ctx, cidStr); err == nil {
+		manifest.TotalSize = localFile.FileSize
+		manifest.HashHex = localFile.FileHash
+		manifest.Filename = localFile.Filename
+		manifest.PieceSize = localFile.PieceSize
+		if localFile.ShareKey != "" {
+			key, err := crypt.DecodeKey(localFile.ShareKey)
+			if err != nil {
+				return controlMessage{}, err
+			}
+			if manifest.Filename, err = crypt.SealName(key, localFile.Filename); err != nil {
+				return controlMessage{}, err
+			}
+			manifest.Encrypted = true
+		}
+		manifest.Restricted = localFile.Restricted
+	} else if d, ok := c.partialDownload(ctx, cidStr); ok {
+		manifest.TotalSize = d.FileSize
+		manifest.HashHex = d.FileHash
+		manifest.Filename = d.Filename
+	} else {
+		return controlMessage{}, fmt.Errorf("%w: %s", errNotFound, cidStr)
+	}
+
+	pieces, err := c.db.GetPieces(ctx, cidStr)
+	if err != nil {
+		return controlMessage{}, fmt.Errorf("error getting pieces: %w", err)
+	}
+	manifest.NumPieces = int64(len(pieces))
+	manifest.Pieces = pieces
+	if manifest.PieceSize == 0 {
+		// Partial downloads and files added before the piece size was
+		// recorded.
+		manifest.PieceSize = piecesSize(pieces)
+	}
+	return manifest, nil
+}
+
+// pieceSourcePath returns the file a piece can be read from: the shared file
+// itself, or the partial .download file if we already have that piece.
+func (c *Client) pieceSourcePath(ctx context.Context, cidStr string, piece db.Piece) (string, error) {
+	if fileInfo, err := c.db.GetLocalFileByCID(ctx, cidStr); err == nil {
+		return fileInfo.FilePath, nil
+	}
+	d, ok := c.partialDownload(ctx, cidStr)
+	if !ok {
+		return "", fmt.Errorf("%w: %s", errNotShared, cidStr)
+	}
+	if !piece.Have {
+		return "", errPieceUnavailable
+	}
+	return d.DownloadPath, nil
+}
+
+var (
+	errPieceUnavailable = errors.New("piece not downloaded yet")
+	errNotShared        = errors.New("file is not shared")
+)
+
+// handlePieceUnavailable reassigns a piece that a partial seeder did not have.
+func (c *Client) handlePieceUnavailable(ctrl controlMessage, peer *webRTC.SimpleWebRTCPeer) {
+	c.downloadsMux.RLock()
+	state, ok := c.activeDownloads[ctrl.CID]
+	c.downloadsMux.RUnlock()
+	if !ok {
+		return
+	}
+	idx := int(ctrl.Index)
+	pid := peer.GetSignalingStream().Conn().RemotePeer()
+	state.mu.Lock()
+	if idx < 0 || idx >= len(state.PieceStatus) || state.PieceStatus[idx] {
+		state.mu.Unlock()
+		return
+	}
+	if state.lacking[pid] == nil {
+		state.lacking[pid] = make(map[int]bool)
+	}
+	state.lacking[pid][idx] = true
+	if state.Sequential {
+		// Let another streaming worker take the piece.
+		state.mu.Unlock()
+		state.releasePiece(idx)
+		return
+	}
+	if timer, ok := state.pieceTimers[idx]; ok {
+		timer.Stop()
+		delete(state.pieceTimers, idx)
+	}
+	state.mu.Unlock()
+	transferLog.Debug("peer does not have piece yet, re-requesting", logging.KeyPeer, pid, logging.KeyCID, ctrl.CID, logging.KeyPiece, idx)
+	c.reRequestPiece(state, idx)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// startPartialDownload starts downloading target on node while origin holds
+// back every piece but the first, and returns once node has verified that
+// piece. The returned function lets the remaining pieces through and waits
+// for the download to finish.
+func startPartialDownload(tn *testNetwork, origin, node *testNode, target string) func() {
+	tn.t.Helper()
+	release := make(chan struct{})
+	origin.hooks.beforeSendChunk = func(to peer.ID, msg *controlMessage) bool {
+		if to == node.host.ID() && msg.Index != 0 {
+			<-release
+		}
+		return true
+	}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- node.downloadFile(target, downloadOptions{}) }()
+	var once sync.Once
+	finish := func() {
+		tn.t.Helper()
+		once.Do(func() {
+			close(release)
+			select {
+			case err := <-errCh:
+				if err != nil {
+					tn.t.Fatalf("download failed: %v", err)
+				}
+			case <-time.After(testTransferTimeout):
+				tn.t.Fatalf("download of %s did not finish within %v", target, testTransferTimeout)
+			}
+		})
+	}
+	tn.t.Cleanup(finish)
+
+	id, _ := splitShareLink(target)
+	waitFor(tn.t, testTransferTimeout, "the first piece to arrive", func() bool {
+		pieces, _ := node.db.GetPieces(context.Background(), id)
+		return len(pieces) > 1 && pieces[0].Have
+	})
+	return finish
+}
+
+// announced reports whether node has announced itself as a provider of cidStr.
+func announced(t *testing.T, node *testNode, cidStr string) bool {
+	t.Helper()
+	providers, err := node.dht.ProviderStore().GetProviders(context.Background(), mustDecodeCID(t, cidStr).Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range providers {
+		if p.ID == node.host.ID() {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTransferFromPartialSeeder(t *testing.T) {
+	tn := newTestNetwork(t, 3)
+	origin, partial, late := tn.nodes[0], tn.nodes[1], tn.nodes[2]
+	partial.seeding = seedingConfig{Enabled: true}
+	cidStr, want := tn.shareFile(origin, "partial.bin", testFileSize)
+
+	finish := startPartialDownload(tn, origin, partial, cidStr)
+	waitFor(t, 30*time.Second, "the partial download to be announced", func() bool {
+		return announced(t, partial, cidStr)
+	})
+
+	full, err := origin.buildManifest(context.Background(), cidStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := partial.buildManifest(context.Background(), cidStr)
+	if err != nil {
+		t.Fatalf("partial download has no manifest: %v", err)
+	}
+	if manifest.NumPieces != full.NumPieces || manifest.PieceSize != full.PieceSize || manifest.TotalSize != full.TotalSize || manifest.HashHex != full.HashHex {
+		t.Fatalf("manifest = %d pieces of %d bytes, want %d pieces of %d bytes", manifest.NumPieces, manifest.PieceSize, full.NumPieces, full.PieceSize)
+	}
+
+	// Everything the late node gets has to come from the partial seeder.
+	if err := tn.mn.UnlinkPeers(origin.host.ID(), late.host.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if err := tn.mn.DisconnectPeers(origin.host.ID(), late.host.ID()); err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	served := make(map[int64]bool)
+	partial.hooks.beforeSendChunk = func(to peer.ID, msg *controlMessage) bool {
+		if to == late.host.ID() {
+			mu.Lock()
+			served[msg.Index] = true
+			mu.Unlock()
+		}
+		return true
+	}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- late.downloadFile(cidStr, downloadOptions{}) }()
+	waitFor(t, testTransferTimeout, "the partial seeder to report missing pieces", func() bool {
+		late.downloadsMux.RLock()
+		state, ok := late.activeDownloads[cidStr]
+		late.downloadsMux.RUnlock()
+		if !ok {
+			return false
+		}
+		state.mu.Lock()
+		defer state.mu.Unlock()
+		lacking := state.lacking[partial.host.ID()]
+		return state.PieceStatus[0] && !lacking[0] && len(lacking) > 0
+	})
+	mu.Lock()
+	if len(served) != 1 || !served[0] {
+		t.Errorf("partial seeder served pieces %v, want only the piece it had", served)
+	}
+	mu.Unlock()
+
+	finish()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("download failed: %v", err)
+		}
+	case <-time.After(testTransferTimeout):
+		t.Fatalf("download of %s did not finish within %v", cidStr, testTransferTimeout)
+	}
+	d, err := late.db.GetDownloadByCID(context.Background(), cidStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(d.DownloadPath); err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("downloaded content differs from the shared file: %v", err)
+	}
+}
+
+func TestPrivatePartialDownloadIsNotShared(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts func(partial *testNode) addOptions
+	}{
+		{"encrypted", func(*testNode) addOptions { return addOptions{Encrypt: true} }},
+		{"restricted", func(partial *testNode) addOptions { return addOptions{Allow: []peer.ID{partial.host.ID()}} }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tn := newTestNetwork(t, 2)
+			origin, partial := tn.nodes[0], tn.nodes[1]
+			partial.seeding = seedingConfig{Enabled: true}
+			want := bytes.Repeat([]byte("private build "), testFileSize/14)
+			cidStr, key := sharePrivate(tn, origin, "private.bin", want, tc.opts(partial))
+			target := cidStr
+			if key != "" {
+				target += "#" + key
+			}
+
+			finish := startPartialDownload(tn, origin, partial, target)
+			ctx := context.Background()
+			if announced(t, partial, cidStr) {
+				t.Fatal("private download was announced")
+			}
+			if _, err := partial.buildManifest(ctx, cidStr); !errors.Is(err, errNotFound) {
+				t.Fatalf("manifest of a private download: err = %v, want %v", err, errNotFound)
+			}
+			pieces, err := partial.db.GetPieces(ctx, cidStr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := partial.pieceSourcePath(ctx, cidStr, pieces[0]); !errors.Is(err, errNotShared) {
+				t.Fatalf("piece of a private download: err = %v, want %v", err, errNotShared)
+			}
+
+			finish()
+			if announced(t, partial, cidStr) {
+				t.Fatal("private download was announced")
+			}
+		})
+	}
+}
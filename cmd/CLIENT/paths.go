@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// Conflict policies for a download whose target path already exists.
+const (
+	ConflictRename    = "rename"
+	ConflictOverwrite = "overwrite"
+	ConflictSkip      = "skip"
+)
+
+const maxFilenameLen = 255
+
+// errDownloadSkipped is returned when the target exists and the conflict
+// policy is ConflictSkip.
+var errDownloadSkipped = errors.New("target file already exists")
+
+// outputConfig controls where downloads are written.
+type outputConfig struct {
+	Dir        string
+	OnConflict string
+}
+
+// loadOutputConfig reads TORRENTIUM_DOWNLOAD_DIR (default: the working
+// directory) and TORRENTIUM_ON_CONFLICT (rename, overwrite or skip).
+func loadOutputConfig() outputConfig {
+	cfg := outputConfig{Dir: ".", OnConflict: ConflictRename}
+	if v := os.Getenv("TORRENTIUM_DOWNLOAD_DIR"); v != "" {
+		cfg.Dir = v
+	}
+	if v := os.Getenv("TORRENTIUM_ON_CONFLICT"); v != "" {
+		if validConflictPolicy(v) {
+			cfg.OnConflict = v
+		} else {
+			logger.Warn("invalid TORRENTIUM_ON_CONFLICT", "value", v, "using", cfg.OnConflict)
+		}
+	}
+	return cfg
+}
+
+func validConflictPolicy(p string) bool {
+	return p == ConflictRename || p == ConflictOverwrite || p == ConflictSkip
+}
+
+// sanitizeFilename turns a filename supplied by a remote peer into a safe
+// single path component. Directory parts, control characters and characters
+// that are invalid on common filesystems are removed, and Windows device
+// names get a leading underscore; if nothing usable is left, fallback is
+// returned.
+func sanitizeFilename(name, fallback string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsControl(r):
+			return -1
+		case strings.ContainsRune(`<>:"|?*`, r):
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	name = strings.TrimRight(name, ". ")
+	if isReservedName(name) {
+		name = "_" + name
+	}
+	if len(name) > maxFilenameLen {
+		ext := filepath.Ext(name)
+		if len(ext) > 16 {
+			ext = ""
+		}
+		name = strings.ToValidUTF8(name[:maxFilenameLen-len(ext)], "") + ext
+	}
+	if name == "" || name == "." || name == ".." {
+		return fallback
+	}
+	return name
+}
+
+// isReservedName reports whether name refers to a device on Windows, where
+// "CON" and "con.txt" alike open the console rather than a file.
+func isReservedName(name string) bool {
+	stem, _, _ := strings.Cut(name, ".")
+	switch stem = strings.ToUpper(strings.TrimSpace(stem)); stem {
+	case "CON", "PRN", "AUX", "NUL":
+		return true
+	}
+	if len(stem) == 4 && (strings.HasPrefix(stem, "COM") || strings.HasPrefix(stem, "LPT")) {
+		return stem[3] >= '1' && stem[3] <= '9'
+	}
+	return false
+}
+
+// resolveOutputPath decides the final path of a download. out is the
+// --out argument: an existing directory (or one ending in a separator)
+// receives the sanitized remote name, anything else is used as the file path.
+// Without --out the configured download directory is used.
+func resolveOutputPath(dir, out, remoteName, fallback string) (string, error) {
+	name := sanitizeFilename(remoteName, fallback)
+	if out == "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return "", fmt.Errorf("failed to create download directory: %w", err)
+		}
+		return filepath.Join(dir, name), nil
+	}
+	if strings.HasSuffix(out, string(os.PathSeparator)) || strings.HasSuffix(out, "/") {
+		if err := os.MkdirAll(out, 0o755); err != nil {
+			return "", fmt.Errorf("failed to create output directory: %w", err)
+		}
+		return filepath.Join(out, name), nil
+	}
+	if info, err := os.Stat(out); err == nil && info.IsDir() {
+		return filepath.Join(out, name), nil
+	}
+	if err := os.MkdirAll(filepath.Dir(out), 0o755); err != nil {
+		return "", fmt.Errorf("failed to create output directory: %w", err)
+	}
+	return filepath.Clean(out), nil
+}
+
+// partialSuffix is appended to the target path of a download while it runs.
+const partialSuffix = ".download"
+
+// reserveOutputPath picks the path a download is saved to when path may
+// already exist, and reserves it by creating its partial file, which is
+// returned open. A path is taken if it exists or another download is writing
+// its partial file; creating the partial file exclusively makes the check and
+// the reservation one step, so concurrent downloads never share a target.
+// With ConflictRename a numbered suffix is added ("file (1).txt").
+func reserveOutputPath(path, policy string) (string, *os.File, error) {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for i := 0; i < 10000; i++ {
+		candidate := path
+		if i > 0 {
+			candidate = fmt.Sprintf("%s (%d)%s", base, i, ext)
+		}
+		if _, err := os.Lstat(candidate); err == nil {
+			switch policy {
+			case ConflictSkip:
+				return "", nil, fmt.Errorf("%w: %s", errDownloadSkipped, candidate)
+			case ConflictRename:
+				continue
+			}
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return "", nil, err
+		}
+		f, err := os.OpenFile(candidate+partialSuffix, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+		if err == nil {
+			return candidate, f, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return "", nil, err
+		}
+		switch policy {
+		case ConflictSkip:
+			return "", nil, fmt.Errorf("%w: %s is being downloaded", errDownloadSkipped, candidate)
+		case ConflictOverwrite:
+			return "", nil, fmt.Errorf("%s is already being downloaded", candidate)
+		}
+	}
+	return "", nil, fmt.Errorf("could not find a free name for %s", path)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	const fallback = "bafkfallback"
+	long := strings.Repeat("a", 300)
+	for _, tc := range []struct {
+		name, in, want string
+	}{
+		{"plain", "report.pdf", "report.pdf"},
+		{"hidden file", ".bashrc", ".bashrc"},
+		{"parent traversal", "../../etc/passwd", "passwd"},
+		{"absolute path", "/etc/passwd", "passwd"},
+		{"backslash traversal", `..\..\evil.txt`, "evil.txt"},
+		{"windows absolute path", `C:\Windows\System32\cmd.exe`, "cmd.exe"},
+		{"drive letter only", "C:evil.txt", "C_evil.txt"},
+		{"NUL byte", "a\x00b.txt", "ab.txt"},
+		{"control characters", "line\nbreak\t\r.txt", "linebreak.txt"},
+		{"escape sequence", "\x1b[31mred", "[31mred"},
+		{"DEL and C1 controls", "a\x7fb\u0085c", "abc"},
+		{"invalid characters", `a<b>c:d"e|f?g*h`, "a_b_c_d_e_f_g_h"},
+		{"trailing dots and spaces", "name. . ", "name"},
+		{"surrounding spaces", "  name.txt  ", "name.txt"},
+		{"reserved CON", "CON", "_CON"},
+		{"reserved lower case with extension", "nul.txt", "_nul.txt"},
+		{"reserved COM port", "com1.log", "_com1.log"},
+		{"reserved LPT port", "LPT9", "_LPT9"},
+		{"reserved with trailing dot", "aux.", "_aux"},
+		{"not reserved COM0", "COM0", "COM0"},
+		{"not reserved prefix", "console.txt", "console.txt"},
+		{"empty", "", fallback},
+		{"only spaces", "   ", fallback},
+		{"dot", ".", fallback},
+		{"dot dot", "..", fallback},
+		{"traversal only", "../..", fallback},
+		{"trailing slash", "dir/", fallback},
+		{"only dots", "....", fallback},
+		{"only control characters", "\x00\x01\x02", fallback},
+		{"too long keeps extension", long + ".txt", long[:251] + ".txt"},
+		{"too long with long extension", "a." + long, ("a." + long)[:maxFilenameLen]},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := sanitizeFilename(tc.in, fallback); got != tc.want {
+				t.Errorf("sanitizeFilename(%q) = %q, want %q", tc.in, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeFilenameIsSinglePathComponent(t *testing.T) {
+	for _, in := range []string{
+		strings.Repeat("é", 200) + ".mkv",
+		strings.Repeat("日本", 100),
+		"a/" + strings.Repeat("b", 400),
+		"\x00../\x00../x",
+		`a\b/c\..`,
+		"CON." + strings.Repeat("x", 300),
+	} {
+		got := sanitizeFilename(in, "fallback")
+		if len(got) > maxFilenameLen || !utf8.ValidString(got) {
+			t.Errorf("sanitizeFilename(%q) = %q (%d bytes)", in, got, len(got))
+		}
+		if strings.ContainsAny(got, `/\`) || got == "." || got == ".." || filepath.Base(got) != got {
+			t.Errorf("sanitizeFilename(%q) = %q is not a single path component", in, got)
+		}
+	}
+}
+
+func TestResolveOutputPath(t *testing.T) {
+	root := t.TempDir()
+	existing := filepath.Join(root, "existing")
+	if err := os.Mkdir(existing, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name, dir, out, remote, want string
+	}{
+		{"download dir", filepath.Join(root, "downloads"), "", "a.txt", filepath.Join(root, "downloads", "a.txt")},
+		{"download dir with traversal", filepath.Join(root, "downloads"), "", "../../a.txt", filepath.Join(root, "downloads", "a.txt")},
+		{"out ending in separator", root, filepath.Join(root, "new") + "/", "a.txt", filepath.Join(root, "new", "a.txt")},
+		{"out is an existing directory", root, existing, "../a.txt", filepath.Join(existing, "a.txt")},
+		{"out is a file path", root, filepath.Join(root, "sub", "dir", "..", "b.bin"), "a.txt", filepath.Join(root, "sub", "b.bin")},
+		{"unusable remote name", root, existing + "/", "..", filepath.Join(existing, "bafkfallback")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := resolveOutputPath(tc.dir, tc.out, tc.remote, "bafkfallback")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("resolveOutputPath = %s, want %s", got, tc.want)
+			}
+			if info, err := os.Stat(filepath.Dir(got)); err != nil || !info.IsDir() {
+				t.Errorf("parent directory of %s was not created: %v", got, err)
+			}
+		})
+	}
+}
+
+// reserve calls reserveOutputPath and closes the partial file it creates.
+func reserve(t *testing.T, path, policy string) (string, error) {
+	t.Helper()
+	got, f, err := reserveOutputPath(path, policy)
+	if err == nil {
+		f.Close()
+	}
+	return got, err
+}
+
+func TestReserveOutputPath(t *testing.T) {
+	dir := t.TempDir()
+	for _, policy := range []string{ConflictRename, ConflictOverwrite, ConflictSkip} {
+		free := filepath.Join(dir, "free-"+policy+".txt")
+		if got, err := reserve(t, free, policy); err != nil || got != free {
+			t.Errorf("%s of a free path = %s, %v", policy, got, err)
+		}
+		if _, err := os.Stat(free + partialSuffix); err != nil {
+			t.Errorf("%s did not create the partial file: %v", policy, err)
+		}
+	}
+
+	taken := writeTestFile(t, dir, "taken.txt", []byte("x"))
+	if got, err := reserve(t, taken, ConflictOverwrite); err != nil || got != taken {
+		t.Errorf("overwrite = %s, %v", got, err)
+	}
+	os.Remove(taken + partialSuffix)
+	if _, err := reserve(t, taken, ConflictSkip); !errors.Is(err, errDownloadSkipped) {
+		t.Errorf("skip: err = %v, want errDownloadSkipped", err)
+	}
+
+	got, err := reserve(t, taken, ConflictRename)
+	if err != nil || got != filepath.Join(dir, "taken (1).txt") {
+		t.Fatalf("rename = %s, %v", got, err)
+	}
+	// The partial file of the first rename reserves "taken (1).txt".
+	if got, err := reserve(t, taken, ConflictRename); err != nil || got != filepath.Join(dir, "taken (2).txt") {
+		t.Errorf("second rename = %s, %v", got, err)
+	}
+
+	// A dangling symlink is taken too: writing through it would create its target.
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(filepath.Join(dir, "nowhere"), link); err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+	if got, err := reserve(t, link, ConflictRename); err != nil || got != link+" (1)" {
+		t.Errorf("rename of a dangling symlink = %s, %v", got, err)
+	}
+}
+
+func TestReserveOutputPathWhileDownloading(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "movie.mkv")
+	writeTestFile(t, dir, "movie.mkv"+partialSuffix, []byte("partial"))
+
+	if got, err := reserve(t, path, ConflictRename); err != nil || got != filepath.Join(dir, "movie (1).mkv") {
+		t.Errorf("rename = %s, %v", got, err)
+	}
+	if _, err := reserve(t, path, ConflictSkip); !errors.Is(err, errDownloadSkipped) {
+		t.Errorf("skip: err = %v, want errDownloadSkipped", err)
+	}
+	if _, err := reserve(t, path, ConflictOverwrite); err == nil {
+		t.Error("overwrite reserved a path another download is writing")
+	}
+	if data, _ := os.ReadFile(path + partialSuffix); string(data) != "partial" {
+		t.Errorf("partial file of the running download was truncated: %q", data)
+	}
+
+	// Concurrent downloads of the same name all get their own path.
+	const n = 8
+	paths := make(chan string, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p, err := reserve(t, filepath.Join(dir, "same.bin"), ConflictRename)
+			if err != nil {
+				t.Error(err)
+			}
+			paths <- p
+		}()
+	}
+	wg.Wait()
+	close(paths)
+	seen := make(map[string]bool)
+	for p := range paths {
+		if seen[p] {
+			t.Errorf("%s was reserved twice", p)
+		}
+		seen[p] = true
+	}
+}
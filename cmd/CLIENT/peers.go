@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+
+	db "torrentium/internal/db"
+	"torrentium/internal/logging"
+
+	"github.com/dustin/go-humanize"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Reputation changes applied after every verified or corrupt piece.
+const (
+	GoodPieceScore = 1.0
+	BadPieceScore  = -10.0
+)
+
+// errPeerRefused is returned to peers we do not talk to.
+var errPeerRefused = errors.New("peer not allowed")
+
+// peerPolicy decides which peers we exchange data with.
+type peerPolicy struct {
+	TrustedOnly bool    // talk only to trusted peers
+	BanScore    float64 // block peers whose score drops to this value; 0 disables auto-bans
+}
+
+// loadPeerPolicy reads TORRENTIUM_TRUSTED_ONLY (default false) and
+// TORRENTIUM_BAN_SCORE (default -20, 0 disables automatic bans).
+func loadPeerPolicy() peerPolicy {
+	cfg := peerPolicy{BanScore: -20}
+	if v := os.Getenv("TORRENTIUM_TRUSTED_ONLY"); v != "" {
+		trusted, err := strconv.ParseBool(v)
+		if err != nil {
+			logger.Warn("invalid TORRENTIUM_TRUSTED_ONLY", "value", v, logging.KeyErr, err)
+		} else {
+			cfg.TrustedOnly = trusted
+		}
+	}
+	if v := os.Getenv("TORRENTIUM_BAN_SCORE"); v != "" {
+		score, err := strconv.ParseFloat(v, 64)
+		if err != nil || score > 0 {
+			logger.Warn("invalid TORRENTIUM_BAN_SCORE", "value", v)
+		} else {
+			cfg.BanScore = score
+		}
+	}
+	return cfg
+}
+
+// loadPeerRules restores the stored block and trust lists into the gater.
+func (c *Client) loadPeerRules() {
+	rules, err := c.db.GetPeerRules(context.Background())
+	if err != nil {
+		logger.Error("failed to load peer rules", logging.KeyErr, err)
+		return
+	}
+	for _, r := range rules {
+		pid, err := peer.Decode(r.PeerID)
+		if err != nil {
+			logger.Warn("ignoring peer rule with invalid peer ID", logging.KeyPeer, r.PeerID)
+			continue
+		}
+		switch r.Rule {
+		case db.PeerRuleBlock:
+			c.gater.Block(pid)
+		case db.PeerRuleTrust:
+			c.gater.Trust(pid)
+		}
+	}
+}
+
+// peerAllowed reports whether we accept signaling and control messages from
+// pid and connect to it for downloads.
+func (c *Client) peerAllowed(pid peer.ID) bool {
+	if c.gater.Blocked(pid) {
+		return false
+	}
+	return !c.policy.TrustedOnly || c.gater.Trusted(pid)
+}
+
+// disconnectPeer drops our WebRTC and libp2p connections to pid.
+func (c *Client) disconnectPeer(pid peer.ID) {
+	c.peersMux.RLock()
+	p := c.webRTCPeers[pid]
+	c.peersMux.RUnlock()
+	if p != nil {
+		p.Close()
+	}
+	_ = c.host.Network().ClosePeer(pid)
+}
+
+func (c *Client) blockPeer(pid peer.ID, reason string) error {
+	if err := c.db.SetPeerRule(context.Background(), pid.String(), db.PeerRuleBlock, reason); err != nil {
+		return err
+	}
+	c.gater.Block(pid)
+	c.disconnectPeer(pid)
+	return nil
+}
+
+func (c *Client) trustPeer(pid peer.ID) error {
+	if err := c.db.SetPeerRule(context.Background(), pid.String(), db.PeerRuleTrust, ""); err != nil {
+		return err
+	}
+	c.gater.Trust(pid)
+	return nil
+}
+
+// unblockPeer lifts a block and resets the peer's reputation so that it is
+// not banned again by the next penalty.
+func (c *Client) unblockPeer(pid peer.ID) error {
+	ctx := context.Background()
+	if !c.gater.Blocked(pid) {
+		return fmt.Errorf("%s is not blocked", pid)
+	}
+	if err := c.db.DeletePeerRule(ctx, pid.String()); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	c.gater.Clear(pid)
+	return c.db.ResetPeerScore(ctx, pid.String())
+}
+
+// adjustPeerScore records a reputation change and blocks the peer if its
+// score falls to the ban threshold. Trusted peers are never banned.
+func (c *Client) adjustPeerScore(pid peer.ID, delta float64, reason string) {
+	ctx := context.Background()
+	if err := c.db.SetPeerScore(ctx, pid.String(), delta); err != nil {
+		logger.Warn("failed to update peer score", logging.KeyPeer, pid, logging.KeyErr, err)
+		return
+	}
+	if delta >= 0 || c.policy.BanScore == 0 || c.gater.Trusted(pid) || c.gater.Blocked(pid) {
+		return
+	}
+	score, err := c.db.GetPeerScore(ctx, pid.String())
+	if err != nil || score > c.policy.BanScore {
+		return
+	}
+	logger.Warn("banning peer", logging.KeyPeer, pid, "score", score, "reason", reason)
+	if err := c.blockPeer(pid, "auto: "+reason); err != nil {
+		logger.Error("failed to ban peer", logging.KeyPeer, pid, logging.KeyErr, err)
+	}
+}
+
+func (c *Client) setPeerRule(cmd, peerStr, reason string) error {
+	pid, err := peer.Decode(peerStr)
+	if err != nil {
+		return fmt.Errorf("invalid peer ID %q", peerStr)
+	}
+	if pid == c.host.ID() {
+		return fmt.Errorf("cannot %s yourself", cmd)
+	}
+	switch cmd {
+	case "block":
+		err = c.blockPeer(pid, reason)
+	case "trust":
+		err = c.trustPeer(pid)
+	case "unblock":
+		err = c.unblockPeer(pid)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("✓ %sed %s\n", cmd, pid)
+	return nil
+}
+
+func (c *Client) listPeerRules() error {
+	ctx := context.Background()
+	rules, err := c.db.GetPeerRules(ctx)
+	if err != nil {
+		return err
+	}
+	if len(rules) == 0 {
+		fmt.Println(" - No blocked or trusted peers.")
+		return nil
+	}
+	fmt.Println("\n=== Peer Rules ===")
+	for _, r := range rules {
+		fmt.Printf("%-7s %s\n", r.Rule, r.PeerID)
+		if r.Reason != "" {
+			fmt.Printf(" Reason: %s\n", r.Reason)
+		}
+		if score, err := c.db.GetPeerScore(ctx, r.PeerID); err == nil && score != 0 {
+			fmt.Printf(" Score: %.1f\n", score)
+		}
+		fmt.Printf(" Since: %s\n", humanize.Time(r.CreatedAt))
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	db "torrentium/internal/db"
+	p2p "torrentium/internal/p2p"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestBlockedPeerIsRefused(t *testing.T) {
+	tn := newTestNetwork(t, 2)
+	seeder, leecher := tn.nodes[0], tn.nodes[1]
+	cidStr, want := tn.shareFile(seeder, "blocked.bin", testFileSize)
+
+	if err := seeder.setPeerRule("block", leecher.host.ID().String(), "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := leecher.downloadFile(cidStr, downloadOptions{}); err == nil {
+		t.Fatal("blocked peer downloaded the file")
+	}
+	if leecher.webRTCPeer(seeder.host.ID()) != nil {
+		t.Fatal("blocked peer holds a WebRTC connection")
+	}
+
+	if err := seeder.setPeerRule("unblock", leecher.host.ID().String(), ""); err != nil {
+		t.Fatal(err)
+	}
+	got := tn.download(leecher, cidStr, downloadOptions{})
+	if !bytes.Equal(got, want) {
+		t.Fatal("downloaded content differs from the shared file")
+	}
+}
+
+func TestTrustedOnlySkipsUntrustedProviders(t *testing.T) {
+	tn := newTestNetwork(t, 2)
+	seeder, leecher := tn.nodes[0], tn.nodes[1]
+	cidStr, want := tn.shareFile(seeder, "trusted.bin", testFileSize)
+
+	leecher.policy.TrustedOnly = true
+	err := leecher.downloadFile(cidStr, downloadOptions{})
+	if err == nil || !strings.Contains(err.Error(), "untrusted") {
+		t.Fatalf("download from untrusted provider: err = %v", err)
+	}
+
+	if err := leecher.setPeerRule("trust", seeder.host.ID().String(), ""); err != nil {
+		t.Fatal(err)
+	}
+	got := tn.download(leecher, cidStr, downloadOptions{})
+	if !bytes.Equal(got, want) {
+		t.Fatal("downloaded content differs from the shared file")
+	}
+}
+
+func TestCorruptingPeerIsBanned(t *testing.T) {
+	tn := newTestNetwork(t, 3)
+	good, bad, leecher := tn.nodes[0], tn.nodes[1], tn.nodes[2]
+	cidStr, want := tn.shareFile(good, "a.bin", testFileSize)
+	shareExisting(tn, bad, "b.bin", want)
+	// Peers start at a score of 10, so one corrupt piece is enough; the
+	// leecher may well fetch the retry from the honest seeder.
+	leecher.policy.BanScore = 10 + BadPieceScore/2
+
+	var corrupted atomic.Int32
+	bad.hooks.beforeSendChunk = func(_ peer.ID, msg *controlMessage) bool {
+		if msg.ChunkIndex == 0 {
+			corrupted.Add(1)
+			msg.Payload = flipHexDigit(msg.Payload)
+		}
+		return true
+	}
+
+	got := tn.download(leecher, cidStr, downloadOptions{})
+	if !bytes.Equal(got, want) {
+		t.Fatal("downloaded content differs from the shared file")
+	}
+	if corrupted.Load() == 0 {
+		t.Skip("the corrupting seeder was not used for this download")
+	}
+	waitFor(t, testTransferTimeout, "the corrupting peer to be banned", func() bool {
+		return leecher.gater.Blocked(bad.host.ID())
+	})
+	if leecher.gater.Blocked(good.host.ID()) {
+		t.Fatal("honest seeder was banned")
+	}
+	rules, err := leecher.db.GetPeerRules(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 1 || rules[0].Rule != db.PeerRuleBlock || rules[0].PeerID != bad.host.ID().String() {
+		t.Fatalf("rules = %+v, want a block of %s", rules, bad.host.ID())
+	}
+
+	// The ban survives a restart.
+	restarted := &Client{db: leecher.db, gater: p2p.NewGater()}
+	restarted.loadPeerRules()
+	if !restarted.gater.Blocked(bad.host.ID()) {
+		t.Fatal("ban was not restored from the database")
+	}
+}
+
+func TestMalformedMessagesDisconnectPeer(t *testing.T) {
+	tn := newTestNetwork(t, 2)
+	seeder, attacker := tn.nodes[0], tn.nodes[1]
+	cidStr, _ := tn.shareFile(seeder, "target.bin", testFileSize)
+
+	conn, err := attacker.initiateWebRTCConnectionWithRetry(seeder.host.ID(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Out-of-range requests must be ignored rather than crash the seeder.
+	for _, idx := range []int64{-1, 1 << 40} {
+		if err := conn.SendJSONReliable(controlMessage{Command: "REQUEST_PIECE", CID: cidStr, Index: idx}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < MaxMalformedMessages; i++ {
+		if err := conn.SendJSONReliable(map[string]any{"command": "REQUEST_PIECE", "index": "nope"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, 30*time.Second, "the seeder to hang up", func() bool {
+		return seeder.webRTCPeer(attacker.host.ID()) == nil
+	})
+	waitFor(t, 10*time.Second, "the attacker's score to drop", func() bool {
+		score, err := seeder.db.GetPeerScore(context.Background(), attacker.host.ID().String())
+		return err == nil && score < 0
+	})
+}
+
+func TestManifestRequestsAreRateLimited(t *testing.T) {
+	tn := newTestNetwork(t, 2)
+	seeder, attacker := tn.nodes[0], tn.nodes[1]
+	cidStr, _ := tn.shareFile(seeder, "target.bin", 1024)
+
+	conn, err := attacker.initiateWebRTCConnectionWithRetry(seeder.host.ID(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5*ManifestRequestBurst; i++ {
+		if err := conn.SendJSONReliable(controlMessage{Command: "REQUEST_MANIFEST", CID: cidStr}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, 10*time.Second, "the flood to be penalized", func() bool {
+		score, err := seeder.db.GetPeerScore(context.Background(), attacker.host.ID().String())
+		return err == nil && score != 0 && score <= 10+RequestFloodScore*ManifestRequestBurst
+	})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+
+	db "torrentium/internal/db"
+
+	"github.com/dustin/go-humanize"
+)
+
+// MinPieceSize is the smallest piece size addFile picks. Pieces are powers of
+// two between it and MaxPieceSize.
+const MinPieceSize = 256 << 10
+
+// targetPieces is about how many pieces addFile aims for: enough to spread a
+// download over several peers, few enough to keep the manifest small.
+const targetPieces = 1024
+
+// choosePieceSize returns the piece size for a file of the given size: the
+// smallest power of two that splits it into at most targetPieces pieces,
+// within [MinPieceSize, MaxPieceSize]. Files of 256 MiB or less use
+// MinPieceSize, 1 GiB files DefaultPieceSize and files of 16 GiB and more
+// MaxPieceSize.
+func choosePieceSize(fileSize int64) int64 {
+	want := (fileSize + targetPieces - 1) / targetPieces
+	if want <= MinPieceSize {
+		return MinPieceSize
+	}
+	size := int64(1) << bits.Len64(uint64(want-1))
+	return min(size, MaxPieceSize)
+}
+
+// parsePieceSize parses a piece size given on the command line, such as
+// "4MiB" or "512KiB".
+func parsePieceSize(s string) (int64, error) {
+	n, err := humanize.ParseBytes(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid piece size %q", s)
+	}
+	if n < MinPieceSize || n > MaxPieceSize || n&(n-1) != 0 {
+		return 0, fmt.Errorf("piece size must be a power of two between %s and %s", humanize.IBytes(MinPieceSize), humanize.IBytes(MaxPieceSize))
+	}
+	return int64(n), nil
+}
+
+// checkPieceCount rejects a piece size that would split a file of fileSize
+// bytes into more pieces than a manifest may list.
+func checkPieceCount(fileSize, pieceSize int64) error {
+	if n := (fileSize + pieceSize - 1) / pieceSize; n > MaxManifestPieces {
+		return fmt.Errorf("a piece size of %s splits the file into %d pieces, more than the limit of %d; use at least %s",
+			humanize.IBytes(uint64(pieceSize)), n, MaxManifestPieces, humanize.IBytes(uint64(choosePieceSize(fileSize))))
+	}
+	return nil
+}
+
+// piecesSize returns the piece size pieces were cut with: the size of every
+// piece but the last.
+func piecesSize(pieces []db.Piece) int64 {
+	if len(pieces) == 0 {
+		return 0
+	}
+	return pieces[0].Size
+}
+
+// manifestPieceSize returns the piece size of a manifest. Seeders that
+// predate adaptive piece sizes leave PieceSize unset.
+func manifestPieceSize(m controlMessage) int64 {
+	if m.PieceSize > 0 {
+		return m.PieceSize
+	}
+	return piecesSize(m.Pieces)
+}
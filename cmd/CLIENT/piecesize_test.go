@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChoosePieceSize(t *testing.T) {
+	for _, tc := range []struct{ fileSize, want int64 }{
+		{0, MinPieceSize},
+		{10 << 10, MinPieceSize},
+		{256 << 20, MinPieceSize},
+		{256<<20 + 1, 512 << 10},
+		{1 << 30, DefaultPieceSize},
+		{100 << 30, MaxPieceSize},
+	} {
+		if got := choosePieceSize(tc.fileSize); got != tc.want {
+			t.Errorf("choosePieceSize(%d) = %d, want %d", tc.fileSize, got, tc.want)
+		}
+	}
+}
+
+func TestCheckPieceCount(t *testing.T) {
+	const limit = MaxManifestPieces * MinPieceSize
+	for _, tc := range []struct {
+		fileSize, pieceSize int64
+		ok                  bool
+	}{
+		{0, MinPieceSize, true},
+		{limit, MinPieceSize, true},
+		{limit + 1, MinPieceSize, false},
+		{limit + 1, 2 * MinPieceSize, true},
+		{100 << 30, DefaultPieceSize, false},
+		{100 << 30, MaxPieceSize, true},
+	} {
+		if err := checkPieceCount(tc.fileSize, tc.pieceSize); (err == nil) != tc.ok {
+			t.Errorf("checkPieceCount(%d, %d) = %v", tc.fileSize, tc.pieceSize, err)
+		}
+	}
+}
+
+func TestAddRejectsTooManyPieces(t *testing.T) {
+	c := newOfflineClient(t, 0)
+	path := filepath.Join(t.TempDir(), "huge.bin")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A sparse file: the size is checked before anything is read.
+	if err := f.Truncate(MaxManifestPieces*MinPieceSize + 1); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := c.addFile(context.Background(), path, addOptions{PieceSize: MinPieceSize}); err == nil {
+		t.Fatal("added a file with more pieces than a manifest may list")
+	}
+	if files, _ := c.db.GetLocalFiles(context.Background()); len(files) != 0 {
+		t.Fatalf("%d file(s) recorded", len(files))
+	}
+}
+
+func TestTransferKeepsPieceSize(t *testing.T) {
+	tn := newTestNetwork(t, 2)
+	seeder, leecher := tn.nodes[0], tn.nodes[1]
+	leecher.seeding = seedingConfig{Enabled: true}
+	want := make([]byte, testFileSize)
+	rand.Read(want)
+	path := writeTestFile(t, seeder.dir, "custom.bin", want)
+	if err := seeder.addFile(context.Background(), path, addOptions{PieceSize: 512 << 10}); err != nil {
+		t.Fatal(err)
+	}
+	cidStr := rawCID(t, want)
+
+	manifest, err := seeder.buildManifest(context.Background(), cidStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.PieceSize != 512<<10 || manifest.NumPieces != (testFileSize+512<<10-1)/(512<<10) {
+		t.Fatalf("manifest has piece size %d and %d pieces", manifest.PieceSize, manifest.NumPieces)
+	}
+
+	got := tn.download(leecher, cidStr, downloadOptions{})
+	if !bytes.Equal(got, want) {
+		t.Fatal("downloaded content differs from the shared file")
+	}
+	lf, err := leecher.db.GetLocalFileByCID(context.Background(), cidStr)
+	if err != nil {
+		t.Fatalf("completed download is not shared: %v", err)
+	}
+	if lf.PieceSize != 512<<10 {
+		t.Fatalf("seeded download has piece size %d, want %d", lf.PieceSize, 512<<10)
+	}
+}
+
+func TestReAddWithDifferentPieceSize(t *testing.T) {
+	tn := newTestNetwork(t, 2)
+	seeder, leecher := tn.nodes[0], tn.nodes[1]
+	want := make([]byte, testFileSize)
+	rand.Read(want)
+	path := writeTestFile(t, seeder.dir, "resized.bin", want)
+	cidStr := rawCID(t, want)
+	for _, size := range []int64{MinPieceSize, 1 << 20} {
+		if err := seeder.addFile(context.Background(), path, addOptions{PieceSize: size}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pieces, err := seeder.db.GetPieces(context.Background(), cidStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := (testFileSize + 1<<20 - 1) / (1 << 20); len(pieces) != n {
+		t.Fatalf("%d piece rows after re-adding, want %d", len(pieces), n)
+	}
+	for i, p := range pieces {
+		offset := int64(i) << 20
+		if p.Offset != offset || p.Size != min64(1<<20, testFileSize-offset) {
+			t.Fatalf("piece %d has offset %d and size %d after re-adding", i, p.Offset, p.Size)
+		}
+	}
+
+	got := tn.download(leecher, cidStr, downloadOptions{})
+	if !bytes.Equal(got, want) {
+		t.Fatal("downloaded content differs from the shared file")
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	webRTC "torrentium/internal/client"
+	"torrentium/internal/crypt"
+	"torrentium/internal/logging"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// errAccessDenied is returned when a seeder refuses to serve us a CID because
+// we are not on its allowlist.
+var errAccessDenied = errors.New("access denied by provider")
+
+// shareConfig controls where the ciphertext of encrypted shares is kept.
+type shareConfig struct {
+	EncryptedDir string
+}
+
+// loadShareConfig reads TORRENTIUM_ENCRYPTED_DIR (default "./encrypted").
+func loadShareConfig() shareConfig {
+	cfg := shareConfig{EncryptedDir: "encrypted"}
+	if v := os.Getenv("TORRENTIUM_ENCRYPTED_DIR"); v != "" {
+		cfg.EncryptedDir = v
+	}
+	return cfg
+}
+
+// addOptions are the flags accepted by the add command.
+type addOptions struct {
+	Encrypt   bool
+	Allow     []peer.ID // serve the file only to these peers; empty means anyone
+	PieceSize int64     // 0 picks one from the file size
+}
+
+func parseAddArgs(args []string) (string, addOptions, error) {
+	var opts addOptions
+	var path string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--encrypt":
+			opts.Encrypt = true
+		case "--allow":
+			if i+1 >= len(args) {
+				return "", opts, fmt.Errorf("--allow requires a peer ID")
+			}
+			i++
+			for _, s := range strings.Split(args[i], ",") {
+				pid, err := peer.Decode(s)
+				if err != nil {
+					return "", opts, fmt.Errorf("invalid peer ID %q", s)
+				}
+				opts.Allow = append(opts.Allow, pid)
+			}
+		case "--piece-size":
+			if i+1 >= len(args) {
+				return "", opts, fmt.Errorf("--piece-size requires a size")
+			}
+			i++
+			size, err := parsePieceSize(args[i])
+			if err != nil {
+				return "", opts, err
+			}
+			opts.PieceSize = size
+		default:
+			if path != "" || strings.HasPrefix(args[i], "--") {
+				return "", opts, fmt.Errorf("unexpected argument %q", args[i])
+			}
+			path = args[i]
+		}
+	}
+	if path == "" {
+		return "", opts, fmt.Errorf("missing path")
+	}
+	return path, opts, nil
+}
+
+// splitShareLink splits a share link of the form "<cid>#<key>".
+func splitShareLink(s string) (cidStr, key string) {
+	cidStr, key, _ = strings.Cut(s, "#")
+	return cidStr, key
+}
+
+// encryptForSharing encrypts the file at path with a fresh key into the
+// encrypted directory and returns the path of the ciphertext.
+func (c *Client) encryptForSharing(path string) (string, []byte, error) {
+	key, err := crypt.NewKey()
+	if err != nil {
+		return "", nil, err
+	}
+	if err := os.MkdirAll(c.shares.EncryptedDir, 0o700); err != nil {
+		return "", nil, fmt.Errorf("failed to create encrypted directory: %w", err)
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer src.Close()
+	dst, err := os.CreateTemp(c.shares.EncryptedDir, "*.enc.tmp")
+	if err != nil {
+		return "", nil, err
+	}
+	if err := crypt.Encrypt(dst, src, key); err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return "", nil, fmt.Errorf("failed to encrypt file: %w", err)
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(dst.Name())
+		return "", nil, err
+	}
+	return dst.Name(), key, nil
+}
+
+// decryptDownload decrypts a verified encrypted download at src into dst and
+// removes the ciphertext.
+func decryptDownload(src, dst string, key []byte) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if err := crypt.Decrypt(out, in, key); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	if err := os.Rename(out.Name(), dst); err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	in.Close()
+	return os.Remove(src)
+}
+
+// authorize reports whether pid may fetch cidStr from us. Lookup errors deny
+// access.
+func (c *Client) authorize(ctx context.Context, cidStr string, pid peer.ID) bool {
+	ok, err := c.db.IsPeerAllowed(ctx, cidStr, pid.String())
+	if err != nil {
+		transferLog.Error("failed to check allowlist", logging.KeyCID, cidStr, logging.KeyErr, err)
+		return false
+	}
+	return ok
+}
+
+// denyAccess tells a peer that it is not allowed to fetch a piece of a CID.
+func (c *Client) denyAccess(ctrl controlMessage, p *webRTC.SimpleWebRTCPeer) {
+	pid := p.GetSignalingStream().Conn().RemotePeer()
+	transferLog.Info("denied piece request from peer not on allowlist", logging.KeyPeer, pid, logging.KeyCID, ctrl.CID, logging.KeyPiece, ctrl.Index)
+	_ = p.SendJSONReliable(controlMessage{Command: "ACCESS_DENIED", CID: ctrl.CID, Index: ctrl.Index})
+}
+
+// sharedFileCID checks that cidStr is one of our shared files.
+func (c *Client) sharedFileCID(ctx context.Context, cidStr string) error {
+	if _, err := c.db.GetLocalFileByCID(ctx, cidStr); errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("not sharing %s", cidStr)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *Client) allowPeer(cidStr, peerStr string) error {
+	ctx := context.Background()
+	pid, err := peer.Decode(peerStr)
+	if err != nil {
+		return fmt.Errorf("invalid peer ID %q", peerStr)
+	}
+	if err := c.sharedFileCID(ctx, cidStr); err != nil {
+		return err
+	}
+	if err := c.db.AllowPeer(ctx, cidStr, pid.String()); err != nil {
+		return err
+	}
+	fmt.Printf("✓ %s may now fetch %s\n", pid, cidStr)
+	return nil
+}
+
+func (c *Client) revokePeer(cidStr, peerStr string) error {
+	ctx := context.Background()
+	pid, err := peer.Decode(peerStr)
+	if err != nil {
+		return fmt.Errorf("invalid peer ID %q", peerStr)
+	}
+	if err := c.db.RevokePeer(ctx, cidStr, pid.String()); errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%s is not on the allowlist of %s", pid, cidStr)
+	} else if err != nil {
+		return err
+	}
+	fmt.Printf("✓ %s may no longer fetch %s\n", pid, cidStr)
+	if peers, err := c.db.GetAllowedPeers(ctx, cidStr); err == nil && len(peers) == 0 {
+		fmt.Println(" The allowlist is now empty: nobody can fetch the file. Use 'unrestrict' to serve it to anyone.")
+	}
+	return nil
+}
+
+// unrestrict makes a restricted share public again.
+func (c *Client) unrestrict(cidStr string) error {
+	if err := c.db.Unrestrict(context.Background(), cidStr); errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("not sharing %s", cidStr)
+	} else if err != nil {
+		return err
+	}
+	fmt.Printf("✓ %s is now served to anyone\n", cidStr)
+	return nil
+}
+
+func (c *Client) showACL(cidStr string) error {
+	ctx := context.Background()
+	file, err := c.db.GetLocalFileByCID(ctx, cidStr)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("not sharing %s", cidStr)
+	} else if err != nil {
+		return err
+	}
+	if !file.Restricted {
+		fmt.Println(" - No allowlist: the file is served to anyone.")
+		return nil
+	}
+	peers, err := c.db.GetAllowedPeers(ctx, cidStr)
+	if err != nil {
+		return err
+	}
+	if len(peers) == 0 {
+		fmt.Println(" - The allowlist is empty: nobody can fetch the file.")
+		return nil
+	}
+	fmt.Printf("\n=== Peers allowed to fetch %s ===\n", cidStr)
+	for _, p := range peers {
+		fmt.Printf(" %s\n", p)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// sharePrivate shares a copy of data from node with opts and returns the
+// stored file's CID and share key.
+func sharePrivate(tn *testNetwork, node *testNode, name string, data []byte, opts addOptions) (string, string) {
+	tn.t.Helper()
+	path := writeTestFile(tn.t, node.dir, name, data)
+	if err := node.addFile(context.Background(), path, opts); err != nil {
+		tn.t.Fatalf("addFile: %v", err)
+	}
+	files, err := node.db.GetLocalFiles(context.Background())
+	if err != nil {
+		tn.t.Fatal(err)
+	}
+	for _, f := range files {
+		if f.Filename == name {
+			return f.CID, f.ShareKey
+		}
+	}
+	tn.t.Fatalf("%s is not shared", name)
+	return "", ""
+}
+
+func TestTransferEncryptedShare(t *testing.T) {
+	tn := newTestNetwork(t, 2)
+	seeder, leecher := tn.nodes[0], tn.nodes[1]
+	leecher.seeding = seedingConfig{Enabled: true}
+
+	want := bytes.Repeat([]byte("confidential "), testFileSize/13)
+	cidStr, key := sharePrivate(tn, seeder, "build-secret.tar", want, addOptions{Encrypt: true})
+	if key == "" {
+		t.Fatal("encrypted share has no key")
+	}
+	if cidStr == rawCID(t, want) {
+		t.Fatal("encrypted share is addressed by its plaintext")
+	}
+
+	manifest, err := seeder.buildManifest(context.Background(), cidStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !manifest.Encrypted || strings.Contains(manifest.Filename, "secret") {
+		t.Fatalf("manifest leaks the share: encrypted=%v filename=%q", manifest.Encrypted, manifest.Filename)
+	}
+
+	if err := leecher.downloadFile(cidStr, downloadOptions{}); err == nil {
+		t.Fatal("download without a key succeeded")
+	}
+
+	got := tn.download(leecher, cidStr+"#"+key, downloadOptions{})
+	if !bytes.Equal(got, want) {
+		t.Fatal("decrypted content differs from the shared file")
+	}
+	d, err := leecher.db.GetDownloadByCID(context.Background(), cidStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Base(d.DownloadPath) != "build-secret.tar" || d.FileSize != int64(len(want)) {
+		t.Fatalf("download = %s (%d bytes), want build-secret.tar (%d bytes)", d.DownloadPath, d.FileSize, len(want))
+	}
+	if _, err := leecher.db.GetLocalFileByCID(context.Background(), cidStr); err == nil {
+		t.Fatal("encrypted download was re-shared")
+	}
+}
+
+func TestTransferRestrictedShare(t *testing.T) {
+	tn := newTestNetwork(t, 3)
+	seeder, partner, stranger := tn.nodes[0], tn.nodes[1], tn.nodes[2]
+	want := bytes.Repeat([]byte("partner build "), testFileSize/14)
+	cidStr, _ := sharePrivate(tn, seeder, "partner.bin", want, addOptions{Allow: []peer.ID{partner.host.ID()}})
+
+	if err := stranger.downloadFile(cidStr, downloadOptions{}); !errors.Is(err, errAccessDenied) {
+		t.Fatalf("download by a peer not on the allowlist: err = %v, want %v", err, errAccessDenied)
+	}
+
+	got := tn.download(partner, cidStr, downloadOptions{})
+	if !bytes.Equal(got, want) {
+		t.Fatal("downloaded content differs from the shared file")
+	}
+
+	if err := seeder.allowPeer(cidStr, stranger.host.ID().String()); err != nil {
+		t.Fatal(err)
+	}
+	got = tn.download(stranger, cidStr, downloadOptions{})
+	if !bytes.Equal(got, want) {
+		t.Fatal("downloaded content differs from the shared file")
+	}
+}
+
+func TestRevokeLastPeerKeepsShareRestricted(t *testing.T) {
+	tn := newTestNetwork(t, 2)
+	seeder, partner := tn.nodes[0], tn.nodes[1]
+	want := bytes.Repeat([]byte("revoked build "), testFileSize/14)
+	cidStr, _ := sharePrivate(tn, seeder, "revoked.bin", want, addOptions{Allow: []peer.ID{partner.host.ID()}})
+
+	if err := seeder.revokePeer(cidStr, partner.host.ID().String()); err != nil {
+		t.Fatal(err)
+	}
+	if err := partner.downloadFile(cidStr, downloadOptions{}); !errors.Is(err, errAccessDenied) {
+		t.Fatalf("download after the last peer was revoked: err = %v, want %v", err, errAccessDenied)
+	}
+
+	if err := seeder.unrestrict(cidStr); err != nil {
+		t.Fatal(err)
+	}
+	got := tn.download(partner, cidStr, downloadOptions{})
+	if !bytes.Equal(got, want) {
+		t.Fatal("downloaded content differs from the shared file")
+	}
+}
+
+func TestParseAddArgs(t *testing.T) {
+	pid := "12D3KooWBLZFWsGZxoCFC8NsFgKvD6WJ6xV9UmYdR8t2C1kqYTcd"
+	path, opts, err := parseAddArgs([]string{"--encrypt", "--allow", pid, "--piece-size", "4MiB", "file.bin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "file.bin" || !opts.Encrypt || len(opts.Allow) != 1 || opts.Allow[0].String() != pid || opts.PieceSize != 4<<20 {
+		t.Fatalf("parseAddArgs = %q, %+v", path, opts)
+	}
+	for _, args := range [][]string{nil, {"--allow"}, {"--allow", "nope", "f"}, {"a", "b"}, {"--bogus", "f"}, {"--piece-size", "3MiB", "f"}, {"--piece-size", "64KiB", "f"}} {
+		if _, _, err := parseAddArgs(args); err == nil {
+			t.Errorf("parseAddArgs(%q) succeeded", args)
+		}
+	}
+}
+
+func TestFailedShareLeavesNothingBehind(t *testing.T) {
+	c := newOfflineClient(t, 0)
+	c.shares = shareConfig{EncryptedDir: t.TempDir()}
+	ctx := context.Background()
+	// Storing the allowlist is the last step before the share is complete.
+	if _, err := c.db.DB.Exec(`CREATE TRIGGER fail_acl BEFORE INSERT ON share_acl BEGIN SELECT RAISE(FAIL, 'disk full'); END`); err != nil {
+		t.Fatal(err)
+	}
+	path := writeTestFile(t, t.TempDir(), "secret.bin", bytes.Repeat([]byte("secret "), 1000))
+	pid, err := peer.Decode("12D3KooWBLZFWsGZxoCFC8NsFgKvD6WJ6xV9UmYdR8t2C1kqYTcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.shareFile(ctx, path, addOptions{Encrypt: true, Allow: []peer.ID{pid}}, nil); err == nil {
+		t.Fatal("share succeeded although its allowlist could not be stored")
+	}
+
+	if left, _ := os.ReadDir(c.shares.EncryptedDir); len(left) != 0 {
+		t.Errorf("encrypted copy left behind: %v", left)
+	}
+	if files, _ := c.db.GetLocalFiles(ctx); len(files) != 0 {
+		t.Errorf("%d file(s) recorded", len(files))
+	}
+	var pieces int
+	if err := c.db.DB.QueryRow(`SELECT COUNT(*) FROM pieces`).Scan(&pieces); err != nil || pieces != 0 {
+		t.Errorf("%d piece row(s) left behind, %v", pieces, err)
+	}
+}
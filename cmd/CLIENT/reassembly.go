@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"sync"
+
+	db "torrentium/internal/db"
+)
+
+// chunkPool recycles the buffers chunks are read into and compressed into,
+// so serving a piece costs a few chunks of memory whatever the piece size.
+var chunkPool = sync.Pool{New: func() any {
+	b := make([]byte, MaxChunk)
+	return &b
+}}
+
+func getChunkBuf() *[]byte { return chunkPool.Get().(*[]byte) }
+
+func putChunkBuf(b *[]byte) { chunkPool.Put(b) }
+
+// pieceProgress tracks which chunks of a piece have been written to the
+// partial file.
+type pieceProgress struct {
+	bits      []uint64
+	have      int
+	total     int
+	verifying bool // all chunks are in and the piece is being hashed
+}
+
+func newPieceProgress(total int) *pieceProgress {
+	return &pieceProgress{bits: make([]uint64, (total+63)/64), total: total}
+}
+
+// set marks chunk i as received and reports whether it was new.
+func (p *pieceProgress) set(i int) bool {
+	word, bit := i/64, uint64(1)<<(i%64)
+	if p.bits[word]&bit != 0 {
+		return false
+	}
+	p.bits[word] |= bit
+	p.have++
+	return true
+}
+
+func (p *pieceProgress) complete() bool { return p.have == p.total }
+
+// hashPiece hashes a piece as stored in f.
+func hashPiece(f *os.File, piece db.Piece) (string, error) {
+	buf := getChunkBuf()
+	defer putChunkBuf(buf)
+	h := sha256.New()
+	if _, err := io.CopyBuffer(h, io.NewSectionReader(f, piece.Offset, piece.Size), *buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	db "torrentium/internal/db"
+)
+
+func TestPieceProgress(t *testing.T) {
+	p := newPieceProgress(70)
+	for i := 0; i < 70; i++ {
+		if !p.set(i) {
+			t.Fatalf("chunk %d reported as duplicate", i)
+		}
+		if i == 65 && p.set(65) {
+			t.Fatal("duplicate chunk reported as new")
+		}
+		if p.complete() != (i == 69) {
+			t.Fatalf("complete() = %v after %d chunks", p.complete(), i+1)
+		}
+	}
+}
+
+func TestHashPieceReadsBackFromDisk(t *testing.T) {
+	data := make([]byte, 3*MaxChunk+100)
+	rand.Read(data)
+	f, err := os.Create(filepath.Join(t.TempDir(), "partial"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// Chunks arrive out of order.
+	for _, i := range []int{3, 0, 2, 1} {
+		end := min((i+1)*MaxChunk, len(data))
+		if _, err := f.WriteAt(data[i*MaxChunk:end], int64(i*MaxChunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sum := sha256.Sum256(data[MaxChunk:])
+	got, err := hashPiece(f, db.Piece{Offset: MaxChunk, Size: int64(len(data) - MaxChunk)})
+	if err != nil || got != hex.EncodeToString(sum[:]) {
+		t.Fatalf("hashPiece = %s, %v", got, err)
+	}
+}
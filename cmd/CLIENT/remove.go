@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	db "torrentium/internal/db"
+	"torrentium/internal/logging"
+
+	"github.com/ipfs/go-cid"
+)
+
+// ReprovideInterval is how often shared files are announced again. DHT
+// provider records expire after 48 hours, so this keeps them alive with
+// room to spare.
+const ReprovideInterval = 12 * time.Hour
+
+// unshareFile stops serving a shared file and forgets its metadata and
+// pieces. Piece requests for it that wait for an upload slot are answered
+// right away. The file itself is left alone, except for the ciphertext of an
+// encrypted share, which only exists to be shared.
+func (c *Client) unshareFile(ctx context.Context, f db.LocalFile) error {
+	c.sharingMux.Lock()
+	delete(c.sharingFiles, f.CID)
+	c.sharingMux.Unlock()
+	if err := c.db.DeleteShare(ctx, f.CID); err != nil {
+		return err
+	}
+	c.unshared.fire(f.CID)
+	if f.ShareKey != "" && c.isEncryptedCopy(f.FilePath) {
+		if err := os.Remove(f.FilePath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			storageLog.Warn("failed to delete encrypted copy", "path", f.FilePath, logging.KeyErr, err)
+		}
+	}
+	return nil
+}
+
+// isEncryptedCopy reports whether path lies in the directory add --encrypt
+// writes ciphertext to.
+func (c *Client) isEncryptedCopy(path string) bool {
+	dir, err := filepath.Abs(c.shares.EncryptedDir)
+	if err != nil {
+		return false
+	}
+	abs, err := filepath.Abs(path)
+	return err == nil && strings.HasPrefix(abs, dir+string(filepath.Separator))
+}
+
+// removeFile stops sharing cidStr. Peers in the middle of downloading it are
+// told the pieces are unavailable and move on to other providers.
+func (c *Client) removeFile(cidStr string) error {
+	ctx := context.Background()
+	f, err := c.db.GetLocalFileByCID(ctx, cidStr)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%s is not being shared", cidStr)
+	} else if err != nil {
+		return err
+	}
+	if err := c.unshareFile(ctx, *f); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", cidStr, err)
+	}
+	fmt.Printf("✓ Stopped sharing '%s'\n", f.Filename)
+	fmt.Println(" Its DHT announcements expire within 48 hours.")
+	return nil
+}
+
+// removeMissing stops sharing every file that no longer exists on disk.
+func (c *Client) removeMissing() error {
+	ctx := context.Background()
+	files, err := c.db.GetLocalFiles(ctx)
+	if err != nil {
+		return err
+	}
+	removed := 0
+	for _, f := range files {
+		if _, err := os.Stat(f.FilePath); !errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err := c.unshareFile(ctx, f); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", f.CID, err)
+		}
+		fmt.Printf(" - Removed '%s' (%s)\n", f.Filename, f.CID)
+		removed++
+	}
+	if removed == 0 {
+		fmt.Println(" - All shared files are present.")
+	} else {
+		fmt.Printf("✓ Stopped sharing %d missing file(s)\n", removed)
+	}
+	return nil
+}
+
+// startReprovider announces every shared file again each ReprovideInterval
+// and republishes our names. A removed file is no longer announced and drops
+// out of the DHT once its provider records expire.
+func (c *Client) startReprovider() {
+	go func() {
+		ticker := time.NewTicker(ReprovideInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			c.reprovide(context.Background())
+			c.republishNames(context.Background())
+		}
+	}()
+}
+
+func (c *Client) reprovide(ctx context.Context) {
+	files, err := c.db.GetLocalFiles(ctx)
+	if err != nil {
+		dhtLog.Error("failed to load shared files", logging.KeyErr, err)
+		return
+	}
+	announced := 0
+	for _, f := range files {
+		// Announcing takes a while; skip files removed in the meantime.
+		if _, err := c.db.GetLocalFileByCID(ctx, f.CID); err != nil {
+			continue
+		}
+		id, err := cid.Decode(f.CID)
+		if err != nil {
+			continue
+		}
+		provideCtx, cancel := context.WithTimeout(ctx, 60*time.Second)
+		err = c.provide(provideCtx, id)
+		cancel()
+		if err != nil {
+			dhtLog.Warn("failed to re-announce file", logging.KeyCID, f.CID, logging.KeyErr, err)
+			continue
+		}
+		announced++
+	}
+	dhtLog.Info("re-announced shared files", "announced", announced, "shared", len(files))
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestRemoveDuringDownload(t *testing.T) {
+	tn := newTestNetwork(t, 3)
+	removing, staying, leecher := tn.nodes[0], tn.nodes[1], tn.nodes[2]
+	cidStr, want := tn.shareFile(removing, "a.bin", testFileSize)
+	shareExisting(tn, staying, "b.bin", want)
+
+	var once sync.Once
+	var removed atomic.Bool
+	removing.hooks.beforeSendChunk = func(_ peer.ID, _ *controlMessage) bool {
+		once.Do(func() {
+			removed.Store(true)
+			if err := removing.removeFile(cidStr); err != nil {
+				t.Error(err)
+			}
+		})
+		return true
+	}
+
+	got := tn.download(leecher, cidStr, downloadOptions{})
+	if !bytes.Equal(got, want) {
+		t.Fatal("downloaded content differs from the shared file")
+	}
+	if !removed.Load() {
+		t.Skip("the removing seeder was not used for this download")
+	}
+
+	ctx := context.Background()
+	if _, err := removing.db.GetLocalFileByCID(ctx, cidStr); err == nil {
+		t.Fatal("removed file is still shared")
+	}
+	if pieces, _ := removing.db.GetPieces(ctx, cidStr); len(pieces) != 0 {
+		t.Fatalf("%d pieces left behind", len(pieces))
+	}
+	if matches, _ := removing.db.SearchByFilename(ctx, "a.bin"); len(matches) != 0 {
+		t.Fatal("removed file is still in the search index")
+	}
+	if removing.removeFile(cidStr) == nil {
+		t.Fatal("removing a file twice succeeded")
+	}
+}
+
+func TestRemoveAnswersQueuedRequests(t *testing.T) {
+	tn := newTestNetwork(t, 3)
+	removing, staying, leecher := tn.nodes[0], tn.nodes[1], tn.nodes[2]
+	cidStr, want := tn.shareFile(removing, "a.bin", testFileSize)
+	shareExisting(tn, staying, "b.bin", want)
+
+	// Keep every upload slot for the leecher busy, so that its requests to
+	// the removing seeder wait in the queue until the file is removed.
+	pl := removing.limiters.get(leecher.host.ID())
+	for i := 0; i < MaxUploadsPerPeer; i++ {
+		pl.uploads <- struct{}{}
+	}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- leecher.downloadFile(cidStr, downloadOptions{}) }()
+	waitFor(t, testTransferTimeout, "piece requests to queue up", func() bool { return pl.queued.Load() > 0 })
+	if err := removing.removeFile(cidStr); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, "queued requests to be answered", func() bool { return pl.queued.Load() == 0 })
+
+	// The pieces are fetched from the other seeder long before they would
+	// time out on the removing one.
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("download failed: %v", err)
+		}
+	case <-time.After(testTransferTimeout):
+		t.Fatal("download did not finish after the file was removed")
+	}
+	d, err := leecher.db.GetDownloadByCID(context.Background(), cidStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(d.DownloadPath); err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("downloaded content differs from the shared file: %v", err)
+	}
+}
+
+func TestRemoveMissing(t *testing.T) {
+	tn := newTestNetwork(t, 1)
+	node := tn.nodes[0]
+	gone, _ := shareExisting(tn, node, "gone.bin", []byte("deleted from disk"))
+	kept, _ := shareExisting(tn, node, "kept.bin", []byte("still here"))
+	lf, err := node.db.GetLocalFileByCID(context.Background(), gone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(lf.FilePath); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := node.removeMissing(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := node.db.GetLocalFileByCID(context.Background(), gone); err == nil {
+		t.Fatal("missing file is still shared")
+	}
+	if _, err := node.db.GetLocalFileByCID(context.Background(), kept); err != nil {
+		t.Fatalf("present file was removed: %v", err)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	webRTC "torrentium/internal/client"
+	"torrentium/internal/logging"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Error codes carried by ERROR responses.
+const (
+	ErrCodeNotFound     = "NOT_FOUND"
+	ErrCodeBusy         = "BUSY"
+	ErrCodeAccessDenied = "ACCESS_DENIED"
+	ErrCodeInternal     = "INTERNAL"
+)
+
+const ManifestTimeout = 30 * time.Second
+
+var (
+	errNotFound = errors.New("not found")
+	errBusy     = errors.New("peer is busy")
+)
+
+// remoteError is an ERROR response from a peer. It matches errNotFound,
+// errBusy and errAccessDenied with errors.Is.
+type remoteError struct {
+	Code string
+}
+
+func (e *remoteError) Error() string { return "peer replied " + e.Code }
+
+func (e *remoteError) Is(target error) bool {
+	switch target {
+	case errNotFound:
+		return e.Code == ErrCodeNotFound
+	case errBusy:
+		return e.Code == ErrCodeBusy
+	case errAccessDenied:
+		return e.Code == ErrCodeAccessDenied
+	}
+	return false
+}
+
+// pendingRequests matches responses to the requests we sent. Requests are
+// numbered per client and looked up per peer, so a response is only
+// accepted from the peer the request went to.
+type pendingRequests struct {
+	mu   sync.Mutex
+	next uint64
+	m    map[peer.ID]map[uint64]pendingRequest
+}
+
+type pendingRequest struct {
+	cid string
+	ch  chan controlMessage
+}
+
+func (r *pendingRequests) add(pid peer.ID, cidStr string) (uint64, chan controlMessage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.m == nil {
+		r.m = make(map[peer.ID]map[uint64]pendingRequest)
+	}
+	if r.m[pid] == nil {
+		r.m[pid] = make(map[uint64]pendingRequest)
+	}
+	r.next++
+	ch := make(chan controlMessage, 1)
+	r.m[pid][r.next] = pendingRequest{cid: cidStr, ch: ch}
+	return r.next, ch
+}
+
+func (r *pendingRequests) remove(pid peer.ID, id uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.m[pid], id)
+	if len(r.m[pid]) == 0 {
+		delete(r.m, pid)
+	}
+}
+
+// deliver hands a response to the waiting request. It reports false if no
+// request from pid with that ID is pending. Peers that predate request IDs
+// reply without one; their response goes to the oldest request for its CID.
+func (r *pendingRequests) deliver(pid peer.ID, resp controlMessage) bool {
+	r.mu.Lock()
+	req, ok := r.m[pid][resp.RequestID]
+	if !ok && resp.RequestID == 0 && resp.CID != "" {
+		var oldest uint64
+		for id, pr := range r.m[pid] {
+			if pr.cid == resp.CID && (oldest == 0 || id < oldest) {
+				oldest, req, ok = id, pr, true
+			}
+		}
+	}
+	r.mu.Unlock()
+	if ok {
+		select {
+		case req.ch <- resp:
+		default: // duplicate response
+		}
+	}
+	return ok
+}
+
+// request sends req over the reliable channel and waits for the matching
+// response. ERROR responses are returned as *remoteError.
+func (c *Client) request(p *webRTC.SimpleWebRTCPeer, req controlMessage, timeout time.Duration) (controlMessage, error) {
+	pid := p.GetSignalingStream().Conn().RemotePeer()
+	id, ch := c.pending.add(pid, req.CID)
+	defer c.pending.remove(pid, id)
+
+	req.RequestID = id
+	if err := p.SendJSONReliable(req); err != nil {
+		return controlMessage{}, err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case resp := <-ch:
+		if resp.Command == "ERROR" {
+			return controlMessage{}, &remoteError{Code: resp.Error}
+		}
+		return resp, nil
+	case <-timer.C:
+		return controlMessage{}, fmt.Errorf("%s to %s timed out after %v", req.Command, pid, timeout)
+	case <-p.WaitForCloseChannel():
+		return controlMessage{}, fmt.Errorf("connection to %s closed", pid)
+	}
+}
+
+// handleResponse routes a MANIFEST, PIECE_HASHES or ERROR message to its
+// request.
+func (c *Client) handleResponse(ctrl controlMessage, p *webRTC.SimpleWebRTCPeer) {
+	pid := p.GetSignalingStream().Conn().RemotePeer()
+	if ctrl.Command == "ERROR" && ctrl.Error == ErrCodeIncompatible {
+		transferLog.Warn("peer refused our protocol version", logging.KeyPeer, pid, "version", ProtocolVersion)
+		return
+	}
+	if !c.pending.deliver(pid, ctrl) {
+		transferLog.Debug("ignoring response to unknown request", logging.KeyPeer, pid, "command", ctrl.Command, "request_id", ctrl.RequestID)
+	}
+}
+
+// replyError answers a request with an ERROR response.
+func replyError(p *webRTC.SimpleWebRTCPeer, req controlMessage, code string) {
+	resp := controlMessage{Command: "ERROR", CID: req.CID, RequestID: req.RequestID, Error: code}
+	if err := p.SendJSONReliable(resp); err != nil {
+		transferLog.Debug("failed to send error response", logging.KeyCID, req.CID, "code", code, logging.KeyErr, err)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	webRTC "torrentium/internal/client"
+
+	"github.com/libp2p/go-libp2p/core/test"
+)
+
+func TestPendingRequestsMatchPeer(t *testing.T) {
+	var pr pendingRequests
+	a, b := test.RandPeerIDFatal(t), test.RandPeerIDFatal(t)
+	id, ch := pr.add(a, "cid")
+	if pr.deliver(b, controlMessage{Command: "MANIFEST", RequestID: id}) {
+		t.Fatal("response from another peer was accepted")
+	}
+	if !pr.deliver(a, controlMessage{Command: "MANIFEST", RequestID: id}) {
+		t.Fatal("response was not delivered")
+	}
+	if resp := <-ch; resp.RequestID != id {
+		t.Fatalf("delivered request %d, want %d", resp.RequestID, id)
+	}
+	pr.remove(a, id)
+	if pr.deliver(a, controlMessage{Command: "MANIFEST", RequestID: id}) {
+		t.Fatal("response to a finished request was accepted")
+	}
+}
+
+func TestConcurrentManifestRequests(t *testing.T) {
+	tn := newTestNetwork(t, 3)
+	leecher := tn.nodes[2]
+	cidStr, data := tn.shareFile(tn.nodes[0], "a.bin", testFileSize)
+	shareExisting(tn, tn.nodes[1], "b.bin", data)
+
+	var conns []*webRTC.SimpleWebRTCPeer
+	for _, seeder := range tn.nodes[:2] {
+		conn, err := leecher.initiateWebRTCConnectionWithRetry(seeder.host.ID(), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+
+	// Several requests for the same CID in flight on each connection at once.
+	var wg sync.WaitGroup
+	errs := make(chan error, 4*len(conns))
+	for _, conn := range conns {
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(conn *webRTC.SimpleWebRTCPeer) {
+				defer wg.Done()
+				m, err := leecher.requestManifest(conn, cidStr)
+				if err == nil && m.TotalSize != int64(len(data)) {
+					err = errors.New("manifest has the wrong size")
+				}
+				errs <- err
+			}(conn)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := time.Now()
+	_, err := leecher.requestManifest(conns[0], rawCID(t, []byte("nobody has this")))
+	if !errors.Is(err, errNotFound) {
+		t.Fatalf("manifest for unknown CID: err = %v, want %v", err, errNotFound)
+	}
+	if time.Since(start) > ManifestTimeout/2 {
+		t.Fatal("NOT_FOUND was not sent right away")
+	}
+}
+
+func TestManifestRequestFloodGetsBusy(t *testing.T) {
+	tn := newTestNetwork(t, 2)
+	seeder, leecher := tn.nodes[0], tn.nodes[1]
+	cidStr, _ := tn.shareFile(seeder, "popular.bin", 1024)
+	conn, err := leecher.initiateWebRTCConnectionWithRetry(seeder.host.ID(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	busy := 0
+	for i := 0; i < 3*ManifestRequestBurst; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := leecher.requestManifest(conn, cidStr); errors.Is(err, errBusy) {
+				mu.Lock()
+				busy++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if busy == 0 {
+		t.Fatal("no request was answered with BUSY")
+	}
+}
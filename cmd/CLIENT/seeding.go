@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	db "torrentium/internal/db"
+	"torrentium/internal/logging"
+
+	"github.com/dustin/go-humanize"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+const SeedCheckInterval = 1 * time.Minute
+
+// seedingConfig controls whether completed downloads are shared back to the
+// swarm and for how long. Zero limits mean seeding never stops on its own.
+type seedingConfig struct {
+	Enabled  bool
+	MaxRatio float64
+	MaxTime  time.Duration
+}
+
+// loadSeedingConfig reads TORRENTIUM_AUTO_SEED (default true),
+// TORRENTIUM_SEED_RATIO (e.g. "2.0") and TORRENTIUM_SEED_TIME (e.g. "24h").
+func loadSeedingConfig() seedingConfig {
+	cfg := seedingConfig{Enabled: true}
+	if v := os.Getenv("TORRENTIUM_AUTO_SEED"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			logger.Warn("invalid TORRENTIUM_AUTO_SEED", "value", v, logging.KeyErr, err)
+		} else {
+			cfg.Enabled = enabled
+		}
+	}
+	if v := os.Getenv("TORRENTIUM_SEED_RATIO"); v != "" {
+		ratio, err := strconv.ParseFloat(v, 64)
+		if err != nil || ratio < 0 {
+			logger.Warn("invalid TORRENTIUM_SEED_RATIO", "value", v)
+		} else {
+			cfg.MaxRatio = ratio
+		}
+	}
+	if v := os.Getenv("TORRENTIUM_SEED_TIME"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			logger.Warn("invalid TORRENTIUM_SEED_TIME", "value", v)
+		} else {
+			cfg.MaxTime = d
+		}
+	}
+	return cfg
+}
+
+// verifyDownloadedFile checks the complete file against the hash from the
+// manifest and against the digest embedded in the CID itself.
+func verifyDownloadedFile(path string, fileCID cid.Cid, hashHex string) error {
+	decoded, err := multihash.Decode(fileCID.Hash())
+	if err != nil {
+		return fmt.Errorf("failed to decode CID multihash: %w", err)
+	}
+	if !strings.EqualFold(hex.EncodeToString(decoded.Digest), hashHex) {
+		return fmt.Errorf("manifest hash %s does not match CID %s", hashHex, fileCID)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("failed to hash downloaded file: %w", err)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(got, hashHex) {
+		return fmt.Errorf("downloaded file hash %s does not match expected %s", got, hashHex)
+	}
+	return nil
+}
+
+// seedDownload registers a verified download as a local file and announces it
+// on the DHT so that other peers can fetch it from us.
+func (c *Client) seedDownload(ctx context.Context, fileCID cid.Cid, path string, manifest controlMessage, opts downloadOptions) error {
+	cidStr := fileCID.String()
+	if err := c.db.AddLocalFile(ctx, cidStr, manifest.Filename, manifest.TotalSize, path, manifest.HashHex, manifestPieceSize(manifest)); err != nil {
+		return fmt.Errorf("failed to store file metadata: %w", err)
+	}
+	maxRatio, maxTime := c.seedLimits(opts)
+	if err := c.db.AddSeed(ctx, cidStr, maxRatio, int64(maxTime/time.Second)); err != nil {
+		return fmt.Errorf("failed to record seed: %w", err)
+	}
+
+	c.sharingMux.Lock()
+	c.sharingFiles[cidStr] = &FileInfo{
+		FilePath: path,
+		Hash:     manifest.HashHex,
+		Size:     manifest.TotalSize,
+		Name:     manifest.Filename,
+		PieceSz:  manifestPieceSize(manifest),
+	}
+	c.sharingMux.Unlock()
+
+	provideCtx, cancel := context.WithTimeout(ctx, 60*time.Second)
+	defer cancel()
+	if err := c.provide(provideCtx, fileCID); err != nil {
+		dhtLog.Warn("failed to announce downloaded file", logging.KeyCID, cidStr, logging.KeyErr, err)
+	} else {
+		storageLog.Info("seeding download", "name", manifest.Filename, logging.KeyCID, cidStr)
+	}
+	return nil
+}
+
+// seedLimits returns the ratio and time limits for seeding a download:
+// --seed-ratio and --seed-time override the configured defaults.
+func (c *Client) seedLimits(opts downloadOptions) (float64, time.Duration) {
+	maxRatio, maxTime := c.seeding.MaxRatio, c.seeding.MaxTime
+	if opts.SeedRatio > 0 {
+		maxRatio = opts.SeedRatio
+	}
+	if opts.SeedTime > 0 {
+		maxTime = opts.SeedTime
+	}
+	return maxRatio, maxTime
+}
+
+// stopSeeding stops serving a seeded download. The file and its download
+// record stay on disk so it remains subject to the storage quota.
+func (c *Client) stopSeeding(ctx context.Context, cidStr string) error {
+	if err := c.db.DeleteLocalFile(ctx, cidStr); err != nil {
+		return err
+	}
+	c.sharingMux.Lock()
+	delete(c.sharingFiles, cidStr)
+	c.sharingMux.Unlock()
+	return c.db.DeleteSeed(ctx, cidStr)
+}
+
+// seedLimitReached reports whether a seed has hit its ratio or time limit.
+func seedLimitReached(s seedRow, now time.Time) bool {
+	if s.MaxRatio > 0 && s.FileSize > 0 && float64(s.UploadedBytes) >= s.MaxRatio*float64(s.FileSize) {
+		return true
+	}
+	if s.MaxSeconds > 0 && now.Sub(s.StartedAt) >= time.Duration(s.MaxSeconds)*time.Second {
+		return true
+	}
+	return false
+}
+
+// seedRow is a seed joined with the metadata of the file being seeded.
+type seedRow struct {
+	db.Seed
+	Name     string
+	FileSize int64
+}
+
+func (c *Client) seedRows(ctx context.Context) ([]seedRow, error) {
+	seeds, err := c.db.GetSeeds(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]seedRow, 0, len(seeds))
+	for _, s := range seeds {
+		row := seedRow{Seed: s, Name: s.CID}
+		if lf, err := c.db.GetLocalFileByCID(ctx, s.CID); err == nil {
+			row.Name = lf.Filename
+			row.FileSize = lf.FileSize
+		}
+		out = append(out, row)
+	}
+	return out, nil
+}
+
+func (c *Client) enforceSeedLimits(ctx context.Context) {
+	rows, err := c.seedRows(ctx)
+	if err != nil {
+		storageLog.Error("failed to load seeds", logging.KeyErr, err)
+		return
+	}
+	now := time.Now()
+	for _, s := range rows {
+		if !seedLimitReached(s, now) {
+			continue
+		}
+		if err := c.stopSeeding(ctx, s.CID); err != nil {
+			storageLog.Error("failed to stop seeding", logging.KeyCID, s.CID, logging.KeyErr, err)
+			continue
+		}
+		storageLog.Info("stopped seeding: limit reached", "name", s.Name, logging.KeyCID, s.CID, "uploaded", humanize.Bytes(uint64(s.UploadedBytes)))
+	}
+}
+
+func (c *Client) startSeedLimitEnforcer() {
+	go func() {
+		ticker := time.NewTicker(SeedCheckInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			c.enforceSeedLimits(context.Background())
+		}
+	}()
+}
+
+func (c *Client) listSeeds() error {
+	rows, err := c.seedRows(context.Background())
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		fmt.Println(" - No downloads are being seeded.")
+		return nil
+	}
+	fmt.Println("\n=== Seeding ===")
+	for _, s := range rows {
+		fmt.Printf("Name: %s\n", s.Name)
+		fmt.Printf(" CID: %s\n", s.CID)
+		fmt.Printf(" Uploaded: %s", humanize.Bytes(uint64(s.UploadedBytes)))
+		if s.FileSize > 0 {
+			fmt.Printf(" (ratio %.2f)", float64(s.UploadedBytes)/float64(s.FileSize))
+		}
+		fmt.Println()
+		fmt.Printf(" Seeding since: %s\n", humanize.Time(s.StartedAt))
+		if s.MaxRatio > 0 {
+			fmt.Printf(" Ratio limit: %.2f\n", s.MaxRatio)
+		}
+		if s.MaxSeconds > 0 {
+			fmt.Printf(" Time limit: %s\n", time.Duration(s.MaxSeconds)*time.Second)
+		}
+		fmt.Println(" ---")
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// addTestSeed records cidStr as a seeded download of size bytes with the
+// limits that opts give it.
+func addTestSeed(t *testing.T, c *Client, cidStr string, size int64, opts downloadOptions) {
+	t.Helper()
+	ctx := context.Background()
+	path := writeTestFile(t, t.TempDir(), cidStr, make([]byte, size))
+	if err := c.db.AddLocalFile(ctx, cidStr, cidStr, size, path, "", DefaultPieceSize); err != nil {
+		t.Fatal(err)
+	}
+	maxRatio, maxTime := c.seedLimits(opts)
+	if err := c.db.AddSeed(ctx, cidStr, maxRatio, int64(maxTime/time.Second)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSeedLimits(t *testing.T) {
+	c := &Client{seeding: seedingConfig{Enabled: true, MaxRatio: 2, MaxTime: 24 * time.Hour}}
+	for _, tc := range []struct {
+		opts      downloadOptions
+		wantRatio float64
+		wantTime  time.Duration
+	}{
+		{downloadOptions{}, 2, 24 * time.Hour},
+		{downloadOptions{SeedRatio: 0.5}, 0.5, 24 * time.Hour},
+		{downloadOptions{SeedTime: time.Hour}, 2, time.Hour},
+		{downloadOptions{SeedRatio: 5, SeedTime: 30 * time.Minute}, 5, 30 * time.Minute},
+	} {
+		ratio, d := c.seedLimits(tc.opts)
+		if ratio != tc.wantRatio || d != tc.wantTime {
+			t.Errorf("seedLimits(ratio %v, time %v) = %v, %v; want %v, %v", tc.opts.SeedRatio, tc.opts.SeedTime, ratio, d, tc.wantRatio, tc.wantTime)
+		}
+	}
+}
+
+func TestEnforceSeedLimits(t *testing.T) {
+	c := newOfflineClient(t, 0)
+	c.seeding = seedingConfig{Enabled: true, MaxRatio: 2}
+	ctx := context.Background()
+	addTestSeed(t, c, "ratio", 100, downloadOptions{SeedRatio: 1.5})
+	addTestSeed(t, c, "expired", 100, downloadOptions{SeedTime: time.Hour})
+	addTestSeed(t, c, "default", 100, downloadOptions{})
+	if _, err := c.db.DB.Exec(`UPDATE seeds SET started_at=? WHERE cid=?`, time.Now().Add(-2*time.Hour), "expired"); err != nil {
+		t.Fatal(err)
+	}
+
+	shared := func(cidStr string) bool {
+		_, err := c.db.GetLocalFileByCID(ctx, cidStr)
+		return err == nil
+	}
+	seeded := func(cidStr string) bool {
+		seeds, err := c.db.GetSeeds(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range seeds {
+			if s.CID == cidStr {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, cidStr := range []string{"ratio", "default"} {
+		if err := c.db.AddSeedUpload(ctx, cidStr, 149); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.enforceSeedLimits(ctx)
+	if shared("expired") || seeded("expired") {
+		t.Error("seed past its time limit is still shared")
+	}
+	for _, cidStr := range []string{"ratio", "default"} {
+		if !shared(cidStr) || !seeded(cidStr) {
+			t.Errorf("%s stopped seeding below its ratio limit", cidStr)
+		}
+	}
+
+	// --seed-ratio 1.5 is reached at 150 bytes; the configured ratio of 2
+	// still applies to the other seed.
+	for _, cidStr := range []string{"ratio", "default"} {
+		if err := c.db.AddSeedUpload(ctx, cidStr, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.enforceSeedLimits(ctx)
+	if shared("ratio") || seeded("ratio") {
+		t.Error("seed past its ratio limit is still shared")
+	}
+	if !shared("default") || !seeded("default") {
+		t.Error("seed below the configured ratio limit stopped seeding")
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"torrentium/internal/logging"
+	"torrentium/internal/shareuri"
+
+	"github.com/dustin/go-humanize"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// HintDialTimeout bounds how long a download waits for the peers listed in
+// a share URI before it falls back to the DHT.
+const HintDialTimeout = 10 * time.Second
+
+// shareURI returns the torrentium: URI of a file we share, with our own
+// addresses as the provider hints.
+func (c *Client) shareURI(ctx context.Context, cidStr string) (shareuri.URI, error) {
+	lf, err := c.db.GetLocalFileByCID(ctx, cidStr)
+	if errors.Is(err, sql.ErrNoRows) {
+		return shareuri.URI{}, fmt.Errorf("%s is not being shared", cidStr)
+	} else if err != nil {
+		return shareuri.URI{}, err
+	}
+	u := shareuri.URI{CID: lf.CID, Name: lf.Filename, Size: lf.FileSize, Key: lf.ShareKey, Peers: c.providerHints()}
+	if pieces, err := c.db.GetPieces(ctx, cidStr); err == nil && len(pieces) > 0 {
+		if u.PiecesRoot, err = piecesRoot(pieces); err != nil {
+			return shareuri.URI{}, err
+		}
+	}
+	return u, nil
+}
+
+// providerHints lists the addresses others can dial us on, best first:
+// public addresses, then relay circuits, then private and loopback ones.
+func (c *Client) providerHints() []multiaddr.Multiaddr {
+	rank := func(a multiaddr.Multiaddr) int {
+		switch {
+		case manet.IsPublicAddr(a):
+			return 0
+		case isRelayAddr(a):
+			return 1
+		case manet.IsIPLoopback(a):
+			return 3
+		}
+		return 2
+	}
+	addrs := slices.Clone(c.host.Addrs())
+	slices.SortStableFunc(addrs, func(a, b multiaddr.Multiaddr) int { return rank(a) - rank(b) })
+	var hints []multiaddr.Multiaddr
+	for _, a := range addrs {
+		if manet.IsIPUnspecified(a) {
+			continue
+		}
+		hint, err := multiaddr.NewMultiaddr(a.String() + "/p2p/" + c.host.ID().String())
+		if err != nil {
+			continue
+		}
+		hints = append(hints, hint)
+		if len(hints) == shareuri.MaxPeers {
+			break
+		}
+	}
+	return hints
+}
+
+func isRelayAddr(a multiaddr.Multiaddr) bool {
+	_, err := a.ValueForProtocol(multiaddr.P_CIRCUIT)
+	return err == nil
+}
+
+func (c *Client) printShareURI(cidStr string) error {
+	u, err := c.shareURI(context.Background(), cidStr)
+	if err != nil {
+		return err
+	}
+	fmt.Println(u)
+	return nil
+}
+
+// dialHints connects to the providers listed in a share URI and returns
+// those that answered.
+func (c *Client) dialHints(ctx context.Context, hints []peer.AddrInfo) []peer.AddrInfo {
+	ctx, cancel := context.WithTimeout(ctx, HintDialTimeout)
+	defer cancel()
+	var (
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+		connected []peer.AddrInfo
+	)
+	for _, info := range hints {
+		if info.ID == c.host.ID() || !c.peerAllowed(info.ID) {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.host.Connect(ctx, info); err != nil {
+				transferLog.Debug("hinted provider unreachable", logging.KeyPeer, info.ID, logging.KeyErr, err)
+				return
+			}
+			mu.Lock()
+			connected = append(connected, info)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return connected
+}
+
+// checkManifestHints rejects a manifest that does not match the size or
+// pieces root given in a share URI.
+func checkManifestHints(m controlMessage, opts downloadOptions) error {
+	if opts.Size > 0 && m.TotalSize != opts.Size {
+		return fmt.Errorf("manifest size %d does not match the share URI's %d", m.TotalSize, opts.Size)
+	}
+	if opts.PiecesRoot != "" {
+		root, err := piecesRoot(m.Pieces)
+		if err != nil {
+			return err
+		}
+		if root != opts.PiecesRoot {
+			return fmt.Errorf("manifest pieces do not match the share URI")
+		}
+	}
+	return nil
+}
+
+// applyShareURI turns a share URI into the share link to download and the
+// hints that go with it.
+func applyShareURI(s string, opts *downloadOptions) (string, error) {
+	u, err := shareuri.Parse(s)
+	if err != nil {
+		return "", err
+	}
+	opts.Hints = u.Providers()
+	opts.Size = u.Size
+	opts.PiecesRoot = u.PiecesRoot
+	if u.Name != "" {
+		fmt.Printf("Share URI for '%s'", u.Name)
+		if u.Size > 0 {
+			fmt.Printf(" (%s)", humanize.Bytes(uint64(u.Size)))
+		}
+		fmt.Printf(", %d hinted provider(s)\n", len(opts.Hints))
+	}
+	if u.Key != "" {
+		return u.CID + "#" + u.Key, nil
+	}
+	return u.CID, nil
+}
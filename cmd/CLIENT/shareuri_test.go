@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"torrentium/internal/shareuri"
+)
+
+func TestDownloadFromShareURI(t *testing.T) {
+	tn := newTestNetwork(t, 2)
+	seeder, leecher := tn.nodes[0], tn.nodes[1]
+	cidStr, want := tn.shareFile(seeder, "hinted.bin", testFileSize)
+
+	u, err := seeder.shareURI(context.Background(), cidStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Name != "hinted.bin" || u.Size != testFileSize || u.PiecesRoot == "" || len(u.Peers) == 0 {
+		t.Fatalf("share URI = %+v", u)
+	}
+
+	var opts downloadOptions
+	target, err := leecher.resolveTarget(u.String(), &opts)
+	if err != nil || target != cidStr {
+		t.Fatalf("resolveTarget = %s, %v", target, err)
+	}
+	if len(opts.Hints) != 1 || opts.Hints[0].ID != seeder.host.ID() {
+		t.Fatalf("hints = %v", opts.Hints)
+	}
+	if got := tn.download(leecher, target, opts); !bytes.Equal(got, want) {
+		t.Fatal("downloaded content differs from the shared file")
+	}
+
+	// A manifest that does not match the URI is not used.
+	u.PiecesRoot = strings.Repeat("00", 32)
+	opts = downloadOptions{Out: leecher.dir + "/again.bin"}
+	if _, err := leecher.resolveTarget(u.String(), &opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := leecher.downloadFile(cidStr, opts); err == nil {
+		t.Fatal("downloaded a file whose manifest does not match the share URI")
+	}
+}
+
+func TestShareURIOfEncryptedShareCarriesKey(t *testing.T) {
+	tn := newTestNetwork(t, 1)
+	node := tn.nodes[0]
+	path := writeTestFile(t, node.dir, "secret.txt", []byte("top secret"))
+	if err := node.addFile(context.Background(), path, addOptions{Encrypt: true}); err != nil {
+		t.Fatal(err)
+	}
+	files, err := node.db.GetLocalFiles(context.Background())
+	if err != nil || len(files) != 1 {
+		t.Fatalf("shared files = %v, %v", files, err)
+	}
+	u, err := node.shareURI(context.Background(), files[0].CID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := shareuri.Parse(u.String())
+	if err != nil || parsed.Key == "" || parsed.Key != files[0].ShareKey {
+		t.Fatalf("parsed URI = %+v, %v", parsed, err)
+	}
+	var opts downloadOptions
+	if target, _ := node.resolveTarget(u.String(), &opts); target != files[0].CID+"#"+files[0].ShareKey {
+		t.Fatalf("target = %s", target)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	db "torrentium/internal/db"
+	"torrentium/internal/logging"
+
+	"github.com/dustin/go-humanize"
+)
+
+const DefaultGCInterval = 1 * time.Hour
+
+// AbandonedDownloadGrace is how old an in-progress download record with no
+// running download must be before it is treated as abandoned. It covers the
+// moment between recording a download and registering it as active.
+const AbandonedDownloadGrace = time.Minute
+
+// storageConfig holds the disk budget for downloaded content. A zero Quota
+// means downloads are never evicted automatically.
+type storageConfig struct {
+	Quota      int64
+	GCInterval time.Duration
+}
+
+// loadStorageConfig reads TORRENTIUM_STORAGE_QUOTA (e.g. "20GB") and
+// TORRENTIUM_GC_INTERVAL (e.g. "30m") from the environment.
+func loadStorageConfig() storageConfig {
+	cfg := storageConfig{GCInterval: DefaultGCInterval}
+	if v := os.Getenv("TORRENTIUM_STORAGE_QUOTA"); v != "" {
+		q, err := humanize.ParseBytes(v)
+		if err != nil {
+			logger.Warn("invalid TORRENTIUM_STORAGE_QUOTA", "value", v, logging.KeyErr, err)
+		} else {
+			cfg.Quota = int64(q)
+		}
+	}
+	if v := os.Getenv("TORRENTIUM_GC_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			logger.Warn("invalid TORRENTIUM_GC_INTERVAL", "value", v)
+		} else {
+			cfg.GCInterval = d
+		}
+	}
+	return cfg
+}
+
+type gcReport struct {
+	Evicted      []db.Download
+	Abandoned    []db.Download
+	FreedBytes   int64
+	PrunedPieces int64
+}
+
+// evictionCandidates returns the unpinned, completed downloads that have to be
+// removed (least recently used first) so that need more bytes fit in quota.
+// downloads must already be ordered by last access, oldest first.
+func evictionCandidates(downloads []db.Download, quota, need int64) []db.Download {
+	if quota <= 0 {
+		return nil
+	}
+	var used int64
+	for _, d := range downloads {
+		used += d.FileSize
+	}
+	var out []db.Download
+	for _, d := range downloads {
+		if used+need <= quota {
+			break
+		}
+		if d.Pinned || d.Status != db.DownloadStatusCompleted {
+			continue
+		}
+		out = append(out, d)
+		used -= d.FileSize
+	}
+	return out
+}
+
+// abandonedDownloads returns the in-progress downloads that no running
+// download owns any more, e.g. because it failed or the client exited.
+func (c *Client) abandonedDownloads(downloads []db.Download) []db.Download {
+	c.downloadsMux.RLock()
+	defer c.downloadsMux.RUnlock()
+	cutoff := time.Now().Add(-AbandonedDownloadGrace)
+	var out []db.Download
+	for _, d := range downloads {
+		if d.Status != db.DownloadStatusDownloading || d.LastAccessed.After(cutoff) {
+			continue
+		}
+		if _, ok := c.activeDownloads[d.CID]; !ok {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// pruneAbandoned deletes abandoned downloads and their partial files, which
+// would otherwise count against the quota forever. It returns the downloads
+// that are left.
+func (c *Client) pruneAbandoned(ctx context.Context, downloads []db.Download) (left, pruned []db.Download, err error) {
+	abandoned := c.abandonedDownloads(downloads)
+	if len(abandoned) == 0 {
+		return downloads, nil, nil
+	}
+	for _, d := range abandoned {
+		storageLog.Info("removing abandoned download", "name", d.Filename, logging.KeyCID, d.CID)
+		if err := c.deleteDownload(ctx, d); err != nil {
+			return nil, pruned, err
+		}
+		pruned = append(pruned, d)
+	}
+	left = slices.DeleteFunc(slices.Clone(downloads), func(d db.Download) bool {
+		return slices.ContainsFunc(pruned, func(p db.Download) bool { return p.CID == d.CID })
+	})
+	return left, pruned, nil
+}
+
+// ensureSpace evicts unpinned downloads until need more bytes fit in the quota.
+func (c *Client) ensureSpace(ctx context.Context, need int64) error {
+	if c.storage.Quota <= 0 {
+		return nil
+	}
+	if need > c.storage.Quota {
+		return fmt.Errorf("file size %s exceeds storage quota %s",
+			humanize.Bytes(uint64(need)), humanize.Bytes(uint64(c.storage.Quota)))
+	}
+	downloads, err := c.db.GetDownloads(ctx)
+	if err != nil {
+		return err
+	}
+	if downloads, _, err = c.pruneAbandoned(ctx, downloads); err != nil {
+		return err
+	}
+	for _, d := range evictionCandidates(downloads, c.storage.Quota, need) {
+		if err := c.evictDownload(ctx, d); err != nil {
+			return err
+		}
+	}
+	used, err := c.db.DownloadsSize(ctx)
+	if err != nil {
+		return err
+	}
+	if used+need > c.storage.Quota {
+		return fmt.Errorf("not enough storage: %s used of %s quota, %s needed (pinned content cannot be evicted)",
+			humanize.Bytes(uint64(used)), humanize.Bytes(uint64(c.storage.Quota)), humanize.Bytes(uint64(need)))
+	}
+	return nil
+}
+
+// evictDownload deletes a completed download from disk together with its
+// metadata and pieces. If the file is also being shared from the same path it
+// stops being shared.
+func (c *Client) evictDownload(ctx context.Context, d db.Download) error {
+	storageLog.Info("evicting download", "name", d.Filename, logging.KeyCID, d.CID, "size", humanize.Bytes(uint64(d.FileSize)))
+	return c.deleteDownload(ctx, d)
+}
+
+func (c *Client) deleteDownload(ctx context.Context, d db.Download) error {
+	if err := os.Remove(d.DownloadPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove %s: %w", d.DownloadPath, err)
+	}
+	if lf, err := c.db.GetLocalFileByCID(ctx, d.CID); err == nil && lf.FilePath == d.DownloadPath {
+		if err := c.stopSeeding(ctx, d.CID); err != nil {
+			return err
+		}
+	}
+	if err := c.db.DeleteDownload(ctx, d.CID); err != nil {
+		return err
+	}
+	if _, err := c.db.GetLocalFileByCID(ctx, d.CID); errors.Is(err, sql.ErrNoRows) {
+		return c.db.DeletePieces(ctx, d.CID)
+	}
+	return nil
+}
+
+// collectGarbage removes abandoned downloads, enforces the storage quota and
+// prunes piece rows that no longer belong to a shared file or a download.
+func (c *Client) collectGarbage(ctx context.Context) (gcReport, error) {
+	var report gcReport
+	downloads, err := c.db.GetDownloads(ctx)
+	if err != nil {
+		return report, err
+	}
+	if downloads, report.Abandoned, err = c.pruneAbandoned(ctx, downloads); err != nil {
+		return report, err
+	}
+	if c.storage.Quota > 0 {
+		for _, d := range evictionCandidates(downloads, c.storage.Quota, 0) {
+			if err := c.evictDownload(ctx, d); err != nil {
+				return report, err
+			}
+			report.Evicted = append(report.Evicted, d)
+			report.FreedBytes += d.FileSize
+		}
+	}
+	n, err := c.db.PruneOrphanPieces(ctx)
+	if err != nil {
+		return report, fmt.Errorf("failed to prune orphaned pieces: %w", err)
+	}
+	report.PrunedPieces = n
+	return report, nil
+}
+
+func (c *Client) startGarbageCollector() {
+	go func() {
+		ticker := time.NewTicker(c.storage.GCInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			report, err := c.collectGarbage(context.Background())
+			if err != nil {
+				storageLog.Error("garbage collection failed", logging.KeyErr, err)
+				continue
+			}
+			if len(report.Evicted) > 0 || len(report.Abandoned) > 0 || report.PrunedPieces > 0 {
+				storageLog.Info("garbage collection finished", "evicted", len(report.Evicted), "abandoned", len(report.Abandoned),
+					"freed", humanize.Bytes(uint64(report.FreedBytes)), "pruned_pieces", report.PrunedPieces)
+			}
+		}
+	}()
+}
+
+func (c *Client) runGC() error {
+	report, err := c.collectGarbage(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, d := range report.Abandoned {
+		fmt.Printf(" - Removed unfinished download %s (%s)\n", d.Filename, d.CID)
+	}
+	for _, d := range report.Evicted {
+		fmt.Printf(" - Evicted %s (%s)\n", d.Filename, d.CID)
+	}
+	fmt.Printf("✓ Garbage collection freed %s and pruned %d orphaned piece row(s)\n",
+		humanize.Bytes(uint64(report.FreedBytes)), report.PrunedPieces)
+	return nil
+}
+
+func (c *Client) setPinned(cidStr string, pinned bool) error {
+	if err := c.db.SetDownloadPinned(context.Background(), cidStr, pinned); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("no download found for CID %s", cidStr)
+		}
+		return err
+	}
+	if pinned {
+		fmt.Printf("✓ Pinned %s\n", cidStr)
+	} else {
+		fmt.Printf("✓ Unpinned %s\n", cidStr)
+	}
+	return nil
+}
+
+func (c *Client) showStorage() error {
+	ctx := context.Background()
+	downloads, err := c.db.GetDownloads(ctx)
+	if err != nil {
+		return err
+	}
+	used, err := c.db.DownloadsSize(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Println("\n=== Storage ===")
+	if c.storage.Quota > 0 {
+		fmt.Printf("Used: %s of %s quota\n", humanize.Bytes(uint64(used)), humanize.Bytes(uint64(c.storage.Quota)))
+	} else {
+		fmt.Printf("Used: %s (no quota)\n", humanize.Bytes(uint64(used)))
+	}
+	for _, d := range downloads {
+		pin := ""
+		if d.Pinned {
+			pin = " [pinned]"
+		}
+		fmt.Printf("Name: %s%s\n", d.Filename, pin)
+		fmt.Printf(" CID: %s\n", d.CID)
+		fmt.Printf(" Size: %s\n", humanize.Bytes(uint64(d.FileSize)))
+		fmt.Printf(" Status: %s\n", d.Status)
+		fmt.Printf(" Last access: %s\n", humanize.Time(d.LastAccessed))
+		fmt.Println(" ---")
+	}
+	return nil
+}
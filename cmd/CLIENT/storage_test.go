@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	db "torrentium/internal/db"
+)
+
+// addTestDownload records a completed download of size bytes last used at
+// accessed and writes its file.
+func addTestDownload(t *testing.T, c *Client, cidStr string, size int64, accessed time.Time) string {
+	t.Helper()
+	ctx := context.Background()
+	path := writeTestFile(t, t.TempDir(), cidStr, make([]byte, size))
+	if err := c.db.AddDownload(ctx, cidStr, cidStr, size, path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.db.DB.Exec(`UPDATE downloads SET last_accessed=? WHERE cid=?`, accessed, cidStr); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestEvictionCandidates(t *testing.T) {
+	downloads := []db.Download{
+		{CID: "pinned", FileSize: 40, Status: db.DownloadStatusCompleted, Pinned: true},
+		{CID: "old", FileSize: 30, Status: db.DownloadStatusCompleted},
+		{CID: "running", FileSize: 20, Status: db.DownloadStatusDownloading},
+		{CID: "newer", FileSize: 20, Status: db.DownloadStatusCompleted},
+		{CID: "newest", FileSize: 10, Status: db.DownloadStatusCompleted},
+	}
+	for _, tc := range []struct {
+		quota, need int64
+		want        []string
+	}{
+		{quota: 0, need: 1000, want: nil},
+		{quota: 120, need: 0, want: nil},
+		{quota: 120, need: 10, want: []string{"old"}},
+		{quota: 120, need: 50, want: []string{"old", "newer"}},
+		{quota: 100, need: 60, want: []string{"old", "newer", "newest"}},
+	} {
+		var got []string
+		for _, d := range evictionCandidates(downloads, tc.quota, tc.need) {
+			got = append(got, d.CID)
+		}
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("quota %d, need %d: evicted %v, want %v", tc.quota, tc.need, got, tc.want)
+		}
+	}
+}
+
+func TestEnsureSpaceEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newOfflineClient(t, 100)
+	ctx := context.Background()
+	now := time.Now()
+	oldest := addTestDownload(t, c, "oldest", 40, now.Add(-3*time.Hour))
+	pinned := addTestDownload(t, c, "pinned", 30, now.Add(-2*time.Hour))
+	recent := addTestDownload(t, c, "recent", 20, now.Add(-time.Hour))
+	if err := c.db.SetDownloadPinned(ctx, "pinned", true); err != nil {
+		t.Fatal(err)
+	}
+	if used, err := c.db.DownloadsSize(ctx); err != nil || used != 90 {
+		t.Fatalf("used = %d, %v; want 90", used, err)
+	}
+
+	if err := c.ensureSpace(ctx, 50); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(oldest); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("least recently used download was not deleted: %v", err)
+	}
+	for _, p := range []string{pinned, recent} {
+		if _, err := os.Stat(p); err != nil {
+			t.Errorf("%s was deleted: %v", filepath.Base(p), err)
+		}
+	}
+	if used, _ := c.db.DownloadsSize(ctx); used != 50 {
+		t.Errorf("used = %d after eviction, want 50", used)
+	}
+
+	// Only the pinned download is left to make room, which is not enough.
+	if err := c.ensureSpace(ctx, 80); err == nil {
+		t.Fatal("ensureSpace succeeded although pinned content fills the quota")
+	}
+	if _, err := os.Stat(pinned); err != nil {
+		t.Errorf("pinned download was deleted: %v", err)
+	}
+	if err := c.ensureSpace(ctx, 101); err == nil {
+		t.Fatal("ensureSpace accepted a file larger than the quota")
+	}
+}
+
+func TestGCRemovesAbandonedDownloads(t *testing.T) {
+	c := newOfflineClient(t, 0)
+	ctx := context.Background()
+	dir := t.TempDir()
+	start := func(cidStr string, startedAt time.Time) string {
+		path := writeTestFile(t, dir, cidStr+".download", make([]byte, 10))
+		if err := c.db.StartDownload(ctx, cidStr, cidStr, 100, path, ""); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.db.AddPieces(ctx, cidStr, []db.Piece{{Index: 0, Offset: 0, Size: 100, Hash: "00"}}, false); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.db.DB.Exec(`UPDATE downloads SET last_accessed=? WHERE cid=?`, startedAt, cidStr); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	hourAgo := time.Now().Add(-time.Hour)
+	abandoned := start("abandoned", hourAgo)
+	running := start("running", hourAgo)
+	fresh := start("fresh", time.Now())
+	c.activeDownloads["running"] = &DownloadState{}
+
+	report, err := c.collectGarbage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Abandoned) != 1 || report.Abandoned[0].CID != "abandoned" {
+		t.Fatalf("abandoned = %v", report.Abandoned)
+	}
+	if _, err := os.Stat(abandoned); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("partial file of the abandoned download is still there: %v", err)
+	}
+	if _, err := c.db.GetDownloadByCID(ctx, "abandoned"); err == nil {
+		t.Error("abandoned download is still recorded")
+	}
+	if pieces, _ := c.db.GetPieces(ctx, "abandoned"); len(pieces) != 0 {
+		t.Errorf("abandoned download kept %d piece row(s)", len(pieces))
+	}
+	for _, p := range []string{running, fresh} {
+		if _, err := os.Stat(p); err != nil {
+			t.Errorf("%s was deleted: %v", filepath.Base(p), err)
+		}
+	}
+	if used, _ := c.db.DownloadsSize(ctx); used != 200 {
+		t.Errorf("used = %d, want 200", used)
+	}
+}
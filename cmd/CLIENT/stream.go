@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	webRTC "torrentium/internal/client"
+	db "torrentium/internal/db"
+	"torrentium/internal/logging"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	DefaultHTTPAddr       = "127.0.0.1:8089"
+	StreamPathPrefix      = "/ipfs-like/"
+	StreamWindow          = 4                // pieces in flight per peer in streaming mode
+	StreamPieceTimeout    = 30 * time.Second // re-schedule a streamed piece after this long
+	StreamStartTimeout    = 90 * time.Second // how long a request waits for a streaming download to start
+	streamWorkerPollDelay = 1 * time.Second
+)
+
+// errDownloadStopped is returned to readers of a download that ended before
+// the piece they wait for arrived.
+var errDownloadStopped = errors.New("download stopped")
+
+// notifyLocked wakes up everyone waiting for a change in the download state
+// (a completed piece, a released assignment or a moved read cursor).
+// state.mu must be held.
+func (s *DownloadState) notifyLocked() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// setCursor moves the playback position that sequential scheduling starts from.
+func (s *DownloadState) setCursor(idx int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cursor != idx {
+		s.cursor = idx
+		s.notifyLocked()
+	}
+}
+
+// releasePiece returns an unfinished piece to the scheduler so that any
+// worker can request it again.
+func (s *DownloadState) releasePiece(idx int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if timer, ok := s.pieceTimers[idx]; ok {
+		timer.Stop()
+		delete(s.pieceTimers, idx)
+	}
+	if _, ok := s.PieceAssignees[idx]; ok && !s.PieceStatus[idx] {
+		delete(s.PieceAssignees, idx)
+		s.notifyLocked()
+	}
+}
+
+// nextStreamPieceLocked picks the missing, unassigned piece closest after the
+// read cursor that pid has not reported as unavailable, wrapping around to the
+// start of the file. It returns false when pid already has window pieces in
+// flight or there is nothing left to request. state.mu must be held.
+func (s *DownloadState) nextStreamPieceLocked(pid peer.ID, window int) (int, bool) {
+	inFlight := 0
+	for idx, assignee := range s.PieceAssignees {
+		if assignee == pid && !s.PieceStatus[idx] {
+			inFlight++
+		}
+	}
+	if inFlight >= window {
+		return 0, false
+	}
+	for n := 0; n < s.TotalPieces; n++ {
+		idx := (s.cursor + n) % s.TotalPieces
+		if s.PieceStatus[idx] || s.lacking[pid][idx] {
+			continue
+		}
+		if _, assigned := s.PieceAssignees[idx]; assigned {
+			continue
+		}
+		return idx, true
+	}
+	return 0, false
+}
+
+// streamPiecesFromPeer requests pieces from one peer in playback order,
+// keeping at most StreamWindow requests in flight, until the download is done
+// or the peer goes away.
+func (c *Client) streamPiecesFromPeer(p *webRTC.SimpleWebRTCPeer, state *DownloadState) {
+	pid := p.GetSignalingStream().Conn().RemotePeer()
+	for {
+		state.mu.Lock()
+		if state.completedPieces == state.TotalPieces {
+			state.mu.Unlock()
+			return
+		}
+		idx, ok := state.nextStreamPieceLocked(pid, StreamWindow)
+		changed := state.changed
+		if ok {
+			state.PieceAssignees[idx] = pid
+			state.pieceTimers[idx] = time.AfterFunc(StreamPieceTimeout, func() {
+				transferLog.Warn("streamed piece timed out, rescheduling", logging.KeyCID, state.Manifest.CID, logging.KeyPiece, idx)
+				state.releasePiece(idx)
+			})
+		}
+		state.mu.Unlock()
+
+		if !ok {
+			select {
+			case <-changed:
+			case <-p.WaitForCloseChannel():
+				return
+			case <-time.After(streamWorkerPollDelay):
+			}
+			continue
+		}
+
+		req := controlMessage{Command: "REQUEST_PIECE", CID: state.Manifest.CID, Index: int64(idx)}
+		if err := p.SendJSONReliable(req); err != nil {
+			transferLog.Warn("failed to request piece", logging.KeyPeer, pid, logging.KeyPiece, idx, logging.KeyErr, err)
+			state.releasePiece(idx)
+			return
+		}
+	}
+}
+
+// pieceReader is an io.ReadSeeker over a download in progress. Reads block
+// until the pieces covering the requested range have been verified, and move
+// the download cursor so that those pieces are fetched first.
+type pieceReader struct {
+	ctx    context.Context
+	state  *DownloadState
+	file   *os.File
+	size   int64
+	offset int64
+}
+
+func newPieceReader(ctx context.Context, state *DownloadState, path string) (*pieceReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &pieceReader{ctx: ctx, state: state, file: f, size: state.Manifest.TotalSize}, nil
+}
+
+func (r *pieceReader) Close() error { return r.file.Close() }
+
+func (r *pieceReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+// pieceAt returns the index of the piece containing offset.
+func (r *pieceReader) pieceAt(offset int64) int {
+	pieces := r.state.Pieces
+	return sort.Search(len(pieces), func(i int) bool {
+		return pieces[i].Offset+pieces[i].Size > offset
+	})
+}
+
+func (r *pieceReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	idx := r.pieceAt(r.offset)
+	if idx >= len(r.state.Pieces) {
+		return 0, io.EOF
+	}
+	r.state.setCursor(idx)
+	if err := r.waitForPiece(idx); err != nil {
+		return 0, err
+	}
+	piece := r.state.Pieces[idx]
+	if remaining := piece.Offset + piece.Size - r.offset; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err := r.file.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *pieceReader) waitForPiece(idx int) error {
+	for {
+		r.state.mu.Lock()
+		have := r.state.PieceStatus[idx]
+		changed := r.state.changed
+		r.state.mu.Unlock()
+		if have {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-r.state.done:
+			// The piece may have arrived just before the download stopped.
+			r.state.mu.Lock()
+			have, err := r.state.PieceStatus[idx], r.state.err
+			r.state.mu.Unlock()
+			if have {
+				return nil
+			}
+			if err == nil {
+				err = errDownloadStopped
+			}
+			return fmt.Errorf("piece %d unavailable: %w", idx, err)
+		case <-r.ctx.Done():
+			return r.ctx.Err()
+		}
+	}
+}
+
+// streamServer serves shared, downloaded and in-progress files over HTTP
+// with Range support.
+type streamServer struct {
+	c        *Client
+	addr     string
+	once     sync.Once
+	startErr error
+	pending  map[string]bool // CIDs whose streaming download is still starting
+	mu       sync.Mutex
+}
+
+func newStreamServer(c *Client) *streamServer {
+	addr := os.Getenv("TORRENTIUM_HTTP_ADDR")
+	if addr == "" {
+		addr = DefaultHTTPAddr
+	}
+	return &streamServer{c: c, addr: addr, pending: make(map[string]bool)}
+}
+
+// checkLoopbackAddr rejects listen addresses reachable from other machines.
+// The server answers anyone who can connect, without the allowlists that
+// guard restricted shares on the peer-to-peer side.
+func checkLoopbackAddr(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("%s is not a loopback address", addr)
+	}
+	return nil
+}
+
+// start launches the HTTP listener the first time it is called.
+func (s *streamServer) start() error {
+	s.once.Do(func() {
+		if err := checkLoopbackAddr(s.addr); err != nil {
+			s.startErr = fmt.Errorf("refusing to start HTTP server: %w", err)
+			return
+		}
+		ln, err := net.Listen("tcp", s.addr)
+		if err != nil {
+			s.startErr = fmt.Errorf("failed to start HTTP server on %s: %w", s.addr, err)
+			return
+		}
+		s.addr = ln.Addr().String()
+		mux := http.NewServeMux()
+		mux.HandleFunc(StreamPathPrefix, s.handleStream)
+		go func() {
+			if err := http.Serve(ln, mux); err != nil {
+				httpLog.Error("HTTP server stopped", logging.KeyErr, err)
+			}
+		}()
+		httpLog.Info("streaming HTTP server listening", "url", "http://"+s.addr+StreamPathPrefix+"<cid>")
+	})
+	return s.startErr
+}
+
+func (s *streamServer) url(cidStr string) string {
+	return fmt.Sprintf("http://%s%s%s", s.addr, StreamPathPrefix, cidStr)
+}
+
+func (s *streamServer) setPending(cidStr string, pending bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pending {
+		s.pending[cidStr] = true
+	} else {
+		delete(s.pending, cidStr)
+	}
+}
+
+func (s *streamServer) isPending(cidStr string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pending[cidStr]
+}
+
+func (s *streamServer) handleStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cidStr := strings.TrimPrefix(r.URL.Path, StreamPathPrefix)
+	if cidStr == "" || strings.Contains(cidStr, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	ctx := r.Context()
+
+	if path, name, ok := s.c.completedFilePath(ctx, cidStr); ok {
+		f, err := os.Open(path)
+		if err != nil {
+			http.Error(w, "file unavailable", http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		http.ServeContent(w, r, name, time.Time{}, f)
+		return
+	}
+
+	state, err := s.waitForDownload(ctx, cidStr)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	reader, err := newPieceReader(ctx, state, state.Path)
+	if err != nil {
+		http.Error(w, "file unavailable", http.StatusInternalServerError)
+		return
+	}
+	defer reader.Close()
+	http.ServeContent(w, r, state.Manifest.Filename, time.Time{}, reader)
+}
+
+// waitForDownload returns the active download for cidStr, waiting for a
+// streaming download that is still looking for providers.
+func (s *streamServer) waitForDownload(ctx context.Context, cidStr string) (*DownloadState, error) {
+	deadline := time.Now().Add(StreamStartTimeout)
+	for {
+		s.c.downloadsMux.RLock()
+		state, ok := s.c.activeDownloads[cidStr]
+		s.c.downloadsMux.RUnlock()
+		if ok {
+			return state, nil
+		}
+		if !s.isPending(cidStr) || time.Now().After(deadline) {
+			return nil, fmt.Errorf("no download in progress for %s", cidStr)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+}
+
+// completedFilePath returns the on-disk path of a CID we have in full, either
+// as a shared file or as a completed download.
+func (c *Client) completedFilePath(ctx context.Context, cidStr string) (string, string, bool) {
+	if lf, err := c.db.GetLocalFileByCID(ctx, cidStr); err == nil {
+		return lf.FilePath, lf.Filename, true
+	}
+	if d, err := c.db.GetDownloadByCID(ctx, cidStr); err == nil && d.Status == db.DownloadStatusCompleted {
+		return d.DownloadPath, d.Filename, true
+	}
+	return "", "", false
+}
+
+// streamFile starts a sequential download in the background and prints the
+// local URL it can be played from while it downloads.
+func (c *Client) streamFile(cidStr string, opts downloadOptions) error {
+	if _, key := splitShareLink(cidStr); key != "" || opts.Key != "" {
+		return fmt.Errorf("encrypted shares cannot be streamed")
+	}
+	if err := c.httpServer.start(); err != nil {
+		return err
+	}
+	opts.Stream = true
+	c.httpServer.setPending(cidStr, true)
+	go func() {
+		defer c.httpServer.setPending(cidStr, false)
+		if err := c.downloadFile(cidStr, opts); err != nil {
+			transferLog.Error("streaming download failed", logging.KeyCID, cidStr, logging.KeyErr, err)
+		}
+	}()
+	fmt.Printf("Streaming %s\n", cidStr)
+	fmt.Printf(" URL: %s\n", c.httpServer.url(cidStr))
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	db "torrentium/internal/db"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	testStreamPieces    = 4
+	testStreamPieceSize = 100
+)
+
+// streamRequest runs a GET for cidStr through the stream handler.
+func streamRequest(s *streamServer, method, cidStr, rangeHeader string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, StreamPathPrefix+cidStr, nil)
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+	rec := httptest.NewRecorder()
+	s.handleStream(rec, req)
+	return rec
+}
+
+func TestStreamServerRanges(t *testing.T) {
+	c := newOfflineClient(t, 0)
+	s := newStreamServer(c)
+	data := bytes.Repeat([]byte("0123456789"), 40)
+	path := writeTestFile(t, t.TempDir(), "done.bin", data)
+	if err := c.db.AddLocalFile(context.Background(), "bafkdone", "done.bin", int64(len(data)), path, "hash", testStreamPieceSize); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name, rangeHeader string
+		status            int
+		contentRange      string
+		body              []byte
+	}{
+		{"whole file", "", http.StatusOK, "", data},
+		{"closed range", "bytes=10-19", http.StatusPartialContent, "bytes 10-19/400", data[10:20]},
+		{"open-ended range", "bytes=390-", http.StatusPartialContent, "bytes 390-399/400", data[390:]},
+		{"suffix range", "bytes=-5", http.StatusPartialContent, "bytes 395-399/400", data[395:]},
+		{"range past the end", "bytes=400-", http.StatusRequestedRangeNotSatisfiable, "bytes */400", nil},
+		{"inverted range", "bytes=50-10", http.StatusRequestedRangeNotSatisfiable, "", nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := streamRequest(s, http.MethodGet, "bafkdone", tc.rangeHeader)
+			if rec.Code != tc.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tc.status)
+			}
+			if got := rec.Header().Get("Content-Range"); got != tc.contentRange {
+				t.Errorf("Content-Range = %q, want %q", got, tc.contentRange)
+			}
+			if tc.body != nil && !bytes.Equal(rec.Body.Bytes(), tc.body) {
+				t.Errorf("body = %q, want %q", rec.Body.Bytes(), tc.body)
+			}
+		})
+	}
+
+	if rec := streamRequest(s, http.MethodGet, "bafkunknown", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown CID: status = %d", rec.Code)
+	}
+	if rec := streamRequest(s, http.MethodPost, "bafkdone", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: status = %d", rec.Code)
+	}
+}
+
+// newStreamingState registers an in-progress download of data whose first
+// have pieces are already verified.
+func newStreamingState(t *testing.T, c *Client, cidStr string, data []byte, have int) *DownloadState {
+	t.Helper()
+	path := writeTestFile(t, t.TempDir(), cidStr+".download", data)
+	state := &DownloadState{
+		Manifest:       controlMessage{CID: cidStr, Filename: "movie.bin", TotalSize: int64(len(data))},
+		TotalPieces:    testStreamPieces,
+		PieceStatus:    make([]bool, testStreamPieces),
+		PieceAssignees: make(map[int]peer.ID),
+		pieceTimers:    make(map[int]*time.Timer),
+		Path:           path,
+		Sequential:     true,
+		changed:        make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	for i := 0; i < testStreamPieces; i++ {
+		state.Pieces = append(state.Pieces, db.Piece{Index: int64(i), Offset: int64(i * testStreamPieceSize), Size: testStreamPieceSize})
+		state.PieceStatus[i] = i < have
+	}
+	c.activeDownloads[cidStr] = state
+	return state
+}
+
+// verifyPiece marks a piece as downloaded the way handlePieceChunk does.
+func (s *DownloadState) verifyPiece(idx int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.PieceStatus[idx] = true
+	s.completedPieces++
+	s.notifyLocked()
+}
+
+func TestStreamServerWaitsForPieces(t *testing.T) {
+	c := newOfflineClient(t, 0)
+	s := newStreamServer(c)
+	data := bytes.Repeat([]byte("abcdefghij"), 40)
+	state := newStreamingState(t, c, "bafkstream", data, 2)
+
+	rec := streamRequest(s, http.MethodGet, "bafkstream", "bytes=0-199")
+	if rec.Code != http.StatusPartialContent || !bytes.Equal(rec.Body.Bytes(), data[:200]) {
+		t.Fatalf("verified range: status %d, %d bytes", rec.Code, rec.Body.Len())
+	}
+
+	// An open-ended range waits for the missing pieces and moves the cursor
+	// to them.
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() { done <- streamRequest(s, http.MethodGet, "bafkstream", "bytes=150-") }()
+	waitFor(t, 5*time.Second, "cursor to reach the first missing piece", func() bool {
+		state.mu.Lock()
+		defer state.mu.Unlock()
+		return state.cursor == 2
+	})
+	state.verifyPiece(2)
+	state.verifyPiece(3)
+	select {
+	case rec := <-done:
+		if rec.Code != http.StatusPartialContent || !bytes.Equal(rec.Body.Bytes(), data[150:]) {
+			t.Fatalf("open-ended range: status %d, %d bytes", rec.Code, rec.Body.Len())
+		}
+		if got := rec.Header().Get("Content-Range"); got != "bytes 150-399/400" {
+			t.Errorf("Content-Range = %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request did not finish after the pieces arrived")
+	}
+
+	if rec := streamRequest(s, http.MethodGet, "bafkstream", "bytes=500-"); rec.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("unsatisfiable range: status = %d", rec.Code)
+	}
+}
+
+func TestStreamReaderFailsWhenDownloadStops(t *testing.T) {
+	c := newOfflineClient(t, 0)
+	s := newStreamServer(c)
+	data := bytes.Repeat([]byte("x"), testStreamPieces*testStreamPieceSize)
+	state := newStreamingState(t, c, "bafkfail", data, 1)
+
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() { done <- streamRequest(s, http.MethodGet, "bafkfail", "bytes=0-") }()
+	waitFor(t, 5*time.Second, "reader to wait for piece 1", func() bool {
+		state.mu.Lock()
+		defer state.mu.Unlock()
+		return state.cursor == 1
+	})
+	state.mu.Lock()
+	state.err = errors.New("all providers disconnected")
+	state.mu.Unlock()
+	close(state.done)
+
+	select {
+	case rec := <-done:
+		// The headers are already out, so the response ends early.
+		if rec.Body.Len() != testStreamPieceSize {
+			t.Fatalf("served %d bytes, want only the verified %d", rec.Body.Len(), testStreamPieceSize)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("reader still blocked after the download stopped")
+	}
+
+	r, err := newPieceReader(context.Background(), state, state.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := r.Seek(testStreamPieceSize, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(make([]byte, 10)); err == nil || !errors.Is(err, state.err) {
+		t.Fatalf("Read after the download stopped: err = %v", err)
+	}
+}
+
+func TestCheckLoopbackAddr(t *testing.T) {
+	for addr, ok := range map[string]bool{
+		"127.0.0.1:8089":   true,
+		"127.0.0.2:80":     true,
+		"[::1]:8089":       true,
+		"localhost:0":      true,
+		"0.0.0.0:8089":     false,
+		":8089":            false,
+		"[::]:8089":        false,
+		"192.168.1.5:8089": false,
+		"example.com:80":   false,
+		"127.0.0.1":        false,
+	} {
+		if err := checkLoopbackAddr(addr); (err == nil) != ok {
+			t.Errorf("checkLoopbackAddr(%q) = %v", addr, err)
+		}
+	}
+	s := &streamServer{addr: "0.0.0.0:0", pending: make(map[string]bool)}
+	if err := s.start(); err == nil {
+		t.Fatalf("started an HTTP server on %s", s.addr)
+	}
+}
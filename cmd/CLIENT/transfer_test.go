@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	webRTC "torrentium/internal/client"
+	db "torrentium/internal/db"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// testFileSize spans several pieces with a short last piece.
+const testFileSize = 2*DefaultPieceSize + 300*1024
+
+func TestTransferEndToEnd(t *testing.T) {
+	tn := newTestNetwork(t, 2)
+	seeder, leecher := tn.nodes[0], tn.nodes[1]
+
+	cidStr, want := tn.shareFile(seeder, "movie.bin", testFileSize)
+
+	providers, err := leecher.findProvidersWithTimeout(mustDecodeCID(t, cidStr), 10*time.Second, MaxProviders)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(providers) != 1 || providers[0].ID != seeder.host.ID() {
+		t.Fatalf("providers = %v, want only %s", providers, seeder.host.ID())
+	}
+
+	got := tn.download(leecher, cidStr, downloadOptions{})
+	if !bytes.Equal(got, want) {
+		t.Fatal("downloaded content differs from the shared file")
+	}
+
+	pieces, err := leecher.db.GetPieces(context.Background(), cidStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range pieces {
+		if !p.Have {
+			t.Errorf("piece %d not marked as downloaded", p.Index)
+		}
+	}
+
+	w := seeder.windows.lookup(leecher.host.ID())
+	if w == nil {
+		t.Fatal("seeder has no sending window for the leecher")
+	}
+	waitFor(t, 5*time.Second, "all pieces to be acknowledged", func() bool {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		return w.srtt > 0 && w.inflight == 0
+	})
+}
+
+func TestTransferFromMultipleSeeders(t *testing.T) {
+	tn := newTestNetwork(t, 3)
+	leecher := tn.nodes[2]
+
+	cidStr, want := tn.shareFile(tn.nodes[0], "a.bin", testFileSize)
+	if again, _ := shareExisting(tn, tn.nodes[1], "b.bin", want); again != cidStr {
+		t.Fatalf("same content got CID %s, want %s", again, cidStr)
+	}
+
+	got := tn.download(leecher, cidStr, downloadOptions{})
+	if !bytes.Equal(got, want) {
+		t.Fatal("downloaded content differs from the shared file")
+	}
+}
+
+func TestTransferRecoversStalledPiece(t *testing.T) {
+	tn := newTestNetwork(t, 2)
+	seeder, leecher := tn.nodes[0], tn.nodes[1]
+	leecher.pieceTimeout = time.Second
+	cidStr, want := tn.shareFile(seeder, "stalled.bin", testFileSize)
+
+	// The first transmission of piece 1 stops halfway; the piece is
+	// re-requested when it times out.
+	var transmissions atomic.Int32
+	var stalled atomic.Bool
+	seeder.hooks.beforeSendChunk = func(_ peer.ID, msg *controlMessage) bool {
+		if msg.Index != 1 {
+			return true
+		}
+		if msg.ChunkIndex == 0 {
+			transmissions.Add(1)
+		}
+		if transmissions.Load() == 1 && msg.ChunkIndex >= msg.TotalChunks/2 {
+			stalled.Store(true)
+			return false
+		}
+		return true
+	}
+
+	got := tn.download(leecher, cidStr, downloadOptions{})
+	if !bytes.Equal(got, want) {
+		t.Fatal("downloaded content differs from the shared file")
+	}
+	if !stalled.Load() {
+		t.Fatal("no piece stalled")
+	}
+}
+
+func TestTransferSkipsUnreadablePiece(t *testing.T) {
+	tn := newTestNetwork(t, 3)
+	broken, healthy, leecher := tn.nodes[0], tn.nodes[1], tn.nodes[2]
+	cidStr, want := tn.shareFile(broken, "a.bin", testFileSize)
+	shareExisting(tn, healthy, "b.bin", want)
+
+	// The broken seeder's copy loses its tail after it was shared, so reading
+	// the last pieces fails; the leecher must not wait for them to time out.
+	lf, err := broken.db.GetLocalFileByCID(context.Background(), cidStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(lf.FilePath, testFileSize/4); err != nil {
+		t.Fatal(err)
+	}
+
+	got := tn.download(leecher, cidStr, downloadOptions{})
+	if !bytes.Equal(got, want) {
+		t.Fatal("downloaded content differs from the shared file")
+	}
+}
+
+func TestTransferRecoversCorruptPiece(t *testing.T) {
+	tn := newTestNetwork(t, 2)
+	seeder, leecher := tn.nodes[0], tn.nodes[1]
+	cidStr, want := tn.shareFile(seeder, "corrupt.bin", testFileSize)
+
+	var corrupted atomic.Bool
+	seeder.hooks.beforeSendChunk = func(_ peer.ID, msg *controlMessage) bool {
+		if msg.Index == 1 && msg.ChunkIndex == 0 && corrupted.CompareAndSwap(false, true) {
+			msg.Payload = flipHexDigit(msg.Payload)
+		}
+		return true
+	}
+
+	got := tn.download(leecher, cidStr, downloadOptions{})
+	if !bytes.Equal(got, want) {
+		t.Fatal("downloaded content differs from the shared file")
+	}
+	if !corrupted.Load() {
+		t.Fatal("no piece was corrupted")
+	}
+}
+
+func TestTransferSurvivesPeerDisconnect(t *testing.T) {
+	tn := newTestNetwork(t, 3)
+	good, flaky, leecher := tn.nodes[0], tn.nodes[1], tn.nodes[2]
+	cidStr, want := tn.shareFile(good, "a.bin", testFileSize)
+	shareExisting(tn, flaky, "b.bin", want)
+
+	// The flaky seeder goes away as soon as it starts sending: the leecher
+	// has to fetch its pieces from the remaining seeder.
+	var once sync.Once
+	flaky.hooks.beforeSendChunk = func(to peer.ID, _ *controlMessage) bool {
+		once.Do(func() {
+			go func() {
+				waitFor(t, 30*time.Second, "both seeders to connect", func() bool {
+					return leecher.webRTCPeerCount() == 2
+				})
+				leecher.webRTCPeer(flaky.host.ID()).Close()
+			}()
+		})
+		return false
+	}
+
+	got := tn.download(leecher, cidStr, downloadOptions{})
+	if !bytes.Equal(got, want) {
+		t.Fatal("downloaded content differs from the shared file")
+	}
+}
+
+func TestTransferSeedsCompletedDownload(t *testing.T) {
+	tn := newTestNetwork(t, 3)
+	origin, first, second := tn.nodes[0], tn.nodes[1], tn.nodes[2]
+	first.seeding = seedingConfig{Enabled: true}
+	cidStr, want := tn.shareFile(origin, "seed.bin", testFileSize)
+
+	tn.download(first, cidStr, downloadOptions{})
+	if _, err := first.db.GetLocalFileByCID(context.Background(), cidStr); err != nil {
+		t.Fatalf("completed download is not shared: %v", err)
+	}
+
+	// Cut the original seeder off so that everything has to come from the
+	// node that just finished downloading.
+	if err := tn.mn.UnlinkPeers(origin.host.ID(), second.host.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if err := tn.mn.DisconnectPeers(origin.host.ID(), second.host.ID()); err != nil {
+		t.Fatal(err)
+	}
+
+	got := tn.download(second, cidStr, downloadOptions{})
+	if !bytes.Equal(got, want) {
+		t.Fatal("downloaded content differs from the shared file")
+	}
+	seeds, err := first.db.GetSeeds(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seeds) != 1 || seeds[0].UploadedBytes < int64(len(want)) {
+		t.Fatalf("seeds = %+v, want one seed with at least %d bytes uploaded", seeds, len(want))
+	}
+}
+
+// shareExisting shares a copy of data from node and returns its CID.
+func shareExisting(tn *testNetwork, node *testNode, name string, data []byte) (string, *db.LocalFile) {
+	tn.t.Helper()
+	path := writeTestFile(tn.t, node.dir, name, data)
+	if err := node.addFile(context.Background(), path, addOptions{}); err != nil {
+		tn.t.Fatalf("addFile: %v", err)
+	}
+	cidStr := rawCID(tn.t, data)
+	lf, err := node.db.GetLocalFileByCID(context.Background(), cidStr)
+	if err != nil {
+		tn.t.Fatal(err)
+	}
+	return cidStr, lf
+}
+
+func flipHexDigit(s string) string {
+	b := []byte(s)
+	if b[0] == '0' {
+		b[0] = '1'
+	} else {
+		b[0] = '0'
+	}
+	return string(b)
+}
+
+func TestTransferOverDataChannelPool(t *testing.T) {
+	tn := newTestNetwork(t, 3)
+	seeder, leecher, legacy := tn.nodes[0], tn.nodes[1], tn.nodes[2]
+	legacy.dataChannels = 1
+	cidStr, want := tn.shareFile(seeder, "pool.bin", 4*DefaultPieceSize)
+
+	got := tn.download(leecher, cidStr, downloadOptions{})
+	if !bytes.Equal(got, want) {
+		t.Fatal("downloaded content differs from the shared file")
+	}
+	for _, p := range []*webRTC.SimpleWebRTCPeer{leecher.webRTCPeer(seeder.host.ID()), seeder.webRTCPeer(leecher.host.ID())} {
+		if p == nil {
+			t.Fatal("peers are not connected")
+		}
+		waitFor(t, 5*time.Second, "the data channel pool to open", func() bool {
+			return p.DataChannels() == DefaultDataChannels
+		})
+	}
+
+	// A peer that asks for a single channel gets no pool.
+	if got := tn.download(legacy, cidStr, downloadOptions{}); !bytes.Equal(got, want) {
+		t.Fatal("downloaded content differs from the shared file")
+	}
+	if p := seeder.webRTCPeer(legacy.host.ID()); p == nil || p.DataChannels() != 1 {
+		t.Fatal("a pool was opened although one peer asked for a single channel")
+	}
+}
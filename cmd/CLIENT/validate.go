@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	db "torrentium/internal/db"
+)
+
+// Limits on what a remote peer may ask us to allocate.
+const (
+	MaxControlMessageSize = 8 << 20 // largest accepted data channel message (manifests included)
+	MaxManifestPieces     = 1 << 16
+	MaxPieceSize          = 16 << 20
+	MaxFilenameBytes      = 4096
+)
+
+// errMalformed wraps every validation failure of a remote message.
+type errMalformed struct{ reason string }
+
+func (e errMalformed) Error() string { return "malformed message: " + e.reason }
+
+func malformedf(format string, args ...any) error {
+	return errMalformed{fmt.Sprintf(format, args...)}
+}
+
+// chunkCount returns how many chunks a piece of the given size is sent in.
+func chunkCount(size int64) int {
+	return int((size + MaxChunk - 1) / MaxChunk)
+}
+
+// chunkLen returns the payload length of chunk i of a piece.
+func chunkLen(size int64, i int) int {
+	return int(min64(MaxChunk, size-int64(i)*MaxChunk))
+}
+
+func validHash(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// validateManifest checks a manifest received for cidStr before anything is
+// allocated from it: the pieces must be contiguous, bounded in size and
+// add up to the total size. If the manifest states a piece size, every piece
+// but the last must have it.
+func validateManifest(m controlMessage, cidStr string) error {
+	if m.CID != cidStr {
+		return malformedf("manifest for %q, requested %q", m.CID, cidStr)
+	}
+	if m.TotalSize < 0 || m.NumPieces < 0 || m.NumPieces > MaxManifestPieces {
+		return malformedf("manifest size %d with %d pieces", m.TotalSize, m.NumPieces)
+	}
+	if int64(len(m.Pieces)) != m.NumPieces {
+		return malformedf("manifest lists %d of %d pieces", len(m.Pieces), m.NumPieces)
+	}
+	if !validHash(m.HashHex) {
+		return malformedf("invalid file hash")
+	}
+	if len(m.Filename) > MaxFilenameBytes {
+		return malformedf("filename of %d bytes", len(m.Filename))
+	}
+	if m.PieceSize < 0 || m.PieceSize > MaxPieceSize {
+		return malformedf("piece size %d", m.PieceSize)
+	}
+	var offset int64
+	for i, p := range m.Pieces {
+		if p.Index != int64(i) || p.Offset != offset {
+			return malformedf("piece %d has index %d at offset %d", i, p.Index, p.Offset)
+		}
+		if p.Size <= 0 || p.Size > MaxPieceSize {
+			return malformedf("piece %d has size %d", i, p.Size)
+		}
+		if m.PieceSize > 0 && (p.Size > m.PieceSize || p.Size < m.PieceSize && i < len(m.Pieces)-1) {
+			return malformedf("piece %d has size %d, piece size is %d", i, p.Size, m.PieceSize)
+		}
+		if !validHash(p.Hash) {
+			return malformedf("piece %d has an invalid hash", i)
+		}
+		offset += p.Size
+	}
+	if offset != m.TotalSize {
+		return malformedf("pieces cover %d of %d bytes", offset, m.TotalSize)
+	}
+	return nil
+}
+
+// decodeChunk validates a PIECE_CHUNK against the manifest of the download
+// and returns its payload.
+func decodeChunk(ctrl controlMessage, pieces []db.Piece) ([]byte, error) {
+	if ctrl.Index < 0 || ctrl.Index >= int64(len(pieces)) {
+		return nil, malformedf("chunk for piece %d of %d", ctrl.Index, len(pieces))
+	}
+	size := pieces[ctrl.Index].Size
+	total := chunkCount(size)
+	if ctrl.TotalChunks != total {
+		return nil, malformedf("piece %d sent in %d chunks, expected %d", ctrl.Index, ctrl.TotalChunks, total)
+	}
+	if ctrl.ChunkIndex < 0 || ctrl.ChunkIndex >= total || ctrl.Sequence != ctrl.ChunkIndex {
+		return nil, malformedf("chunk %d (sequence %d) of %d", ctrl.ChunkIndex, ctrl.Sequence, total)
+	}
+	want := chunkLen(size, ctrl.ChunkIndex)
+	switch ctrl.Compression {
+	case "":
+		if len(ctrl.Payload) != 2*want {
+			return nil, malformedf("chunk %d of piece %d has %d hex digits, expected %d", ctrl.ChunkIndex, ctrl.Index, len(ctrl.Payload), 2*want)
+		}
+	case CompressionZstd:
+		// Compressed chunks are only sent when they are smaller.
+		if len(ctrl.Payload) >= 2*want {
+			return nil, malformedf("compressed chunk %d of piece %d has %d hex digits", ctrl.ChunkIndex, ctrl.Index, len(ctrl.Payload))
+		}
+	default:
+		return nil, malformedf("unknown compression %q", ctrl.Compression)
+	}
+	data, err := hex.DecodeString(ctrl.Payload)
+	if err != nil {
+		return nil, malformedf("chunk payload: %v", err)
+	}
+	if ctrl.Compression == CompressionZstd {
+		data, err = zstdDecoder.DecodeAll(data, make([]byte, 0, want))
+		if err != nil {
+			return nil, malformedf("chunk payload: %v", err)
+		}
+		if len(data) != want {
+			return nil, malformedf("chunk %d of piece %d decompresses to %d bytes, expected %d", ctrl.ChunkIndex, ctrl.Index, len(data), want)
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	db "torrentium/internal/db"
+)
+
+func testManifest(sizes ...int64) controlMessage {
+	hash := hex.EncodeToString(make([]byte, sha256.Size))
+	m := controlMessage{Command: "MANIFEST", CID: "bafkreitest", HashHex: hash, NumPieces: int64(len(sizes))}
+	for i, size := range sizes {
+		m.Pieces = append(m.Pieces, db.Piece{Index: int64(i), Offset: m.TotalSize, Size: size, Hash: hash})
+		m.TotalSize += size
+	}
+	return m
+}
+
+func TestValidateManifest(t *testing.T) {
+	if err := validateManifest(testManifest(DefaultPieceSize, 100), "bafkreitest"); err != nil {
+		t.Fatalf("valid manifest rejected: %v", err)
+	}
+	withSize := testManifest(DefaultPieceSize, 100)
+	withSize.PieceSize = DefaultPieceSize
+	if err := validateManifest(withSize, "bafkreitest"); err != nil {
+		t.Fatalf("valid manifest with a piece size rejected: %v", err)
+	}
+	cases := map[string]func(m *controlMessage){
+		"other CID":       func(m *controlMessage) { m.CID = "bafkreiother" },
+		"piece count":     func(m *controlMessage) { m.NumPieces = 3 },
+		"negative size":   func(m *controlMessage) { m.TotalSize = -1 },
+		"total size":      func(m *controlMessage) { m.TotalSize++ },
+		"gap":             func(m *controlMessage) { m.Pieces[1].Offset++ },
+		"index":           func(m *controlMessage) { m.Pieces[1].Index = 5 },
+		"huge piece":      func(m *controlMessage) { m.Pieces[1].Size = MaxPieceSize + 1 },
+		"empty piece":     func(m *controlMessage) { m.Pieces[1].Size = 0 },
+		"piece hash":      func(m *controlMessage) { m.Pieces[0].Hash = "zz" },
+		"file hash":       func(m *controlMessage) { m.HashHex = "" },
+		"long filename":   func(m *controlMessage) { m.Filename = strings.Repeat("a", MaxFilenameBytes+1) },
+		"too many pieces": func(m *controlMessage) { m.NumPieces = MaxManifestPieces + 1 },
+		"short piece":     func(m *controlMessage) { m.PieceSize = 2 * DefaultPieceSize },
+		"long piece":      func(m *controlMessage) { m.PieceSize = DefaultPieceSize / 2 },
+	}
+	for name, mutate := range cases {
+		m := testManifest(DefaultPieceSize, 100)
+		mutate(&m)
+		if err := validateManifest(m, "bafkreitest"); err == nil {
+			t.Errorf("%s: manifest accepted", name)
+		}
+	}
+}
+
+func TestDecodeChunk(t *testing.T) {
+	pieces := testManifest(DefaultPieceSize, MaxChunk+10).Pieces
+	chunk := func(index int64, chunkIndex, total, size int) controlMessage {
+		return controlMessage{
+			Command:     "PIECE_CHUNK",
+			Index:       index,
+			ChunkIndex:  chunkIndex,
+			Sequence:    chunkIndex,
+			TotalChunks: total,
+			Payload:     strings.Repeat("ab", size),
+		}
+	}
+	valid := []controlMessage{
+		chunk(0, 0, DefaultPieceSize/MaxChunk, MaxChunk),
+		chunk(1, 0, 2, MaxChunk),
+		chunk(1, 1, 2, 10),
+	}
+	for _, c := range valid {
+		data, err := decodeChunk(c, pieces)
+		if err != nil {
+			t.Fatalf("valid chunk %d/%d rejected: %v", c.Index, c.ChunkIndex, err)
+		}
+		if len(data) != len(c.Payload)/2 {
+			t.Fatalf("decoded %d bytes, want %d", len(data), len(c.Payload)/2)
+		}
+	}
+
+	bad := map[string]controlMessage{
+		"negative piece":   chunk(-1, 0, 2, MaxChunk),
+		"piece past end":   chunk(2, 0, 2, MaxChunk),
+		"chunk count":      chunk(1, 0, 1<<30, MaxChunk),
+		"negative chunk":   chunk(1, -1, 2, MaxChunk),
+		"chunk past end":   chunk(1, 2, 2, MaxChunk),
+		"short payload":    chunk(1, 0, 2, 10),
+		"oversize payload": chunk(1, 1, 2, MaxChunk),
+	}
+	nonHex := chunk(1, 1, 2, 10)
+	nonHex.Payload = strings.Repeat("zz", 10)
+	bad["non-hex payload"] = nonHex
+	seq := chunk(1, 1, 2, 10)
+	seq.Sequence = 0
+	bad["sequence"] = seq
+	for name, c := range bad {
+		if _, err := decodeChunk(c, pieces); err == nil {
+			t.Errorf("%s: chunk accepted", name)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"torrentium/internal/logging"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// DefaultWatchSettle is how long a watched file must go unchanged before it
+// is hashed, so that files still being written are not shared half-done.
+const DefaultWatchSettle = 2 * time.Second
+
+// watchConfig lists the directories whose files are shared automatically.
+type watchConfig struct {
+	Dirs   []string
+	Settle time.Duration
+}
+
+// loadWatchConfig reads TORRENTIUM_WATCH_DIRS, a list of directories separated
+// like PATH, and TORRENTIUM_WATCH_SETTLE (default "2s").
+func loadWatchConfig() watchConfig {
+	cfg := watchConfig{Settle: DefaultWatchSettle}
+	for _, dir := range filepath.SplitList(os.Getenv("TORRENTIUM_WATCH_DIRS")) {
+		if dir != "" {
+			cfg.Dirs = append(cfg.Dirs, dir)
+		}
+	}
+	if v := os.Getenv("TORRENTIUM_WATCH_SETTLE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			logger.Warn("invalid TORRENTIUM_WATCH_SETTLE", "value", v)
+		} else {
+			cfg.Settle = d
+		}
+	}
+	return cfg
+}
+
+// folderWatcher keeps the files below the watched directories shared: new
+// files are added, a changed file is shared under its new CID in place of the
+// old one, and deleted files stop being shared.
+type folderWatcher struct {
+	c       *Client
+	cfg     watchConfig
+	fsw     *fsnotify.Watcher
+	ctx     context.Context
+	cancel  context.CancelFunc
+	mu      sync.Mutex
+	timers  map[string]*time.Timer // pending syncs, reset by every event
+	pending chan string
+	done    chan struct{}
+}
+
+// startWatching watches cfg.Dirs and their subdirectories. Files that
+// changed while the client was not running are picked up by an initial scan.
+func (c *Client) startWatching(cfg watchConfig) (*folderWatcher, error) {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file watcher: %w", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &folderWatcher{
+		c:       c,
+		cfg:     cfg,
+		fsw:     fsw,
+		ctx:     ctx,
+		cancel:  cancel,
+		timers:  make(map[string]*time.Timer),
+		pending: make(chan string, 64),
+		done:    make(chan struct{}),
+	}
+	var dirs []string
+	for _, dir := range cfg.Dirs {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			fsw.Close()
+			return nil, fmt.Errorf("invalid watch directory %s: %w", dir, err)
+		}
+		if err := fsw.Add(abs); err != nil {
+			fsw.Close()
+			return nil, fmt.Errorf("failed to watch %s: %w", abs, err)
+		}
+		dirs = append(dirs, abs)
+	}
+	w.cfg.Dirs = dirs
+	go w.events()
+	go w.syncLoop()
+	go func() {
+		for _, dir := range dirs {
+			w.forgetMissing(dir)
+			w.addTree(dir)
+		}
+	}()
+	return w, nil
+}
+
+// stop stops watching and waits for a sync in progress to be cancelled.
+func (w *folderWatcher) stop() {
+	w.cancel()
+	w.fsw.Close()
+	w.mu.Lock()
+	for _, t := range w.timers {
+		t.Stop()
+	}
+	w.mu.Unlock()
+	<-w.done
+}
+
+func (w *folderWatcher) events() {
+	for {
+		select {
+		case ev, ok := <-w.fsw.Events:
+			if !ok {
+				return
+			}
+			if ignoredWatchPath(ev.Name) {
+				continue
+			}
+			if ev.Has(fsnotify.Create) {
+				if info, err := os.Stat(ev.Name); err == nil && info.IsDir() {
+					w.addTree(ev.Name)
+					continue
+				}
+			}
+			if ev.Has(fsnotify.Create | fsnotify.Write | fsnotify.Remove | fsnotify.Rename) {
+				w.schedule(ev.Name)
+			}
+		case err, ok := <-w.fsw.Errors:
+			if !ok {
+				return
+			}
+			watchLog.Warn("file watcher error", logging.KeyErr, err)
+		}
+	}
+}
+
+// addTree watches dir and every directory below it and schedules a sync of
+// the files found there.
+func (w *folderWatcher) addTree(dir string) {
+	_ = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			watchLog.Warn("failed to scan watched directory", "path", path, logging.KeyErr, err)
+			return nil
+		}
+		if path != dir && ignoredWatchPath(path) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if path != dir {
+				if err := w.fsw.Add(path); err != nil {
+					watchLog.Warn("failed to watch directory", "path", path, logging.KeyErr, err)
+				}
+			}
+			return nil
+		}
+		w.schedule(path)
+		return nil
+	})
+}
+
+// schedule syncs path once it has gone cfg.Settle without another event.
+func (w *folderWatcher) schedule(path string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.ctx.Err() != nil {
+		return
+	}
+	if t, ok := w.timers[path]; ok {
+		t.Reset(w.cfg.Settle)
+		return
+	}
+	w.timers[path] = time.AfterFunc(w.cfg.Settle, func() {
+		w.mu.Lock()
+		delete(w.timers, path)
+		w.mu.Unlock()
+		select {
+		case w.pending <- path:
+		case <-w.ctx.Done():
+		}
+	})
+}
+
+// syncLoop handles settled paths one at a time, so a burst of new files is
+// hashed in turn rather than all at once.
+func (w *folderWatcher) syncLoop() {
+	defer close(w.done)
+	for {
+		select {
+		case path := <-w.pending:
+			if err := w.sync(path); err != nil && w.ctx.Err() == nil {
+				watchLog.Error("failed to sync watched file", "path", path, logging.KeyErr, err)
+			}
+		case <-w.ctx.Done():
+			return
+		}
+	}
+}
+
+// sync brings the share of path in line with what is on disk.
+func (w *folderWatcher) sync(path string) error {
+	ctx := w.ctx
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		w.forgetMissing(path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	if downloading, err := w.c.isDownloadPath(ctx, path); err != nil || downloading {
+		// Downloads are shared by seeding once they are complete.
+		return err
+	}
+
+	prev, err := w.c.db.GetLocalFileByPath(ctx, path)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	// Only an exact match counts: copies that keep the source's mtime can
+	// replace a file with one that looks older.
+	if prev != nil && prev.FileSize == info.Size() && prev.ModTime == info.ModTime().UnixNano() {
+		return nil
+	}
+	shared, err := w.c.shareFile(ctx, path, addOptions{}, nil)
+	if err != nil {
+		return err
+	}
+	if prev == nil || prev.CID == shared.CID.String() {
+		watchLog.Info("shared watched file", "path", path, logging.KeyCID, shared.CID)
+		return nil
+	}
+	// The old content is gone from disk, so its CID cannot be served any more.
+	if err := w.c.unshareFile(ctx, *prev); err != nil {
+		return fmt.Errorf("failed to unshare previous version %s: %w", prev.CID, err)
+	}
+	watchLog.Info("shared changed file", "path", path, logging.KeyCID, shared.CID, "previous", prev.CID)
+	return nil
+}
+
+// forgetMissing unshares the files at or below path that no longer exist.
+func (w *folderWatcher) forgetMissing(path string) {
+	files, err := w.c.db.GetLocalFiles(w.ctx)
+	if err != nil {
+		if w.ctx.Err() == nil {
+			watchLog.Error("failed to load shared files", logging.KeyErr, err)
+		}
+		return
+	}
+	for _, f := range files {
+		if f.FilePath != path && !strings.HasPrefix(f.FilePath, path+string(filepath.Separator)) {
+			continue
+		}
+		if _, err := os.Stat(f.FilePath); !errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err := w.c.unshareFile(w.ctx, f); err != nil {
+			watchLog.Error("failed to unshare deleted file", "path", f.FilePath, logging.KeyErr, err)
+			continue
+		}
+		watchLog.Info("unshared deleted file", "path", f.FilePath, logging.KeyCID, f.CID)
+	}
+}
+
+// ignoredWatchPath reports whether a watched path is hidden or one of our
+// own temporary files.
+func ignoredWatchPath(path string) bool {
+	name := filepath.Base(path)
+	return strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".download") || strings.HasSuffix(name, ".tmp")
+}
+
+// isDownloadPath reports whether path is the target of one of our downloads.
+func (c *Client) isDownloadPath(ctx context.Context, path string) (bool, error) {
+	downloads, err := c.db.GetDownloads(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, d := range downloads {
+		if abs, err := filepath.Abs(d.DownloadPath); err == nil && abs == path {
+			return true, nil
+		}
+	}
+	return false, nil
+}
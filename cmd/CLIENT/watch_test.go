@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	db "torrentium/internal/db"
+)
+
+func TestWatchedFolderFollowsFiles(t *testing.T) {
+	tn := newTestNetwork(t, 1)
+	node := tn.nodes[0]
+	dir := t.TempDir()
+	w, err := node.startWatching(watchConfig{Dirs: []string{dir}, Settle: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(w.stop)
+	ctx := context.Background()
+	sharedCID := func(path string) string {
+		lf, err := node.db.GetLocalFileByPath(ctx, path)
+		if err != nil {
+			return ""
+		}
+		return lf.CID
+	}
+
+	v1 := make([]byte, 100<<10)
+	rand.Read(v1)
+	out := filepath.Join(dir, "build", "out")
+	if err := os.MkdirAll(out, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	path := writeTestFile(t, out, "app.bin", v1)
+	cid1 := rawCID(t, v1)
+	waitFor(t, 10*time.Second, "the new file to be shared", func() bool {
+		return sharedCID(path) == cid1
+	})
+
+	v2 := append(v1, "patched"...)
+	if err := os.WriteFile(path, v2, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cid2 := rawCID(t, v2)
+	waitFor(t, 10*time.Second, "the changed file to be shared", func() bool {
+		return sharedCID(path) == cid2
+	})
+	if _, err := node.db.GetLocalFileByCID(ctx, cid1); err == nil {
+		t.Fatal("previous version is still shared")
+	}
+	if pieces, _ := node.db.GetPieces(ctx, cid1); len(pieces) != 0 {
+		t.Fatalf("previous version left %d pieces behind", len(pieces))
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 10*time.Second, "the deleted file to be unshared", func() bool {
+		_, err := node.db.GetLocalFileByCID(ctx, cid2)
+		return err != nil
+	})
+}
+
+func TestWatchedFileReplacedWithOlderModTime(t *testing.T) {
+	tn := newTestNetwork(t, 1)
+	node := tn.nodes[0]
+	dir := t.TempDir()
+	ctx := context.Background()
+	v1 := make([]byte, 100<<10)
+	rand.Read(v1)
+	path := writeTestFile(t, dir, "app.bin", v1)
+	w, err := node.startWatching(watchConfig{Dirs: []string{dir}, Settle: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(w.stop)
+	shared := func(path string) *db.LocalFile {
+		lf, _ := node.db.GetLocalFileByPath(ctx, path)
+		return lf
+	}
+	cid1 := rawCID(t, v1)
+	waitFor(t, 10*time.Second, "the file to be shared", func() bool {
+		lf := shared(path)
+		return lf != nil && lf.CID == cid1
+	})
+
+	// Same size, older mtime, as left behind by cp -p or rsync -t.
+	v2 := make([]byte, len(v1))
+	rand.Read(v2)
+	if err := os.WriteFile(path, v2, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-24 * time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	cid2 := rawCID(t, v2)
+	waitFor(t, 10*time.Second, "the replaced file to be shared", func() bool {
+		lf := shared(path)
+		return lf != nil && lf.CID == cid2 && lf.ModTime == old.UnixNano()
+	})
+	if _, err := node.db.GetLocalFileByCID(ctx, cid1); err == nil {
+		t.Fatal("previous version is still shared")
+	}
+
+	// Rewriting identical content, as builds do, records the new mtime, so
+	// the next event or restart does not hash the file again.
+	if err := os.WriteFile(path, v2, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 10*time.Second, "the new mtime to be recorded", func() bool {
+		lf := shared(path)
+		return lf != nil && lf.CID == cid2 && lf.ModTime == info.ModTime().UnixNano()
+	})
+}
@@ -4,10 +4,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"torrentium/internal/logging"
+
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/pion/webrtc/v3"
@@ -17,18 +20,60 @@ const (
 	maxICEGatheringTimeout = 15 * time.Second
 	connectionTimeout      = 30 * time.Second
 	keepAliveInterval      = 15 * time.Second
+
+	// Bulk senders wait while more than sendBufferHigh bytes are queued on
+	// the data channel and resume once it drains below sendBufferLow.
+	sendBufferHigh = 1 << 20
+	sendBufferLow  = 256 << 10
+
+	// MaxDataChannels bounds the pool of bulk data channels per peer.
+	MaxDataChannels = 16
+)
+
+var logger = logging.Logger("client")
+
+var defaultSTUNServers = []string{
+	"stun:stun.l.google.com:19302",
+	"stun:stun1.l.google.com:19302",
+	"stun:stun.cloudflare.com:3478",
+}
+
+var (
+	iceMu        sync.RWMutex
+	webrtcConfig = webrtc.Configuration{
+		ICEServers: []webrtc.ICEServer{{URLs: defaultSTUNServers}},
+	}
+	webrtcAPI = webrtc.NewAPI()
 )
 
-var webrtcConfig = webrtc.Configuration{
-	ICEServers: []webrtc.ICEServer{
-		{
-			URLs: []string{
-				"stun:stun.l.google.com:19302",
-				"stun:stun1.l.google.com:19302",
-				"stun:stun.cloudflare.com:3478",
-			},
-		},
-	},
+// ICEConfig controls how new peer connections gather ICE candidates.
+type ICEConfig struct {
+	// STUNServers replaces the default public STUN servers. With an empty
+	// list only host candidates are gathered.
+	STUNServers []string
+	// IncludeLoopback gathers loopback candidates so that peers on the same
+	// machine can connect without any other network interface.
+	IncludeLoopback bool
+}
+
+// ConfigureICE replaces the ICE settings used by peers created afterwards.
+func ConfigureICE(cfg ICEConfig) {
+	se := webrtc.SettingEngine{}
+	se.SetIncludeLoopbackCandidate(cfg.IncludeLoopback)
+
+	iceMu.Lock()
+	defer iceMu.Unlock()
+	webrtcConfig = webrtc.Configuration{}
+	if len(cfg.STUNServers) > 0 {
+		webrtcConfig.ICEServers = []webrtc.ICEServer{{URLs: cfg.STUNServers}}
+	}
+	webrtcAPI = webrtc.NewAPI(webrtc.WithSettingEngine(se))
+}
+
+func newPeerConnection() (*webrtc.PeerConnection, error) {
+	iceMu.RLock()
+	defer iceMu.RUnlock()
+	return webrtcAPI.NewPeerConnection(webrtcConfig)
 }
 
 type ConnectionState int
@@ -42,39 +87,83 @@ const (
 	ConnectionStateClosed
 )
 
+func (s ConnectionState) String() string {
+	switch s {
+	case ConnectionStateNew:
+		return "new"
+	case ConnectionStateConnecting:
+		return "connecting"
+	case ConnectionStateConnected:
+		return "connected"
+	case ConnectionStateDisconnected:
+		return "disconnected"
+	case ConnectionStateFailed:
+		return "failed"
+	case ConnectionStateClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("unknown(%d)", int(s))
+}
+
+// dataChannel is one channel of the bulk data pool.
+type dataChannel struct {
+	dc *webrtc.DataChannel
+	// pion assigns a message its stream sequence number and queues it in two
+	// steps, so concurrent writers on one channel can enqueue messages out of
+	// order and stall the receiver. Writes are serialized per channel.
+	sendMu  sync.Mutex
+	drained chan struct{} // signaled when the channel's buffer drains
+}
+
+func newDataChannel(dc *webrtc.DataChannel) *dataChannel {
+	d := &dataChannel{dc: dc, drained: make(chan struct{}, 1)}
+	dc.SetBufferedAmountLowThreshold(sendBufferLow)
+	dc.OnBufferedAmountLow(func() {
+		select {
+		case d.drained <- struct{}{}:
+		default:
+		}
+	})
+	return d
+}
+
 type SimpleWebRTCPeer struct {
-	ID                peer.ID
-	pc                *webrtc.PeerConnection
-	dc                *webrtc.DataChannel
-	reliableDC        *webrtc.DataChannel
-	onMessage         func(msg webrtc.DataChannelMessage, peer *SimpleWebRTCPeer)
-	onCloseCallback   func(peerID peer.ID)
-	fileWriter        io.WriteCloser
-	writerMutex       sync.RWMutex
-	signalingStream   network.Stream
-	streamMux         sync.RWMutex
-	state             ConnectionState
-	stateMux          sync.RWMutex
-	closeOnce         sync.Once
-	closeCh           chan struct{}
-	keepAliveTick     *time.Ticker
-	reliableDCOpen    chan struct{} // ADDED: To signal when the reliable channel is open
-	dcOpenWg          sync.WaitGroup    // ADDED: To wait for all data channels
+	ID              peer.ID
+	pc              *webrtc.PeerConnection
+	reliableDC      *webrtc.DataChannel
+	offerer         bool
+	data            []*dataChannel // data[0] is "data"; the rest are "data-<n>" added once both sides agree
+	dataMu          sync.RWMutex
+	nextData        atomic.Uint32
+	onMessage       func(msg webrtc.DataChannelMessage, peer *SimpleWebRTCPeer)
+	onCloseCallback func(peerID peer.ID)
+	fileWriter      io.WriteCloser
+	writerMutex     sync.RWMutex
+	signalingStream network.Stream
+	streamMux       sync.RWMutex
+	state           ConnectionState
+	stateMux        sync.RWMutex
+	closeOnce       sync.Once
+	closeCh         chan struct{}
+	keepAliveTick   *time.Ticker
+	reliableDCOpen  chan struct{}  // ADDED: To signal when the reliable channel is open
+	reliableSendMu  sync.Mutex     // see dataChannel.sendMu
+	dcOpenWg        sync.WaitGroup // ADDED: To wait for all data channels
 }
 
 func NewSimpleWebRTCPeer(onMessage func(msg webrtc.DataChannelMessage, peer *SimpleWebRTCPeer), onClose func(peerID peer.ID)) (*SimpleWebRTCPeer, error) {
-	pc, err := webrtc.NewPeerConnection(webrtcConfig)
+	pc, err := newPeerConnection()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create peer connection: %w", err)
 	}
 
 	peer := &SimpleWebRTCPeer{
-		pc:               pc,
-		onMessage:        onMessage,
-		onCloseCallback:  onClose,
-		closeCh:          make(chan struct{}),
-		state:            ConnectionStateNew,
-		reliableDCOpen:   make(chan struct{}), // MODIFIED: Initialize the new channel
+		pc:              pc,
+		onMessage:       onMessage,
+		onCloseCallback: onClose,
+		closeCh:         make(chan struct{}),
+		state:           ConnectionStateNew,
+		reliableDCOpen:  make(chan struct{}), // MODIFIED: Initialize the new channel
 	}
 
 	// MODIFIED: We expect two data channels: "data" and "reliable"
@@ -86,7 +175,7 @@ func NewSimpleWebRTCPeer(onMessage func(msg webrtc.DataChannelMessage, peer *Sim
 
 func (p *SimpleWebRTCPeer) setupConnectionHandlers() {
 	p.pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
-		log.Printf("ICE Connection State changed: %s", state.String())
+		p.logger().Debug("ICE connection state changed", "state", state.String())
 		switch state {
 		case webrtc.ICEConnectionStateConnected:
 			p.setConnectionState(ConnectionStateConnected)
@@ -103,30 +192,50 @@ func (p *SimpleWebRTCPeer) setupConnectionHandlers() {
 	})
 
 	p.pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
-		log.Printf("Connection State changed: %s", state.String())
+		p.logger().Debug("peer connection state changed", "state", state.String())
 		if state == webrtc.PeerConnectionStateFailed {
 			p.Close()
 		}
 	})
 
 	p.pc.OnDataChannel(func(dc *webrtc.DataChannel) {
-		log.Printf("New DataChannel %s", dc.Label())
+		p.logger().Debug("new data channel", "label", dc.Label())
 		if dc.Label() == "reliable" {
 			p.reliableDC = dc
 		} else {
-			p.dc = dc
+			p.addDataChannel(dc)
 		}
 		p.setupDataChannel(dc)
 	})
 }
 
+// addDataChannel adds a bulk data channel to the pool. "data" always comes
+// first; extra channels of the pool are appended in any order.
+func (p *SimpleWebRTCPeer) addDataChannel(dc *webrtc.DataChannel) {
+	p.dataMu.Lock()
+	defer p.dataMu.Unlock()
+	if len(p.data) >= MaxDataChannels {
+		p.logger().Warn("ignoring data channel beyond the pool limit", "label", dc.Label())
+		return
+	}
+	d := newDataChannel(dc)
+	if dc.Label() == "data" {
+		p.data = append([]*dataChannel{d}, p.data...)
+	} else {
+		p.data = append(p.data, d)
+	}
+}
+
 func (p *SimpleWebRTCPeer) setupDataChannel(dc *webrtc.DataChannel) {
 	dc.OnOpen(func() {
-		log.Printf("Data channel '%s' opened", dc.Label())
+		p.logger().Debug("data channel opened", "label", dc.Label())
 		p.setConnectionState(ConnectionStateConnected)
 
-		// MODIFIED: Signal that this data channel is open
-		p.dcOpenWg.Done()
+		// MODIFIED: Signal that this data channel is open. Pool channels
+		// opened later are not waited for.
+		if dc.Label() == "data" || dc.Label() == "reliable" {
+			p.dcOpenWg.Done()
+		}
 
 		if dc.Label() == "reliable" {
 			// MODIFIED: Specifically signal that the reliable channel is open
@@ -135,7 +244,7 @@ func (p *SimpleWebRTCPeer) setupDataChannel(dc *webrtc.DataChannel) {
 	})
 
 	dc.OnClose(func() {
-		log.Printf("Data channel '%s' closed", dc.Label())
+		p.logger().Debug("data channel closed", "label", dc.Label())
 		p.setConnectionState(ConnectionStateClosed)
 	})
 
@@ -145,21 +254,19 @@ func (p *SimpleWebRTCPeer) setupDataChannel(dc *webrtc.DataChannel) {
 }
 
 func (p *SimpleWebRTCPeer) CreateOffer() (string, error) {
-	// Create the unreliable data channel for file chunks
-	dc, err := p.pc.CreateDataChannel("data", nil)
+	// Both channels are ordered and fully reliable: SCTP retransmits lost
+	// packets, so the application never has to. Bulk piece data goes over
+	// "data" so that it does not hold up control messages on "reliable".
+	p.offerer = true
+	ordered := true
+	dc, err := p.pc.CreateDataChannel("data", &webrtc.DataChannelInit{Ordered: &ordered})
 	if err != nil {
 		return "", fmt.Errorf("failed to create data channel: %w", err)
 	}
-	p.dc = dc
-	p.setupDataChannel(p.dc)
+	p.addDataChannel(dc)
+	p.setupDataChannel(dc)
 
-	// Create the reliable data channel for control messages
-	ordered := true
-	maxRetransmits := uint16(5)
-	reliableDC, err := p.pc.CreateDataChannel("reliable", &webrtc.DataChannelInit{
-		Ordered:        &ordered,
-		MaxRetransmits: &maxRetransmits,
-	})
+	reliableDC, err := p.pc.CreateDataChannel("reliable", &webrtc.DataChannelInit{Ordered: &ordered})
 	if err != nil {
 		return "", fmt.Errorf("failed to create reliable data channel: %w", err)
 	}
@@ -180,7 +287,7 @@ func (p *SimpleWebRTCPeer) CreateOffer() (string, error) {
 	select {
 	case <-gatherComplete:
 	case <-time.After(maxICEGatheringTimeout):
-		log.Println("ICE gathering timed out")
+		p.logger().Warn("ICE gathering timed out")
 	}
 
 	offerJSON, err := json.Marshal(p.pc.LocalDescription())
@@ -214,7 +321,7 @@ func (p *SimpleWebRTCPeer) HandleOffer(offerStr string) (string, error) {
 	select {
 	case <-gatherComplete:
 	case <-time.After(maxICEGatheringTimeout):
-		log.Println("ICE gathering timed out")
+		p.logger().Warn("ICE gathering timed out")
 	}
 
 	answerJSON, err := json.Marshal(p.pc.LocalDescription())
@@ -233,15 +340,95 @@ func (p *SimpleWebRTCPeer) HandleAnswer(answerStr string) error {
 	return p.pc.SetRemoteDescription(answer)
 }
 
+// SendJSON sends v on the first data channel.
 func (p *SimpleWebRTCPeer) SendJSON(v interface{}) error {
-	if p.dc == nil || p.dc.ReadyState() != webrtc.DataChannelStateOpen {
-		return fmt.Errorf("data channel is not open")
-	}
+	return p.SendJSONOn(0, v)
+}
+
+// SendJSONOn sends v on data channel ch of the pool.
+func (p *SimpleWebRTCPeer) SendJSONOn(ch int, v interface{}) error {
 	data, err := json.Marshal(v)
 	if err != nil {
 		return err
 	}
-	return p.dc.SendText(string(data))
+	return p.send(ch, func(dc *webrtc.DataChannel) error { return dc.SendText(string(data)) })
+}
+
+func (p *SimpleWebRTCPeer) send(ch int, write func(*webrtc.DataChannel) error) error {
+	d := p.dataChannel(ch)
+	if d == nil || d.dc.ReadyState() != webrtc.DataChannelStateOpen {
+		return fmt.Errorf("data channel %d is not open", ch)
+	}
+	d.sendMu.Lock()
+	defer d.sendMu.Unlock()
+	return write(d.dc)
+}
+
+func (p *SimpleWebRTCPeer) dataChannel(ch int) *dataChannel {
+	p.dataMu.RLock()
+	defer p.dataMu.RUnlock()
+	if ch < 0 || ch >= len(p.data) {
+		return nil
+	}
+	return p.data[ch]
+}
+
+// NextDataChannel picks the data channel for the next piece, going round
+// the open channels of the pool. All chunks of a piece must be sent on the
+// same channel so that they arrive in order.
+func (p *SimpleWebRTCPeer) NextDataChannel() int {
+	p.dataMu.RLock()
+	defer p.dataMu.RUnlock()
+	n := len(p.data)
+	if n == 0 {
+		return 0
+	}
+	start := int(p.nextData.Add(1)) % n
+	for i := 0; i < n; i++ {
+		ch := (start + i) % n
+		if p.data[ch].dc.ReadyState() == webrtc.DataChannelStateOpen {
+			return ch
+		}
+	}
+	return 0
+}
+
+// DataChannels returns the number of open data channels.
+func (p *SimpleWebRTCPeer) DataChannels() int {
+	p.dataMu.RLock()
+	defer p.dataMu.RUnlock()
+	n := 0
+	for _, d := range p.data {
+		if d.dc.ReadyState() == webrtc.DataChannelStateOpen {
+			n++
+		}
+	}
+	return n
+}
+
+// IsOfferer reports whether we created the offer of this connection. Only
+// the offerer opens extra data channels, so that both sides never do.
+func (p *SimpleWebRTCPeer) IsOfferer() bool {
+	return p.offerer
+}
+
+// GrowDataChannels opens data channels until the pool has n of them. The
+// SCTP association is already up, so no renegotiation is needed.
+func (p *SimpleWebRTCPeer) GrowDataChannels(n int) error {
+	n = min(n, MaxDataChannels)
+	p.dataMu.RLock()
+	have := len(p.data)
+	p.dataMu.RUnlock()
+	ordered := true
+	for i := have; i < n; i++ {
+		dc, err := p.pc.CreateDataChannel(fmt.Sprintf("data-%d", i), &webrtc.DataChannelInit{Ordered: &ordered})
+		if err != nil {
+			return fmt.Errorf("failed to create data channel: %w", err)
+		}
+		p.addDataChannel(dc)
+		p.setupDataChannel(dc)
+	}
+	return nil
 }
 
 // MODIFIED: SendJSONReliable now waits for the channel to be ready
@@ -262,32 +449,56 @@ func (p *SimpleWebRTCPeer) SendJSONReliable(v interface{}) error {
 	if err != nil {
 		return err
 	}
+	p.reliableSendMu.Lock()
+	defer p.reliableSendMu.Unlock()
 	return p.reliableDC.SendText(string(data))
 }
 
-func (p *SimpleWebRTCPeer) SendRaw(data []byte) error {
-	if p.dc == nil || p.dc.ReadyState() != webrtc.DataChannelStateOpen {
-		return fmt.Errorf("data channel is not open")
+// WaitSendBuffer blocks while data channel ch has too much data queued, so
+// that bulk senders are paced by what the connection actually carries.
+func (p *SimpleWebRTCPeer) WaitSendBuffer(ch int) error {
+	d := p.dataChannel(ch)
+	for d != nil && d.dc.BufferedAmount() > sendBufferHigh {
+		select {
+		case <-d.drained:
+		case <-p.closeCh:
+			return fmt.Errorf("connection closed while waiting for the send buffer")
+		}
 	}
-	return p.dc.Send(data)
+	return nil
+}
+
+func (p *SimpleWebRTCPeer) SendRaw(data []byte) error {
+	return p.send(0, func(dc *webrtc.DataChannel) error { return dc.Send(data) })
 }
 
 func (p *SimpleWebRTCPeer) Close() {
 	p.closeOnce.Do(func() {
-		if p.onCloseCallback != nil && p.signalingStream != nil {
-			p.onCloseCallback(p.signalingStream.Conn().RemotePeer())
+		s := p.GetSignalingStream()
+		if p.onCloseCallback != nil && s != nil {
+			p.onCloseCallback(s.Conn().RemotePeer())
 		}
+		p.stateMux.Lock()
 		p.stopKeepAlive()
+		p.stateMux.Unlock()
 		if p.pc != nil {
 			p.pc.Close()
 		}
-		if s := p.GetSignalingStream(); s != nil {
+		if s != nil {
 			s.Close()
 		}
 		close(p.closeCh)
 	})
 }
 
+// logger returns the package logger annotated with the remote peer, once known.
+func (p *SimpleWebRTCPeer) logger() *slog.Logger {
+	if s := p.GetSignalingStream(); s != nil {
+		return logger.With(logging.KeyPeer, s.Conn().RemotePeer())
+	}
+	return logger
+}
+
 func (p *SimpleWebRTCPeer) SetFileWriter(w io.WriteCloser) {
 	p.writerMutex.Lock()
 	defer p.writerMutex.Unlock()
@@ -360,7 +571,7 @@ func (p *SimpleWebRTCPeer) setConnectionState(state ConnectionState) {
 	}
 
 	p.state = state
-	log.Printf("Connection state changed to: %d", state)
+	p.logger().Debug("connection state changed", "state", state.String())
 
 	if state == ConnectionStateConnected {
 		p.startKeepAlive()
@@ -375,17 +586,19 @@ func (p *SimpleWebRTCPeer) GetConnectionState() ConnectionState {
 	return p.state
 }
 
+// startKeepAlive and stopKeepAlive must be called with stateMux held.
 func (p *SimpleWebRTCPeer) startKeepAlive() {
 	if p.keepAliveTick != nil {
 		return
 	}
-	p.keepAliveTick = time.NewTicker(keepAliveInterval)
+	ticker := time.NewTicker(keepAliveInterval)
+	p.keepAliveTick = ticker
 	go func() {
 		for {
 			select {
-			case <-p.keepAliveTick.C:
+			case <-ticker.C:
 				if err := p.SendJSON(map[string]string{"type": "ping"}); err != nil {
-					log.Printf("Failed to send keepalive: %v", err)
+					p.logger().Debug("failed to send keepalive", logging.KeyErr, err)
 				}
 			case <-p.closeCh:
 				return
@@ -401,17 +614,22 @@ func (p *SimpleWebRTCPeer) stopKeepAlive() {
 	}
 }
 
+// ReliableOpen is closed once the reliable data channel is open.
+func (p *SimpleWebRTCPeer) ReliableOpen() <-chan struct{} {
+	return p.reliableDCOpen
+}
+
 func (p *SimpleWebRTCPeer) WaitForCloseChannel() <-chan struct{} {
 	return p.closeCh
 }
 
 func (p *SimpleWebRTCPeer) SignalDownloadComplete() {
-	log.Printf("Download completed, closing connection")
+	p.logger().Debug("download completed, closing connection")
 	p.Close()
 }
 
 func TestICEConnectivity() error {
-	pc, err := webrtc.NewPeerConnection(webrtcConfig)
+	pc, err := newPeerConnection()
 	if err != nil {
 		return fmt.Errorf("failed to create test connection: %w", err)
 	}
@@ -423,7 +641,7 @@ func TestICEConnectivity() error {
 	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
 		if candidate != nil {
 			candidateCount++
-			log.Printf("Test ICE candidate: %s", candidate.String())
+			logger.Debug("test ICE candidate", "candidate", candidate.String())
 		}
 	})
 
@@ -456,7 +674,7 @@ func TestICEConnectivity() error {
 		if candidateCount == 0 {
 			return fmt.Errorf("ICE gathering timeout - no candidates generated")
 		}
-		log.Printf("ICE gathering timed out with %d candidates", candidateCount)
+		logger.Warn("ICE gathering timed out", "candidates", candidateCount)
 		return nil
 	}
 }
\ No newline at end of file
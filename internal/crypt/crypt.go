@@ -0,0 +1,200 @@
+// Package crypt encrypts shared files so that only holders of the share key
+// can read them. Seeders and the DHT only ever see ciphertext.
+//
+// A file is encrypted with AES-256-GCM in segments of SegmentSize bytes:
+//
+//	magic (8) | nonce prefix (7) | segment 0 | segment 1 | ... | final segment
+//
+// Segment i is sealed with the nonce prefix || i (4 bytes, big endian) || last
+// (1 byte, 1 for the final segment), so segments cannot be reordered, dropped
+// or truncated without decryption failing.
+package crypt
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	KeySize     = 32
+	SegmentSize = 64 * 1024
+
+	magic        = "TRNTENC1"
+	prefixSize   = 7
+	tagSize      = 16
+	sealedSegLen = SegmentSize + tagSize
+)
+
+// ErrDecrypt is returned when the key is wrong or the ciphertext was modified.
+var ErrDecrypt = errors.New("decryption failed: wrong key or corrupted data")
+
+// NewKey returns a random file key.
+func NewKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// EncodeKey returns the text form of a key used in share links.
+func EncodeKey(key []byte) string {
+	return base64.RawURLEncoding.EncodeToString(key)
+}
+
+// DecodeKey parses a key produced by EncodeKey.
+func DecodeKey(s string) ([]byte, error) {
+	key, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(key) != KeySize {
+		return nil, fmt.Errorf("invalid share key")
+	}
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("key must be %d bytes", KeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func segmentNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[prefixSize:], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// Encrypt reads plaintext from src and writes the encrypted stream to dst.
+func Encrypt(dst io.Writer, src io.Reader, key []byte) error {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	prefix := make([]byte, prefixSize)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(dst, magic); err != nil {
+		return err
+	}
+	if _, err := dst.Write(prefix); err != nil {
+		return err
+	}
+
+	r := bufio.NewReaderSize(src, SegmentSize)
+	buf := make([]byte, SegmentSize)
+	out := make([]byte, 0, sealedSegLen)
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := n < SegmentSize
+		if !last {
+			// A full segment is the last one only if nothing follows it.
+			if _, err := r.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return err
+			}
+		}
+		out = aead.Seal(out[:0], segmentNonce(prefix, counter, last), buf[:n], nil)
+		if _, err := dst.Write(out); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+		if counter == math.MaxUint32 {
+			return errors.New("file too large to encrypt")
+		}
+	}
+}
+
+// Decrypt reads an encrypted stream from src and writes the plaintext to dst.
+// It returns ErrDecrypt if the key is wrong or the stream was tampered with.
+func Decrypt(dst io.Writer, src io.Reader, key []byte) error {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, len(magic)+prefixSize)
+	if _, err := io.ReadFull(src, header); err != nil || string(header[:len(magic)]) != magic {
+		return fmt.Errorf("not an encrypted share")
+	}
+	prefix := header[len(magic):]
+
+	r := bufio.NewReaderSize(src, sealedSegLen)
+	buf := make([]byte, sealedSegLen)
+	out := make([]byte, 0, SegmentSize)
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := n < sealedSegLen
+		if !last {
+			if _, err := r.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return err
+			}
+		}
+		out, err = aead.Open(out[:0], segmentNonce(prefix, counter, last), buf[:n], nil)
+		if err != nil {
+			return ErrDecrypt
+		}
+		if _, err := dst.Write(out); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// SealName encrypts a filename for inclusion in a manifest.
+func SealName(key []byte, name string) (string, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(name), []byte(magic))), nil
+}
+
+// OpenName decrypts a filename sealed with SealName.
+func OpenName(key []byte, sealed string) (string, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil || len(data) < aead.NonceSize() {
+		return "", ErrDecrypt
+	}
+	name, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(magic))
+	if err != nil {
+		return "", ErrDecrypt
+	}
+	return string(name), nil
+}
@@ -0,0 +1,90 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+func encrypt(t *testing.T, key, plain []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := Encrypt(&buf, bytes.NewReader(plain), key); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	key, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 1, SegmentSize - 1, SegmentSize, SegmentSize + 1, 3*SegmentSize + 17} {
+		plain := make([]byte, size)
+		if _, err := io.ReadFull(rand.Reader, plain); err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		if err := Decrypt(&out, bytes.NewReader(encrypt(t, key, plain)), key); err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(out.Bytes(), plain) {
+			t.Fatalf("size %d: plaintext mismatch", size)
+		}
+	}
+}
+
+func TestDecryptRejectsTampering(t *testing.T) {
+	key, _ := NewKey()
+	other, _ := NewKey()
+	plain := bytes.Repeat([]byte("confidential build "), SegmentSize/8)
+	sealed := encrypt(t, key, plain)
+
+	flipped := append([]byte(nil), sealed...)
+	flipped[len(flipped)/2] ^= 1
+
+	cases := map[string]struct {
+		data []byte
+		key  []byte
+	}{
+		"wrong key": {sealed, other},
+		"modified":  {flipped, key},
+		// Dropping the final segment must not decrypt to a shorter file.
+		"truncated": {sealed[:len(magic)+prefixSize+sealedSegLen], key},
+	}
+	for name, tc := range cases {
+		err := Decrypt(io.Discard, bytes.NewReader(tc.data), tc.key)
+		if !errors.Is(err, ErrDecrypt) {
+			t.Errorf("%s: err = %v, want ErrDecrypt", name, err)
+		}
+	}
+}
+
+func TestSealName(t *testing.T) {
+	key, _ := NewKey()
+	sealed, err := SealName(key, "release-v2.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, err := OpenName(key, sealed); err != nil || name != "release-v2.tar.gz" {
+		t.Fatalf("OpenName = %q, %v", name, err)
+	}
+	other, _ := NewKey()
+	if _, err := OpenName(other, sealed); !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("OpenName with wrong key: err = %v", err)
+	}
+}
+
+func TestKeyEncoding(t *testing.T) {
+	key, _ := NewKey()
+	got, err := DecodeKey(EncodeKey(key))
+	if err != nil || !bytes.Equal(got, key) {
+		t.Fatalf("DecodeKey(EncodeKey(k)) = %x, %v", got, err)
+	}
+	if _, err := DecodeKey("too-short"); err == nil {
+		t.Fatal("expected error for short key")
+	}
+}
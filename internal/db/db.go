@@ -5,10 +5,11 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"log"
 	"os"
 	"time"
 
+	"torrentium/internal/logging"
+
 	"github.com/google/uuid"
 	"github.com/joho/godotenv"
 	_ "github.com/mattn/go-sqlite3"
@@ -22,6 +23,12 @@ type LocalFile struct {
 	FilePath  string
 	FileHash  string
 	CreatedAt time.Time
+	ShareKey  string // encoded key of an encrypted share; empty for plain files
+	PieceSize int64  // size of every piece but the last; 0 for files added before it was recorded
+	// Restricted shares are served only to the peers on their allowlist, and
+	// to nobody once the allowlist is empty.
+	Restricted bool
+	ModTime    int64 // modification time of the file when it was hashed, in Unix nanoseconds; 0 if unknown
 }
 
 type Download struct {
@@ -32,8 +39,17 @@ type Download struct {
 	DownloadPath string
 	DownloadedAt time.Time
 	Status       string
+	Pinned       bool
+	LastAccessed time.Time
+	FileHash     string
 }
 
+// Download statuses stored in the downloads table.
+const (
+	DownloadStatusDownloading = "downloading"
+	DownloadStatusCompleted   = "completed"
+)
+
 // Piece tracks chunked pieces for resume and verification
 type Piece struct {
 	ID        string
@@ -46,6 +62,25 @@ type Piece struct {
 	UpdatedAt time.Time
 }
 
+// Seed tracks a completed download that is being shared back to the swarm.
+// Zero limits mean the file is seeded indefinitely.
+type Seed struct {
+	CID           string
+	UploadedBytes int64
+	StartedAt     time.Time
+	MaxRatio      float64
+	MaxSeconds    int64
+}
+
+// PublishedName is a name this node points at a CID. Seq is the sequence
+// number of the last record published for it.
+type PublishedName struct {
+	Name        string
+	CID         string
+	Seq         uint64
+	PublishedAt time.Time
+}
+
 // PeerScore stores reputation
 type PeerScore struct {
 	PeerID string
@@ -53,6 +88,21 @@ type PeerScore struct {
 	SeenAt time.Time
 }
 
+// Peer rules: blocked peers are refused, trusted peers are never banned
+// automatically.
+const (
+	PeerRuleBlock = "block"
+	PeerRuleTrust = "trust"
+)
+
+// PeerRule is a persistent block or trust decision about a peer.
+type PeerRule struct {
+	PeerID    string
+	Rule      string
+	Reason    string
+	CreatedAt time.Time
+}
+
 type Repository struct {
 	DB *sql.DB
 }
@@ -61,27 +111,51 @@ func NewRepository(db *sql.DB) *Repository { return &Repository{DB: db} }
 
 var DB *sql.DB
 
+var logger = logging.Logger("db")
+
 func InitDB() *sql.DB {
 	if err := godotenv.Load(); err != nil {
-		log.Printf("Warning: Could not load .env file: %v", err)
+		logger.Warn("could not load .env file", logging.KeyErr, err)
 	}
 	dbpath := os.Getenv("SQLITE_DB_PATH")
 	if dbpath == "" {
 		dbpath = "./peer.db"
 	}
 	var err error
-	DB, err = sql.Open("sqlite3", dbpath)
+	DB, err = Open(dbpath)
 	if err != nil {
-		log.Fatalf("Error creating DB connection: %v", err)
+		fatal("error opening peer database", err)
 	}
-	if err = DB.Ping(); err != nil {
-		log.Fatalf("Error connecting to DB: %v", err)
+	logger.Info("connected to peer database", "path", dbpath)
+	return DB
+}
+
+// Open opens the SQLite database at dsn and brings its schema up to date.
+// dsn may be any go-sqlite3 data source, e.g. "file:node1?mode=memory&cache=shared"
+// for an in-memory database.
+func Open(dsn string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("error creating DB connection: %w", err)
 	}
-	if err := createTables(DB); err != nil {
-		log.Fatalf("Error creating tables: %v", err)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error connecting to DB: %w", err)
 	}
-	log.Println("Successfully connected to peer database")
-	return DB
+	if err := createTables(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating tables: %w", err)
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error migrating tables: %w", err)
+	}
+	return db, nil
+}
+
+func fatal(msg string, err error) {
+	logger.Error(msg, logging.KeyErr, err)
+	os.Exit(1)
 }
 
 func createTables(db *sql.DB) error {
@@ -121,12 +195,36 @@ func createTables(db *sql.DB) error {
 			score REAL NOT NULL,
 			seen_at DATETIME DEFAULT CURRENT_TIMESTAMP
 		);`,
+		`CREATE TABLE IF NOT EXISTS peer_rules (
+			peer_id TEXT PRIMARY KEY,
+			rule TEXT NOT NULL,
+			reason TEXT NOT NULL DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);`,
+		`CREATE TABLE IF NOT EXISTS seeds (
+			cid TEXT PRIMARY KEY,
+			uploaded_bytes INTEGER NOT NULL DEFAULT 0,
+			started_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			max_ratio REAL NOT NULL DEFAULT 0,
+			max_seconds INTEGER NOT NULL DEFAULT 0
+		);`,
+		`CREATE TABLE IF NOT EXISTS share_acl (
+			cid TEXT NOT NULL,
+			peer_id TEXT NOT NULL,
+			PRIMARY KEY (cid, peer_id)
+		);`,
 		`CREATE TABLE IF NOT EXISTS metadata_index (
 			cid TEXT PRIMARY KEY,
 			filename TEXT NOT NULL,
 			file_size INTEGER NOT NULL,
 			file_hash TEXT NOT NULL
 		);`,
+		`CREATE TABLE IF NOT EXISTS published_names (
+			name TEXT PRIMARY KEY,
+			cid TEXT NOT NULL,
+			seq INTEGER NOT NULL,
+			published_at DATETIME NOT NULL
+		);`,
 	}
 	for _, s := range stmts {
 		if _, err := db.Exec(s); err != nil {
@@ -136,11 +234,50 @@ func createTables(db *sql.DB) error {
 	return nil
 }
 
-func (r *Repository) AddLocalFile(ctx context.Context, cid, filename string, fileSize int64, filePath, fileHash string) error {
-	q := `INSERT INTO local_files (id, cid, filename, file_size, file_path, file_hash, created_at)
-	      VALUES (?, ?, ?, ?, ?, ?, ?)
-	      ON CONFLICT(cid) DO UPDATE SET filename=excluded.filename, file_path=excluded.file_path, file_size=excluded.file_size, file_hash=excluded.file_hash`
-	_, err := r.DB.ExecContext(ctx, q, uuid.New().String(), cid, filename, fileSize, filePath, fileHash, time.Now())
+// migrations add columns introduced after the first schema. The number of
+// migrations applied to a database is kept in its user_version, so each runs
+// exactly once; new migrations are only ever appended.
+var migrations = []string{
+	`ALTER TABLE downloads ADD COLUMN pinned INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE downloads ADD COLUMN last_accessed DATETIME`,
+	`ALTER TABLE downloads ADD COLUMN file_hash TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE local_files ADD COLUMN share_key TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE local_files ADD COLUMN piece_size INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE local_files ADD COLUMN restricted INTEGER NOT NULL DEFAULT 0`,
+	`UPDATE local_files SET restricted=1 WHERE cid IN (SELECT cid FROM share_acl)`,
+	`ALTER TABLE local_files ADD COLUMN mod_time INTEGER NOT NULL DEFAULT 0`,
+}
+
+func migrate(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var version int
+	if err := tx.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+	if version >= len(migrations) {
+		return nil
+	}
+	for i, s := range migrations[version:] {
+		if _, err := tx.Exec(s); err != nil {
+			return fmt.Errorf("migration %d: %w", version+i+1, err)
+		}
+	}
+	// PRAGMA does not take bound parameters.
+	if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, len(migrations))); err != nil {
+		return fmt.Errorf("failed to store schema version: %w", err)
+	}
+	return tx.Commit()
+}
+
+func (r *Repository) AddLocalFile(ctx context.Context, cid, filename string, fileSize int64, filePath, fileHash string, pieceSize int64) error {
+	q := `INSERT INTO local_files (id, cid, filename, file_size, file_path, file_hash, created_at, piece_size)
+	      VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	      ON CONFLICT(cid) DO UPDATE SET filename=excluded.filename, file_path=excluded.file_path, file_size=excluded.file_size, file_hash=excluded.file_hash, piece_size=excluded.piece_size`
+	_, err := r.DB.ExecContext(ctx, q, uuid.New().String(), cid, filename, fileSize, filePath, fileHash, time.Now(), pieceSize)
 	if err != nil {
 		return err
 	}
@@ -152,8 +289,10 @@ func (r *Repository) AddLocalFile(ctx context.Context, cid, filename string, fil
 	return nil
 }
 
+const localFileColumns = `id, cid, filename, file_size, file_path, file_hash, created_at, share_key, piece_size, restricted, mod_time`
+
 func (r *Repository) GetLocalFiles(ctx context.Context) ([]LocalFile, error) {
-	rows, err := r.DB.QueryContext(ctx, `SELECT id, cid, filename, file_size, file_path, file_hash, created_at FROM local_files ORDER BY created_at DESC`)
+	rows, err := r.DB.QueryContext(ctx, `SELECT `+localFileColumns+` FROM local_files ORDER BY created_at DESC`)
 	if err != nil {
 		return nil, err
 	}
@@ -161,7 +300,7 @@ func (r *Repository) GetLocalFiles(ctx context.Context) ([]LocalFile, error) {
 	var files []LocalFile
 	for rows.Next() {
 		var f LocalFile
-		if err := rows.Scan(&f.ID, &f.CID, &f.Filename, &f.FileSize, &f.FilePath, &f.FileHash, &f.CreatedAt); err != nil {
+		if err := rows.Scan(&f.ID, &f.CID, &f.Filename, &f.FileSize, &f.FilePath, &f.FileHash, &f.CreatedAt, &f.ShareKey, &f.PieceSize, &f.Restricted, &f.ModTime); err != nil {
 			return nil, err
 		}
 		files = append(files, f)
@@ -171,34 +310,196 @@ func (r *Repository) GetLocalFiles(ctx context.Context) ([]LocalFile, error) {
 
 func (r *Repository) GetLocalFileByCID(ctx context.Context, cid string) (*LocalFile, error) {
 	var f LocalFile
-	err := r.DB.QueryRowContext(ctx, `SELECT id, cid, filename, file_size, file_path, file_hash, created_at FROM local_files WHERE cid = ?`, cid).
-		Scan(&f.ID, &f.CID, &f.Filename, &f.FileSize, &f.FilePath, &f.FileHash, &f.CreatedAt)
+	err := r.DB.QueryRowContext(ctx, `SELECT `+localFileColumns+` FROM local_files WHERE cid = ?`, cid).
+		Scan(&f.ID, &f.CID, &f.Filename, &f.FileSize, &f.FilePath, &f.FileHash, &f.CreatedAt, &f.ShareKey, &f.PieceSize, &f.Restricted, &f.ModTime)
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// GetLocalFileByPath returns the most recently added shared file at path.
+func (r *Repository) GetLocalFileByPath(ctx context.Context, path string) (*LocalFile, error) {
+	var f LocalFile
+	err := r.DB.QueryRowContext(ctx, `SELECT `+localFileColumns+` FROM local_files WHERE file_path = ? ORDER BY created_at DESC LIMIT 1`, path).
+		Scan(&f.ID, &f.CID, &f.Filename, &f.FileSize, &f.FilePath, &f.FileHash, &f.CreatedAt, &f.ShareKey, &f.PieceSize, &f.Restricted, &f.ModTime)
 	if err != nil {
 		return nil, err
 	}
 	return &f, nil
 }
 
+// SetShareKey marks a shared file as encrypted with the given encoded key.
+func (r *Repository) SetShareKey(ctx context.Context, cid, key string) error {
+	_, err := r.DB.ExecContext(ctx, `UPDATE local_files SET share_key=? WHERE cid=?`, key, cid)
+	return err
+}
+
+// SetFileModTime records the modification time the file of cid had when it
+// was hashed.
+func (r *Repository) SetFileModTime(ctx context.Context, cid string, modTime int64) error {
+	_, err := r.DB.ExecContext(ctx, `UPDATE local_files SET mod_time=? WHERE cid=?`, modTime, cid)
+	return err
+}
+
 func (r *Repository) DeleteLocalFile(ctx context.Context, cid string) error {
 	_, err := r.DB.ExecContext(ctx, `DELETE FROM local_files WHERE cid=?`, cid)
 	return err
 }
 
+// DeleteShare forgets that cid is shared: its file entry, search index
+// entry, allowlist and seed record, and its pieces unless a download of it
+// is still in progress.
+func (r *Repository) DeleteShare(ctx context.Context, cid string) error {
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, q := range []string{
+		`DELETE FROM local_files WHERE cid=?`,
+		`DELETE FROM metadata_index WHERE cid=?`,
+		`DELETE FROM share_acl WHERE cid=?`,
+		`DELETE FROM seeds WHERE cid=?`,
+	} {
+		if _, err := tx.ExecContext(ctx, q, cid); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM pieces WHERE cid=? AND NOT EXISTS
+		(SELECT 1 FROM downloads WHERE cid=? AND status=?)`, cid, cid, DownloadStatusDownloading); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 func (r *Repository) AddDownload(ctx context.Context, cid, filename string, fileSize int64, downloadPath string) error {
-	_, err := r.DB.ExecContext(ctx, `INSERT INTO downloads (id, cid, filename, file_size, download_path, downloaded_at, status)
-		VALUES (?, ?, ?, ?, ?, ?, 'completed') ON CONFLICT(cid) DO UPDATE SET status='completed', downloaded_at=excluded.downloaded_at, download_path=excluded.download_path`,
-		uuid.New().String(), cid, filename, fileSize, downloadPath, time.Now())
+	now := time.Now()
+	_, err := r.DB.ExecContext(ctx, `INSERT INTO downloads (id, cid, filename, file_size, download_path, downloaded_at, status, last_accessed)
+		VALUES (?, ?, ?, ?, ?, ?, 'completed', ?) ON CONFLICT(cid) DO UPDATE SET status='completed', file_size=excluded.file_size, downloaded_at=excluded.downloaded_at, download_path=excluded.download_path, last_accessed=excluded.last_accessed`,
+		uuid.New().String(), cid, filename, fileSize, downloadPath, now, now)
+	return err
+}
+
+// StartDownload records a download that is still in progress so that its
+// pieces are not treated as orphaned and its size counts against the quota.
+func (r *Repository) StartDownload(ctx context.Context, cid, filename string, fileSize int64, downloadPath, fileHash string) error {
+	now := time.Now()
+	_, err := r.DB.ExecContext(ctx, `INSERT INTO downloads (id, cid, filename, file_size, download_path, downloaded_at, status, last_accessed, file_hash)
+		VALUES (?, ?, ?, ?, ?, ?, 'downloading', ?, ?) ON CONFLICT(cid) DO UPDATE SET status='downloading', download_path=excluded.download_path, last_accessed=excluded.last_accessed, file_hash=excluded.file_hash`,
+		uuid.New().String(), cid, filename, fileSize, downloadPath, now, now, fileHash)
+	return err
+}
+
+const downloadColumns = `id, cid, filename, file_size, download_path, downloaded_at, status, pinned, last_accessed, file_hash`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanDownload(row rowScanner) (*Download, error) {
+	var d Download
+	var pinnedInt int
+	var lastAccessed sql.NullTime
+	if err := row.Scan(&d.ID, &d.CID, &d.Filename, &d.FileSize, &d.DownloadPath, &d.DownloadedAt, &d.Status, &pinnedInt, &lastAccessed, &d.FileHash); err != nil {
+		return nil, err
+	}
+	d.Pinned = pinnedInt == 1
+	d.LastAccessed = d.DownloadedAt
+	if lastAccessed.Valid {
+		d.LastAccessed = lastAccessed.Time
+	}
+	return &d, nil
+}
+
+func (r *Repository) GetDownloadByCID(ctx context.Context, cid string) (*Download, error) {
+	return scanDownload(r.DB.QueryRowContext(ctx, `SELECT `+downloadColumns+` FROM downloads WHERE cid = ?`, cid))
+}
+
+// GetDownloads returns all downloads, least recently accessed first.
+func (r *Repository) GetDownloads(ctx context.Context) ([]Download, error) {
+	rows, err := r.DB.QueryContext(ctx, `SELECT `+downloadColumns+`
+		FROM downloads ORDER BY COALESCE(last_accessed, downloaded_at) ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Download
+	for rows.Next() {
+		d, err := scanDownload(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *d)
+	}
+	return out, rows.Err()
+}
+
+// SetDownloadPinned marks a download as pinned (never evicted) or unpinned.
+func (r *Repository) SetDownloadPinned(ctx context.Context, cid string, pinned bool) error {
+	res, err := r.DB.ExecContext(ctx, `UPDATE downloads SET pinned=? WHERE cid=?`, boolToInt(pinned), cid)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// TouchDownload bumps the last access time used for LRU eviction.
+func (r *Repository) TouchDownload(ctx context.Context, cid string) error {
+	_, err := r.DB.ExecContext(ctx, `UPDATE downloads SET last_accessed=? WHERE cid=?`, time.Now(), cid)
+	return err
+}
+
+func (r *Repository) DeleteDownload(ctx context.Context, cid string) error {
+	_, err := r.DB.ExecContext(ctx, `DELETE FROM downloads WHERE cid=?`, cid)
 	return err
 }
 
+// DownloadsSize returns the total size of all recorded downloads in bytes.
+func (r *Repository) DownloadsSize(ctx context.Context) (int64, error) {
+	var total int64
+	err := r.DB.QueryRowContext(ctx, `SELECT COALESCE(SUM(file_size), 0) FROM downloads`).Scan(&total)
+	return total, err
+}
+
 func (r *Repository) UpsertPiece(ctx context.Context, cid string, idx int64, offset, size int64, hash string, have bool) error {
 	_, err := r.DB.ExecContext(ctx, `INSERT INTO pieces (id, cid, idx, offset, size, hash, have, updated_at)
 		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
-		ON CONFLICT(cid, idx) DO UPDATE SET have=excluded.have, updated_at=excluded.updated_at`,
+		ON CONFLICT(cid, idx) DO UPDATE SET offset=excluded.offset, size=excluded.size, hash=excluded.hash, have=excluded.have, updated_at=excluded.updated_at`,
 		uuid.New().String(), cid, idx, offset, size, hash, boolToInt(have), time.Now())
 	return err
 }
 
+// AddPieces replaces the pieces of cid in a single transaction, so that either
+// all of them are recorded or none. Pieces left from an earlier layout, such
+// as a different piece size, are dropped.
+func (r *Repository) AddPieces(ctx context.Context, cid string, pieces []Piece, have bool) error {
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `DELETE FROM pieces WHERE cid=?`, cid); err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO pieces (id, cid, idx, offset, size, hash, have, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	now := time.Now()
+	for _, p := range pieces {
+		if _, err := stmt.ExecContext(ctx, uuid.New().String(), cid, p.Index, p.Offset, p.Size, p.Hash, boolToInt(have), now); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
 func (r *Repository) GetPieces(ctx context.Context, cid string) ([]Piece, error) {
 	rows, err := r.DB.QueryContext(ctx, `SELECT id, cid, idx, offset, size, hash, have, updated_at FROM pieces WHERE cid=? ORDER BY idx ASC`, cid)
 	if err != nil {
@@ -218,6 +519,42 @@ func (r *Repository) GetPieces(ctx context.Context, cid string) ([]Piece, error)
 	return out, rows.Err()
 }
 
+// GetPieceHashes returns the hashes of up to limit pieces of cid, starting at
+// piece index start.
+func (r *Repository) GetPieceHashes(ctx context.Context, cid string, start, limit int64) ([]string, error) {
+	rows, err := r.DB.QueryContext(ctx, `SELECT hash FROM pieces WHERE cid=? AND idx>=? ORDER BY idx ASC LIMIT ?`, cid, start, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var h string
+		if err := rows.Scan(&h); err != nil {
+			return nil, err
+		}
+		out = append(out, h)
+	}
+	return out, rows.Err()
+}
+
+func (r *Repository) DeletePieces(ctx context.Context, cid string) error {
+	_, err := r.DB.ExecContext(ctx, `DELETE FROM pieces WHERE cid=?`, cid)
+	return err
+}
+
+// PruneOrphanPieces removes piece rows whose CID is neither shared nor
+// downloaded and returns the number of rows deleted.
+func (r *Repository) PruneOrphanPieces(ctx context.Context) (int64, error) {
+	res, err := r.DB.ExecContext(ctx, `DELETE FROM pieces
+		WHERE cid NOT IN (SELECT cid FROM local_files)
+		AND cid NOT IN (SELECT cid FROM downloads)`)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
 func (r *Repository) MissingPieces(ctx context.Context, cid string) ([]Piece, error) {
 	rows, err := r.DB.QueryContext(ctx, `SELECT id, cid, idx, offset, size, hash, have, updated_at FROM pieces WHERE cid=? AND have=0 ORDER BY idx ASC`, cid)
 	if err != nil {
@@ -237,6 +574,43 @@ func (r *Repository) MissingPieces(ctx context.Context, cid string) ([]Piece, er
 	return out, rows.Err()
 }
 
+func (r *Repository) AddSeed(ctx context.Context, cid string, maxRatio float64, maxSeconds int64) error {
+	_, err := r.DB.ExecContext(ctx, `INSERT INTO seeds (cid, uploaded_bytes, started_at, max_ratio, max_seconds)
+		VALUES (?, 0, ?, ?, ?)
+		ON CONFLICT(cid) DO UPDATE SET started_at=excluded.started_at, max_ratio=excluded.max_ratio, max_seconds=excluded.max_seconds`,
+		cid, time.Now(), maxRatio, maxSeconds)
+	return err
+}
+
+// AddSeedUpload adds n bytes to the upload counter of a seeded CID. It is a
+// no-op for CIDs that are not tracked as seeds.
+func (r *Repository) AddSeedUpload(ctx context.Context, cid string, n int64) error {
+	_, err := r.DB.ExecContext(ctx, `UPDATE seeds SET uploaded_bytes=uploaded_bytes+? WHERE cid=?`, n, cid)
+	return err
+}
+
+func (r *Repository) GetSeeds(ctx context.Context) ([]Seed, error) {
+	rows, err := r.DB.QueryContext(ctx, `SELECT cid, uploaded_bytes, started_at, max_ratio, max_seconds FROM seeds ORDER BY started_at ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Seed
+	for rows.Next() {
+		var sd Seed
+		if err := rows.Scan(&sd.CID, &sd.UploadedBytes, &sd.StartedAt, &sd.MaxRatio, &sd.MaxSeconds); err != nil {
+			return nil, err
+		}
+		out = append(out, sd)
+	}
+	return out, rows.Err()
+}
+
+func (r *Repository) DeleteSeed(ctx context.Context, cid string) error {
+	_, err := r.DB.ExecContext(ctx, `DELETE FROM seeds WHERE cid=?`, cid)
+	return err
+}
+
 func (r *Repository) SetPeerScore(ctx context.Context, peerID string, delta float64) error {
 	tx, err := r.DB.BeginTx(ctx, nil)
 	if err != nil {
@@ -279,6 +653,50 @@ func (r *Repository) GetPeerScore(ctx context.Context, peerID string) (float64,
 	return s, nil
 }
 
+// ResetPeerScore forgets the reputation of a peer.
+func (r *Repository) ResetPeerScore(ctx context.Context, peerID string) error {
+	_, err := r.DB.ExecContext(ctx, `DELETE FROM peer_scores WHERE peer_id=?`, peerID)
+	return err
+}
+
+// SetPeerRule blocks or trusts a peer, replacing any previous rule.
+func (r *Repository) SetPeerRule(ctx context.Context, peerID, rule, reason string) error {
+	_, err := r.DB.ExecContext(ctx, `INSERT INTO peer_rules (peer_id, rule, reason, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(peer_id) DO UPDATE SET rule=excluded.rule, reason=excluded.reason, created_at=excluded.created_at`,
+		peerID, rule, reason, time.Now())
+	return err
+}
+
+// DeletePeerRule removes the rule for a peer. It returns sql.ErrNoRows if the
+// peer has none.
+func (r *Repository) DeletePeerRule(ctx context.Context, peerID string) error {
+	res, err := r.DB.ExecContext(ctx, `DELETE FROM peer_rules WHERE peer_id=?`, peerID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (r *Repository) GetPeerRules(ctx context.Context) ([]PeerRule, error) {
+	rows, err := r.DB.QueryContext(ctx, `SELECT peer_id, rule, reason, created_at FROM peer_rules ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []PeerRule
+	for rows.Next() {
+		var pr PeerRule
+		if err := rows.Scan(&pr.PeerID, &pr.Rule, &pr.Reason, &pr.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, pr)
+	}
+	return out, rows.Err()
+}
+
 func (r *Repository) SearchByFilename(ctx context.Context, q string) ([]LocalFile, error) {
 	rows, err := r.DB.QueryContext(ctx, `SELECT cid, filename, file_size, '' as file_path, '' as file_hash, CURRENT_TIMESTAMP FROM metadata_index WHERE filename LIKE ? ORDER BY filename`, "%"+q+"%")
 	if err != nil {
@@ -297,3 +715,128 @@ func (r *Repository) SearchByFilename(ctx context.Context, q string) ([]LocalFil
 }
 
 func boolToInt(b bool) int { if b { return 1 }; return 0 }
+
+// AllowPeer adds a peer to the allowlist of a CID and marks the CID as
+// restricted, so that it is only served to the listed peers.
+func (r *Repository) AllowPeer(ctx context.Context, cid, peerID string) error {
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO share_acl (cid, peer_id) VALUES (?, ?)`, cid, peerID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE local_files SET restricted=1 WHERE cid=?`, cid); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Unrestrict makes a restricted CID public again and drops its allowlist. It
+// returns sql.ErrNoRows if the CID is not a shared file.
+func (r *Repository) Unrestrict(ctx context.Context, cid string) error {
+	tx, err := r.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, `UPDATE local_files SET restricted=0 WHERE cid=?`, cid)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM share_acl WHERE cid=?`, cid); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RevokePeer removes a peer from the allowlist of a CID. The CID stays
+// restricted even when its allowlist becomes empty. It returns sql.ErrNoRows
+// if the peer was not listed.
+func (r *Repository) RevokePeer(ctx context.Context, cid, peerID string) error {
+	res, err := r.DB.ExecContext(ctx, `DELETE FROM share_acl WHERE cid=? AND peer_id=?`, cid, peerID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetAllowedPeers returns the allowlist of a CID.
+func (r *Repository) GetAllowedPeers(ctx context.Context, cid string) ([]string, error) {
+	rows, err := r.DB.QueryContext(ctx, `SELECT peer_id FROM share_acl WHERE cid=? ORDER BY peer_id`, cid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// IsPeerAllowed reports whether a CID may be served to peerID: it is not a
+// restricted share, or peerID is on its allowlist.
+func (r *Repository) IsPeerAllowed(ctx context.Context, cid, peerID string) (bool, error) {
+	var restricted, listed bool
+	err := r.DB.QueryRowContext(ctx, `SELECT
+		COALESCE((SELECT restricted FROM local_files WHERE cid=?), 0),
+		EXISTS (SELECT 1 FROM share_acl WHERE cid=? AND peer_id=?)`, cid, cid, peerID).
+		Scan(&restricted, &listed)
+	if err != nil {
+		return false, err
+	}
+	return !restricted || listed, nil
+}
+
+// SetPublishedName records that name now points at cid with sequence number
+// seq.
+func (r *Repository) SetPublishedName(ctx context.Context, name, cid string, seq uint64) error {
+	_, err := r.DB.ExecContext(ctx, `INSERT INTO published_names (name, cid, seq, published_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET cid=excluded.cid, seq=excluded.seq, published_at=excluded.published_at`,
+		name, cid, int64(seq), time.Now())
+	return err
+}
+
+// GetPublishedName returns sql.ErrNoRows if name was never published.
+func (r *Repository) GetPublishedName(ctx context.Context, name string) (*PublishedName, error) {
+	var n PublishedName
+	var seq int64
+	err := r.DB.QueryRowContext(ctx, `SELECT name, cid, seq, published_at FROM published_names WHERE name=?`, name).
+		Scan(&n.Name, &n.CID, &seq, &n.PublishedAt)
+	if err != nil {
+		return nil, err
+	}
+	n.Seq = uint64(seq)
+	return &n, nil
+}
+
+func (r *Repository) GetPublishedNames(ctx context.Context) ([]PublishedName, error) {
+	rows, err := r.DB.QueryContext(ctx, `SELECT name, cid, seq, published_at FROM published_names ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []PublishedName
+	for rows.Next() {
+		var n PublishedName
+		var seq int64
+		if err := rows.Scan(&n.Name, &n.CID, &seq, &n.PublishedAt); err != nil {
+			return nil, err
+		}
+		n.Seq = uint64(seq)
+		out = append(out, n)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,153 @@
+// Package logging provides structured, leveled loggers built on log/slog with
+// per-subsystem verbosity.
+//
+// Configuration is read from the environment by Init:
+//
+//	TORRENTIUM_LOG_LEVEL=info,p2p=debug,db=warn   default level plus per-subsystem overrides
+//	TORRENTIUM_LOG_FORMAT=json                    "text" (default) or "json"
+//
+// Loggers returned by Logger may be created before Init runs; they always use
+// the current configuration.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Common attribute keys so that log aggregation sees consistent field names.
+const (
+	KeyPeer      = "peer"
+	KeyCID       = "cid"
+	KeyPiece     = "piece"
+	KeyChunk     = "chunk"
+	KeyErr       = "err"
+	KeySubsystem = "subsystem"
+)
+
+type config struct {
+	base         slog.Handler
+	defaultLevel slog.Level
+	levels       map[string]slog.Level
+}
+
+var current atomic.Pointer[config]
+
+func init() {
+	current.Store(&config{
+		base:         slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}),
+		defaultLevel: slog.LevelInfo,
+		levels:       map[string]slog.Level{},
+	})
+}
+
+// Init configures logging from TORRENTIUM_LOG_LEVEL and TORRENTIUM_LOG_FORMAT
+// and routes the standard library logger through the "std" subsystem.
+func Init() error {
+	return Configure(os.Stderr, os.Getenv("TORRENTIUM_LOG_FORMAT"), os.Getenv("TORRENTIUM_LOG_LEVEL"))
+}
+
+// Configure sets the output, format ("text" or "json") and level spec
+// (e.g. "info,p2p=debug") for all loggers.
+func Configure(w io.Writer, format, levelSpec string) error {
+	defaultLevel, levels, err := parseLevels(levelSpec)
+	if err != nil {
+		return err
+	}
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	var base slog.Handler
+	switch strings.ToLower(format) {
+	case "", "text":
+		base = slog.NewTextHandler(w, opts)
+	case "json":
+		base = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	current.Store(&config{base: base, defaultLevel: defaultLevel, levels: levels})
+
+	// Also captures output of the standard library log package.
+	slog.SetDefault(Logger("std"))
+	return nil
+}
+
+// parseLevels parses "info,p2p=debug,db=warn".
+func parseLevels(spec string) (slog.Level, map[string]slog.Level, error) {
+	def := slog.LevelInfo
+	levels := make(map[string]slog.Level)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, lvl, found := strings.Cut(part, "=")
+		if !found {
+			lvl, name = name, ""
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(strings.TrimSpace(lvl))); err != nil {
+			return def, nil, fmt.Errorf("invalid log level %q: %w", part, err)
+		}
+		if name == "" {
+			def = level
+		} else {
+			levels[strings.TrimSpace(name)] = level
+		}
+	}
+	return def, levels, nil
+}
+
+// Logger returns the logger for a subsystem such as "p2p", "client" or "db".
+// Every record carries a subsystem attribute.
+func Logger(subsystem string) *slog.Logger {
+	return slog.New(&handler{subsystem: subsystem})
+}
+
+// handler resolves the active configuration on every call so that loggers
+// stored in package variables pick up Init.
+type handler struct {
+	subsystem string
+	ops       []func(slog.Handler) slog.Handler
+}
+
+func (h *handler) level(cfg *config) slog.Level {
+	if lvl, ok := cfg.levels[h.subsystem]; ok {
+		return lvl
+	}
+	return cfg.defaultLevel
+}
+
+func (h *handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level(current.Load())
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	cfg := current.Load()
+	if r.Level < h.level(cfg) {
+		return nil
+	}
+	next := cfg.base.WithAttrs([]slog.Attr{slog.String(KeySubsystem, h.subsystem)})
+	for _, op := range h.ops {
+		next = op(next)
+	}
+	return next.Handle(ctx, r)
+}
+
+func (h *handler) with(op func(slog.Handler) slog.Handler) *handler {
+	ops := make([]func(slog.Handler) slog.Handler, len(h.ops), len(h.ops)+1)
+	copy(ops, h.ops)
+	return &handler{subsystem: h.subsystem, ops: append(ops, op)}
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(next slog.Handler) slog.Handler { return next.WithAttrs(attrs) })
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return h.with(func(next slog.Handler) slog.Handler { return next.WithGroup(name) })
+}
@@ -0,0 +1,121 @@
+// Package metrics exposes Prometheus metrics for transfers, peers and the DHT.
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"torrentium/internal/logging"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "torrentium"
+
+var logger = logging.Logger("metrics")
+
+var (
+	BytesSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bytes_sent_total",
+		Help:      "Piece payload bytes sent, by remote peer.",
+	}, []string{"peer"})
+
+	BytesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bytes_received_total",
+		Help:      "Piece payload bytes received, by remote peer.",
+	}, []string{"peer"})
+
+	PiecesVerified = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pieces_verified_total",
+		Help:      "Downloaded pieces whose hash matched the manifest.",
+	})
+
+	PiecesFailed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pieces_failed_total",
+		Help:      "Downloaded pieces whose hash did not match the manifest.",
+	})
+
+	PieceAckTimeouts = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "piece_ack_timeouts_total",
+		Help:      "Uploaded pieces whose acknowledgement did not arrive in time.",
+	})
+
+	ActiveDownloads = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_downloads",
+		Help:      "Downloads currently in progress.",
+	})
+
+	ActiveUploads = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_uploads",
+		Help:      "Piece requests currently being served.",
+	})
+
+	WebRTCPeers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "webrtc_peers",
+		Help:      "WebRTC peer connections, by connection state.",
+	}, []string{"state"})
+
+	DHTRoutingTableSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "dht_routing_table_size",
+		Help:      "Number of peers in the DHT routing table.",
+	})
+
+	DHTProvideDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "dht_provide_duration_seconds",
+		Help:      "Time taken to announce a CID on the DHT.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+	}, []string{"result"})
+
+	DHTFindProvidersDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "dht_find_providers_duration_seconds",
+		Help:      "Time taken to look up providers of a CID on the DHT.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+	})
+
+	PeerRTT = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "peer_rtt_seconds",
+		Help:      "Round trip time of data channel pings.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 12),
+	})
+)
+
+// ObserveProvide records how long a DHT provide took and whether it failed.
+func ObserveProvide(start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	DHTProvideDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+}
+
+// ForgetPeer drops the per-peer series of a disconnected peer, so that the
+// number of series does not grow with every peer ever seen. A peer that
+// reconnects starts counting from zero, which Prometheus treats as a
+// counter reset.
+func ForgetPeer(peer string) {
+	BytesSent.DeleteLabelValues(peer)
+	BytesReceived.DeleteLabelValues(peer)
+}
+
+// Serve exposes all registered metrics (including libp2p's own) on
+// http://addr/metrics. It blocks until the listener fails.
+func Serve(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	logger.Info("metrics endpoint listening", "url", "http://"+addr+"/metrics")
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,220 @@
+// Package naming implements mutable names: records signed with a peer's
+// identity key that point a name chosen by that peer at a CID. A name is
+// written <peer ID>/<name>, and a record is stored in the DHT under
+//
+//	/name/<peer ID>/<name>
+//
+// Publishing a new CID under the same name bumps the record's sequence
+// number; the DHT keeps the record with the highest one.
+//
+// The public IPFS DHT only stores pk and ipns records, so names live in a
+// separate DHT, with protocol prefix ProtocolPrefix, formed by the Torrentium
+// peers among the hosts we are connected to. It has no bootstrap peers of its
+// own: resolvers connect to a name's owner, found through the main DHT, which
+// always holds its own records.
+package naming
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	record "github.com/libp2p/go-libp2p-record"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	ProtocolPrefix = "/torrentium"
+	Namespace      = "name"
+	MaxNameLen     = 64
+)
+
+var (
+	ErrInvalidName   = errors.New("invalid name: use up to 64 letters, digits, '.', '_' or '-'")
+	ErrInvalidRecord = errors.New("invalid name record")
+	ErrExpired       = errors.New("name record has expired")
+)
+
+// Record points a name at a CID until Expires.
+type Record struct {
+	Name      string    `json:"name"`
+	CID       string    `json:"cid"`
+	Seq       uint64    `json:"seq"`
+	Expires   time.Time `json:"expires"`
+	PublicKey []byte    `json:"public_key"`
+	Signature []byte    `json:"signature"`
+}
+
+// NewDHT starts the name DHT on h. It runs in server mode so that peers
+// behind NAT, which most Torrentium peers are, still store each other's
+// records.
+func NewDHT(ctx context.Context, h host.Host, opts ...dht.Option) (*dht.IpfsDHT, error) {
+	opts = append([]dht.Option{
+		dht.ProtocolPrefix(ProtocolPrefix),
+		dht.Mode(dht.ModeServer),
+		dht.Validator(record.NamespacedValidator{Namespace: Validator{}}),
+		dht.DisableProviders(),
+	}, opts...)
+	return dht.New(ctx, h, opts...)
+}
+
+// ValidName reports whether name may be published.
+func ValidName(name string) bool {
+	if name == "" || len(name) > MaxNameLen || name == "." || name == ".." {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// IsName reports whether s looks like a name rather than a CID.
+func IsName(s string) bool {
+	return strings.Contains(s, "/")
+}
+
+// ParseName splits "<peer ID>/<name>".
+func ParseName(s string) (peer.ID, string, error) {
+	owner, name, ok := strings.Cut(s, "/")
+	if !ok {
+		return "", "", fmt.Errorf("name must be <peer ID>/<name>: %q", s)
+	}
+	pid, err := peer.Decode(owner)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid peer ID in name: %w", err)
+	}
+	if !ValidName(name) {
+		return "", "", ErrInvalidName
+	}
+	return pid, name, nil
+}
+
+// Key returns the DHT key of owner's record for name.
+func Key(owner peer.ID, name string) string {
+	return "/" + Namespace + "/" + owner.String() + "/" + name
+}
+
+func parseKey(key string) (peer.ID, string, error) {
+	ns, rest, err := record.SplitKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	if ns != Namespace {
+		return "", "", fmt.Errorf("%w: namespace %q", ErrInvalidRecord, ns)
+	}
+	return ParseName(rest)
+}
+
+// NewRecord signs a record pointing name at cidStr with priv.
+func NewRecord(priv crypto.PrivKey, name, cidStr string, seq uint64, expires time.Time) (*Record, error) {
+	if !ValidName(name) {
+		return nil, ErrInvalidName
+	}
+	if _, err := cid.Decode(cidStr); err != nil {
+		return nil, fmt.Errorf("invalid CID: %w", err)
+	}
+	pub, err := crypto.MarshalPublicKey(priv.GetPublic())
+	if err != nil {
+		return nil, err
+	}
+	rec := &Record{Name: name, CID: cidStr, Seq: seq, Expires: expires.UTC(), PublicKey: pub}
+	if rec.Signature, err = priv.Sign(rec.signedData()); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// signedData is what the signature covers. Names cannot contain newlines.
+func (r *Record) signedData() []byte {
+	return []byte("torrentium-name-record\n" + r.Name + "\n" + r.CID + "\n" +
+		strconv.FormatUint(r.Seq, 10) + "\n" + strconv.FormatInt(r.Expires.UnixNano(), 10))
+}
+
+// Verify checks that owner signed r and that it has not expired at now.
+func (r *Record) Verify(owner peer.ID, now time.Time) error {
+	if !ValidName(r.Name) {
+		return fmt.Errorf("%w: %w", ErrInvalidRecord, ErrInvalidName)
+	}
+	if _, err := cid.Decode(r.CID); err != nil {
+		return fmt.Errorf("%w: bad CID: %w", ErrInvalidRecord, err)
+	}
+	pub, err := crypto.UnmarshalPublicKey(r.PublicKey)
+	if err != nil {
+		return fmt.Errorf("%w: bad public key: %w", ErrInvalidRecord, err)
+	}
+	if !owner.MatchesPublicKey(pub) {
+		return fmt.Errorf("%w: not signed by %s", ErrInvalidRecord, owner)
+	}
+	if ok, err := pub.Verify(r.signedData(), r.Signature); err != nil || !ok {
+		return fmt.Errorf("%w: bad signature", ErrInvalidRecord)
+	}
+	if !now.Before(r.Expires) {
+		return ErrExpired
+	}
+	return nil
+}
+
+func (r *Record) Marshal() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+func Unmarshal(data []byte) (*Record, error) {
+	var r Record
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidRecord, err)
+	}
+	return &r, nil
+}
+
+// Validator checks name records for the DHT.
+type Validator struct{}
+
+var _ record.Validator = Validator{}
+
+// Validate accepts a record stored under the key of its own name that is
+// signed by the peer in the key.
+func (Validator) Validate(key string, value []byte) error {
+	owner, name, err := parseKey(key)
+	if err != nil {
+		return err
+	}
+	rec, err := Unmarshal(value)
+	if err != nil {
+		return err
+	}
+	if rec.Name != name {
+		return fmt.Errorf("%w: record for %q stored under %q", ErrInvalidRecord, rec.Name, name)
+	}
+	return rec.Verify(owner, time.Now())
+}
+
+// Select prefers the highest sequence number, then the latest expiry, which
+// is how a republished record replaces its predecessor.
+func (Validator) Select(_ string, vals [][]byte) (int, error) {
+	best := -1
+	var bestRec *Record
+	for i, v := range vals {
+		rec, err := Unmarshal(v)
+		if err != nil {
+			continue
+		}
+		if bestRec == nil || rec.Seq > bestRec.Seq || rec.Seq == bestRec.Seq && rec.Expires.After(bestRec.Expires) {
+			best, bestRec = i, rec
+		}
+	}
+	if best < 0 {
+		return 0, ErrInvalidRecord
+	}
+	return best, nil
+}
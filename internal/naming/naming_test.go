@@ -0,0 +1,92 @@
+package naming
+
+import (
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const testCID = "bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku"
+
+func newKey(t *testing.T) (crypto.PrivKey, peer.ID) {
+	t.Helper()
+	priv, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := peer.IDFromPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv, pid
+}
+
+func marshal(t *testing.T, r *Record) []byte {
+	t.Helper()
+	data, err := r.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestValidate(t *testing.T) {
+	priv, owner := newKey(t)
+	_, other := newKey(t)
+	rec, err := NewRecord(priv, "nightly", testCID, 1, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v Validator
+	if err := v.Validate(Key(owner, "nightly"), marshal(t, rec)); err != nil {
+		t.Fatalf("valid record rejected: %v", err)
+	}
+
+	tampered := *rec
+	tampered.CID = "bafkreie5cvv4h45feadgeuwhbcutmh6t2ceseocckahdoe6uat64zmz454"
+	expired, _ := NewRecord(priv, "nightly", testCID, 1, time.Now().Add(-time.Second))
+	for _, tc := range []struct {
+		name string
+		key  string
+		rec  *Record
+		want error
+	}{
+		{"tampered", Key(owner, "nightly"), &tampered, ErrInvalidRecord},
+		{"other owner", Key(other, "nightly"), rec, ErrInvalidRecord},
+		{"other name", Key(owner, "stable"), rec, ErrInvalidRecord},
+		{"expired", Key(owner, "nightly"), expired, ErrExpired},
+	} {
+		if err := v.Validate(tc.key, marshal(t, tc.rec)); !errors.Is(err, tc.want) {
+			t.Errorf("%s: err = %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestSelectPrefersNewest(t *testing.T) {
+	priv, _ := newKey(t)
+	soon := time.Now().Add(time.Hour)
+	v1, _ := NewRecord(priv, "nightly", testCID, 1, soon.Add(time.Hour))
+	v2, _ := NewRecord(priv, "nightly", testCID, 2, soon)
+	v2later, _ := NewRecord(priv, "nightly", testCID, 2, soon.Add(time.Minute))
+	i, err := Validator{}.Select("", [][]byte{marshal(t, v1), marshal(t, v2later), []byte("junk"), marshal(t, v2)})
+	if err != nil || i != 1 {
+		t.Fatalf("Select = %d, %v; want 1", i, err)
+	}
+}
+
+func TestParseName(t *testing.T) {
+	_, owner := newKey(t)
+	pid, name, err := ParseName(owner.String() + "/nightly-1.2")
+	if err != nil || pid != owner || name != "nightly-1.2" {
+		t.Fatalf("ParseName = %s, %q, %v", pid, name, err)
+	}
+	for _, bad := range []string{"nightly", "notapeer/nightly", owner.String() + "/", owner.String() + "/a/b", owner.String() + "/.."} {
+		if _, _, err := ParseName(bad); err == nil {
+			t.Errorf("ParseName(%q) succeeded", bad)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package p2p
+
+import (
+	"sync"
+
+	"torrentium/internal/logging"
+
+	"github.com/libp2p/go-libp2p/core/connmgr"
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// Gater keeps the blocked and trusted peer sets. It refuses libp2p
+// connections to and from blocked peers; trust is only consulted by the
+// application, since the DHT needs connections to arbitrary peers.
+type Gater struct {
+	mu      sync.RWMutex
+	blocked map[peer.ID]bool
+	trusted map[peer.ID]bool
+}
+
+var _ connmgr.ConnectionGater = (*Gater)(nil)
+
+func NewGater() *Gater {
+	return &Gater{
+		blocked: make(map[peer.ID]bool),
+		trusted: make(map[peer.ID]bool),
+	}
+}
+
+// Block refuses all connections with p. A blocked peer is no longer trusted.
+func (g *Gater) Block(p peer.ID) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.blocked[p] = true
+	delete(g.trusted, p)
+}
+
+// Trust marks p as trusted. A trusted peer is no longer blocked.
+func (g *Gater) Trust(p peer.ID) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.trusted[p] = true
+	delete(g.blocked, p)
+}
+
+// Clear forgets any rule for p.
+func (g *Gater) Clear(p peer.ID) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.blocked, p)
+	delete(g.trusted, p)
+}
+
+func (g *Gater) Blocked(p peer.ID) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.blocked[p]
+}
+
+func (g *Gater) Trusted(p peer.ID) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.trusted[p]
+}
+
+func (g *Gater) InterceptPeerDial(p peer.ID) bool {
+	return !g.Blocked(p)
+}
+
+func (g *Gater) InterceptAddrDial(p peer.ID, _ ma.Multiaddr) bool {
+	return !g.Blocked(p)
+}
+
+// InterceptAccept allows every inbound connection: the remote peer is only
+// known once the connection is secured.
+func (g *Gater) InterceptAccept(network.ConnMultiaddrs) bool {
+	return true
+}
+
+func (g *Gater) InterceptSecured(_ network.Direction, p peer.ID, _ network.ConnMultiaddrs) bool {
+	if g.Blocked(p) {
+		logger.Debug("refused connection from blocked peer", logging.KeyPeer, p)
+		return false
+	}
+	return true
+}
+
+func (g *Gater) InterceptUpgraded(network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
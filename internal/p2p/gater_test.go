@@ -0,0 +1,31 @@
+package p2p
+
+import (
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/test"
+)
+
+func TestGater(t *testing.T) {
+	g := NewGater()
+	p := test.RandPeerIDFatal(t)
+	if !g.InterceptPeerDial(p) || !g.InterceptSecured(network.DirInbound, p, nil) {
+		t.Fatal("unknown peer refused")
+	}
+
+	g.Block(p)
+	if g.InterceptPeerDial(p) || g.InterceptAddrDial(p, nil) || g.InterceptSecured(network.DirInbound, p, nil) {
+		t.Fatal("blocked peer allowed")
+	}
+
+	g.Trust(p)
+	if g.Blocked(p) || !g.Trusted(p) || !g.InterceptSecured(network.DirOutbound, p, nil) {
+		t.Fatal("trusting a peer must lift its block")
+	}
+
+	g.Clear(p)
+	if g.Blocked(p) || g.Trusted(p) {
+		t.Fatal("Clear kept a rule")
+	}
+}
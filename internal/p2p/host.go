@@ -4,10 +4,11 @@ import (
 	"context"
 	"crypto/rand"
 	"fmt"
-	"log"
 	"os"
 	"time"
 
+	"torrentium/internal/logging"
+
 	"github.com/libp2p/go-libp2p"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	"github.com/libp2p/go-libp2p/core/crypto"
@@ -20,6 +21,8 @@ import (
 
 const privKeyFile = "private_key"
 
+var logger = logging.Logger("p2p")
+
 func reserveWithRelay(ctx context.Context, relayAddrStr string, h host.Host) error {
 	maddr, err := ma.NewMultiaddr(relayAddrStr)
 	if err != nil {
@@ -36,12 +39,13 @@ func reserveWithRelay(ctx context.Context, relayAddrStr string, h host.Host) err
 	if err != nil {
 		return fmt.Errorf("reservation failed: %w", err)
 	}
-	log.Printf("✅ Reservation with relay successful. Expires at: %v", res.Expiration)
+	logger.Info("reservation with relay successful", "expires", res.Expiration)
 	return nil
 }
 func NewHost(
 	ctx context.Context,
 	listenAddr string,
+	gater *Gater,
 	onOffer func(offer, remotePeerID string, s network.Stream) (string, error),
 ) (host.Host, *dht.IpfsDHT, error) {
 
@@ -69,13 +73,18 @@ func NewHost(
 	}
 
 	// 🚀 Create host with relay + autorelay
-	h, err := libp2p.New(
+	opts := []libp2p.Option{
 		libp2p.Identity(priv),
 		libp2p.ListenAddrs(maddr),
 		libp2p.EnableRelay(), // act as relay client
 		libp2p.EnableAutoRelayWithStaticRelays([]peer.AddrInfo{*relayInfo}),
 		libp2p.EnableHolePunching(),
-	)
+	}
+	if gater != nil {
+		// 🚧 Refuse connections with blocked peers
+		opts = append(opts, libp2p.ConnectionGater(gater))
+	}
+	h, err := libp2p.New(opts...)
 	if err != nil {
 		return nil, nil, fmt.Errorf("libp2p peer not initialized: %w", err)
 	}
@@ -84,13 +93,13 @@ func NewHost(
 	if err := h.Connect(ctx, *relayInfo); err != nil {
 		return nil, nil, fmt.Errorf("❌ Failed to connect to relay: %w", err)
 	}
-	log.Println("✅ Connected to relay")
+	logger.Info("connected to relay", logging.KeyPeer, relayInfo.ID)
 
 	// 🛂 Reserve relay slot
 	if err := reserveWithRelay(ctx, relayAddrStr, h); err != nil {
 		return nil, nil, fmt.Errorf("❌ Relay reservation failed: %w", err)
 	}
-	log.Println("✅ Relay reservation successful")
+	logger.Info("relay reservation successful")
 
 	// 📒 DHT setup
 	idht, err := dht.New(ctx, h)
@@ -104,9 +113,9 @@ func NewHost(
 	// 📨 Register WebRTC signaling protocol (your handler)
 	RegisterSignalingProtocol(h, onOffer)
 
-	log.Printf("✅ Host created with ID: %s", h.ID())
+	logger.Info("host created", logging.KeyPeer, h.ID())
 	for _, addr := range h.Addrs() {
-		log.Printf("🟢 Listening on: %s/p2p/%s", addr, h.ID())
+		logger.Info("listening", "addr", fmt.Sprintf("%s/p2p/%s", addr, h.ID()))
 	}
 
 	return h, idht, nil
@@ -137,34 +146,34 @@ func Bootstrap(ctx context.Context, h host.Host, d *dht.IpfsDHT) error {
 		"/ip6/2604:1380:1000:6000::1/tcp/4001/p2p/QmQCU2EcMqAqQPR2i9bChDtGNJchTbq5TbXJJ16u19uLTa",
 	}
 
-	fmt.Println("Connecting to bootstrap nodes...")
+	logger.Info("connecting to bootstrap nodes")
 	connected := 0
 	required := 5
 	for i, addrStr := range bootstrapNodes {
 		// Stop early if we have enough connections
 		if connected >= required {
-			fmt.Printf("Already connected to %d nodes, stopping early\n", connected)
+			logger.Debug("enough bootstrap nodes connected, stopping early", "connected", connected)
 			break
 		}
 
 		addr, err := ma.NewMultiaddr(addrStr)
 		if err != nil {
-			log.Printf("Invalid bootstrap address %s: %v", addrStr, err)
+			logger.Warn("invalid bootstrap address", "addr", addrStr, logging.KeyErr, err)
 			continue
 		}
 
 		pi, err := peer.AddrInfoFromP2pAddr(addr)
 		if err != nil {
-			log.Printf("Failed to parse bootstrap peer info %s: %v", addrStr, err)
+			logger.Warn("failed to parse bootstrap peer info", "addr", addrStr, logging.KeyErr, err)
 			continue
 		}
 
 		// Use shorter timeout for individual connections
 		connectCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
 		if err := h.Connect(connectCtx, *pi); err != nil {
-			log.Printf("Failed to connect to bootstrap node %s: %v", pi.ID, err)
+			logger.Warn("failed to connect to bootstrap node", logging.KeyPeer, pi.ID, logging.KeyErr, err)
 		} else {
-			fmt.Printf("Connected to bootstrap node: %s\n", pi.ID)
+			logger.Info("connected to bootstrap node", logging.KeyPeer, pi.ID)
 			connected++
 		}
 		cancel()
@@ -179,16 +188,16 @@ func Bootstrap(ctx context.Context, h host.Host, d *dht.IpfsDHT) error {
 		return fmt.Errorf("insufficient bootstrap connections: got %d, need at least %d", connected, required)
 	}
 
-	fmt.Printf("Successfully connected to %d bootstrap nodes (minimum %d required)\n", connected, required)
+	logger.Info("connected to bootstrap nodes", "connected", connected, "required", required)
 
 	// Bootstrap the DHT
-	fmt.Println("Bootstrapping DHT...")
+	logger.Info("bootstrapping DHT")
 	if err := d.Bootstrap(ctx); err != nil {
 		return fmt.Errorf("failed to bootstrap DHT: %w", err)
 	}
 
 	// Wait for DHT to become ready with better feedback
-	fmt.Println("Waiting for DHT to become ready...")
+	logger.Info("waiting for DHT to become ready")
 	readyTimeout := time.After(45 * time.Second)
 	checkTicker := time.NewTicker(5 * time.Second)
 	defer checkTicker.Stop()
@@ -198,25 +207,25 @@ func Bootstrap(ctx context.Context, h host.Host, d *dht.IpfsDHT) error {
 		case <-readyTimeout:
 			routingTableSize := d.RoutingTable().Size()
 			if routingTableSize > 0 {
-				fmt.Printf("DHT partially ready (routing table size: %d), continuing...\n", routingTableSize)
+				logger.Warn("DHT partially ready, continuing", "routing_table_size", routingTableSize)
 			} else {
-				fmt.Println("DHT bootstrap timeout, but continuing anyway...")
+				logger.Warn("DHT bootstrap timed out, continuing anyway")
 			}
 			return nil
 
 		case <-checkTicker.C:
 			routingTableSize := d.RoutingTable().Size()
-			fmt.Printf("DHT routing table size: %d\n", routingTableSize)
+			logger.Debug("DHT routing table", "routing_table_size", routingTableSize)
 			if routingTableSize >= 10 {
-				fmt.Println("DHT is ready with good routing table!")
+				logger.Info("DHT is ready", "routing_table_size", routingTableSize)
 				return nil
 			}
 
 		case <-d.RefreshRoutingTable():
 			routingTableSize := d.RoutingTable().Size()
-			fmt.Printf("DHT routing table refreshed (size: %d)\n", routingTableSize)
+			logger.Debug("DHT routing table refreshed", "routing_table_size", routingTableSize)
 			if routingTableSize >= 5 {
-				fmt.Println("DHT is ready!")
+				logger.Info("DHT is ready", "routing_table_size", routingTableSize)
 				return nil
 			}
 		}
@@ -240,12 +249,12 @@ func loadOrGeneratePrivateKey() (crypto.PrivKey, error) {
 			return nil, fmt.Errorf("failed to write private key to file: %w", err)
 		}
 
-		log.Println("Generated new libp2p private key.")
+		logger.Info("generated new libp2p private key")
 		return priv, nil
 	} else if err != nil {
 		return nil, err
 	}
 
-	log.Println("Loaded existing libp2p private key.")
+	logger.Info("loaded existing libp2p private key")
 	return crypto.UnmarshalPrivateKey(privBytes)
 }
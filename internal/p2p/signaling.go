@@ -3,7 +3,8 @@ package p2p
 import (
 	"encoding/json"
 	"fmt"
-	"log"
+
+	"torrentium/internal/logging"
 
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
@@ -19,27 +20,29 @@ type SignalingMessage struct {
 // RegisterSignalingProtocol sets up WebRTC signaling protocol handler
 func RegisterSignalingProtocol(h host.Host, onOffer func(offer, remotePeerID string, s network.Stream) (string, error)) {
 	h.SetStreamHandler(SignalingProtocolID, func(s network.Stream) {
-		log.Printf("Received incoming signaling connection from %s", s.Conn().RemotePeer())
+		remote := s.Conn().RemotePeer()
+		plog := logger.With(logging.KeyPeer, remote)
+		plog.Debug("incoming signaling connection")
 
 		decoder := json.NewDecoder(s)
 		encoder := json.NewEncoder(s)
 
 		var msg SignalingMessage
 		if err := decoder.Decode(&msg); err != nil {
-			log.Printf("Error decoding signaling message: %v", err)
+			plog.Warn("error decoding signaling message", logging.KeyErr, err)
 			_ = s.Reset()
 			return
 		}
 
 		if msg.Type != "offer" {
-			log.Printf("Expected offer, got: %s", msg.Type)
+			plog.Warn("expected offer", "type", msg.Type)
 			_ = s.Reset()
 			return
 		}
 
-		answer, err := onOffer(msg.Data, s.Conn().RemotePeer().String(), s)
+		answer, err := onOffer(msg.Data, remote.String(), s)
 		if err != nil {
-			log.Printf("Error handling offer: %v", err)
+			plog.Warn("error handling offer", logging.KeyErr, err)
 			errorMsg := SignalingMessage{
 				Type: "error",
 				Data: fmt.Sprintf("ERROR:%s", err.Error()),
@@ -55,31 +58,31 @@ func RegisterSignalingProtocol(h host.Host, onOffer func(offer, remotePeerID str
 		}
 
 		if err := encoder.Encode(answerMsg); err != nil {
-			log.Printf("Error encoding answer: %v", err)
+			plog.Warn("error encoding answer", logging.KeyErr, err)
 			_ = s.Reset()
 			return
 		}
 
 		// Keep stream open for ICE candidate exchange
-		log.Printf("Signaling stream established with %s", s.Conn().RemotePeer())
+		plog.Debug("signaling stream established")
 
 		// Handle additional signaling messages (ICE candidates, etc.)
 		for {
 			var additionalMsg SignalingMessage
 			if err := decoder.Decode(&additionalMsg); err != nil {
-				log.Printf("Signaling stream closed or error: %v", err)
+				plog.Debug("signaling stream closed", logging.KeyErr, err)
 				break
 			}
 
 			switch additionalMsg.Type {
 			case "close":
-				log.Printf("Peer requested signaling stream close")
+				plog.Debug("peer requested signaling stream close")
 				return
 			case "ice-candidate":
 				// For now, just log ICE candidates
-				log.Printf("Received ICE candidate from peer")
+				plog.Debug("received ICE candidate")
 			default:
-				log.Printf("Unknown signaling message type: %s", additionalMsg.Type)
+				plog.Warn("unknown signaling message type", "type", additionalMsg.Type)
 			}
 		}
 	})
@@ -0,0 +1,128 @@
+// Package shareuri encodes what a downloader needs to fetch a shared file
+// into a single magnet-style URI:
+//
+//	torrentium:?xt=<cid>&dn=<name>&xl=<size>&mh=<pieces root>&pr=<multiaddr>&pr=...#<share key>
+//
+// xt is required; everything else is optional. pr lists provider addresses
+// ending in /p2p/<peer ID>, including relay circuit addresses, which a
+// downloader dials before it searches the DHT. mh is the pieces root of the
+// file's manifest, so a manifest served by a hinted peer can be checked
+// against it. The share key of an encrypted share travels in the fragment,
+// as it does in share links.
+package shareuri
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const (
+	Scheme = "torrentium"
+
+	// MaxPeers bounds the provider hints in a URI, which keeps it short
+	// enough to paste.
+	MaxPeers = 8
+)
+
+var ErrInvalid = errors.New("invalid torrentium URI")
+
+// URI describes a shared file and where to get it.
+type URI struct {
+	CID        string
+	Name       string
+	Size       int64
+	PiecesRoot string
+	Peers      []ma.Multiaddr
+	Key        string
+}
+
+// IsURI reports whether s uses the torrentium: scheme.
+func IsURI(s string) bool {
+	return strings.HasPrefix(strings.ToLower(s), Scheme+":")
+}
+
+func (u URI) String() string {
+	params := []string{"xt=" + u.CID}
+	if u.Name != "" {
+		params = append(params, "dn="+url.QueryEscape(u.Name))
+	}
+	if u.Size > 0 {
+		params = append(params, "xl="+strconv.FormatInt(u.Size, 10))
+	}
+	if u.PiecesRoot != "" {
+		params = append(params, "mh="+u.PiecesRoot)
+	}
+	for _, p := range u.Peers {
+		params = append(params, "pr="+url.QueryEscape(p.String()))
+	}
+	s := Scheme + ":?" + strings.Join(params, "&")
+	if u.Key != "" {
+		s += "#" + u.Key
+	}
+	return s
+}
+
+// Parse reads a URI produced by String.
+func Parse(s string) (URI, error) {
+	if !IsURI(s) {
+		return URI{}, fmt.Errorf("%w: missing %s: scheme", ErrInvalid, Scheme)
+	}
+	rest := s[len(Scheme)+1:]
+	rest, key, _ := strings.Cut(rest, "#")
+	query, ok := strings.CutPrefix(rest, "?")
+	if !ok {
+		return URI{}, fmt.Errorf("%w: missing query", ErrInvalid)
+	}
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return URI{}, fmt.Errorf("%w: %w", ErrInvalid, err)
+	}
+
+	u := URI{CID: q.Get("xt"), Name: q.Get("dn"), PiecesRoot: q.Get("mh"), Key: key}
+	if _, err := cid.Decode(u.CID); err != nil {
+		return URI{}, fmt.Errorf("%w: bad CID: %w", ErrInvalid, err)
+	}
+	if v := q.Get("xl"); v != "" {
+		if u.Size, err = strconv.ParseInt(v, 10, 64); err != nil || u.Size < 0 {
+			return URI{}, fmt.Errorf("%w: bad size %q", ErrInvalid, v)
+		}
+	}
+	if u.PiecesRoot != "" {
+		if b, err := hex.DecodeString(u.PiecesRoot); err != nil || len(b) != 32 {
+			return URI{}, fmt.Errorf("%w: bad pieces root", ErrInvalid)
+		}
+	}
+	prs := q["pr"]
+	if len(prs) > MaxPeers {
+		prs = prs[:MaxPeers]
+	}
+	for _, pr := range prs {
+		addr, err := ma.NewMultiaddr(pr)
+		if err != nil {
+			return URI{}, fmt.Errorf("%w: bad peer address %q: %w", ErrInvalid, pr, err)
+		}
+		if _, err := peer.AddrInfoFromP2pAddr(addr); err != nil {
+			return URI{}, fmt.Errorf("%w: peer address %q: %w", ErrInvalid, pr, err)
+		}
+		u.Peers = append(u.Peers, addr)
+	}
+	return u, nil
+}
+
+// Providers groups the peer addresses by peer.
+func (u URI) Providers() []peer.AddrInfo {
+	infos, err := peer.AddrInfosFromP2pAddrs(u.Peers...)
+	if err != nil {
+		// Parse has checked every address.
+		return nil
+	}
+	return infos
+}
@@ -0,0 +1,66 @@
+package shareuri
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const (
+	testCID  = "bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku"
+	testPeer = "12D3KooWCP28CB5csS5VAFkFFHi5uDQhVmDa6EisV9vGLAwrJrhK"
+)
+
+func TestRoundTrip(t *testing.T) {
+	direct := ma.StringCast("/ip4/192.0.2.7/tcp/4001/p2p/" + testPeer)
+	relayed := ma.StringCast("/dns4/relay.example.com/tcp/443/wss/p2p/" + testPeer + "/p2p-circuit/p2p/" + testPeer)
+	want := URI{
+		CID:        testCID,
+		Name:       "nightly build & notes.tar.gz",
+		Size:       123456789,
+		PiecesRoot: strings.Repeat("ab", 32),
+		Peers:      []ma.Multiaddr{direct, relayed},
+		Key:        "Jx3kQ",
+	}
+	s := want.String()
+	if !strings.HasPrefix(s, "torrentium:?xt="+testCID+"&") {
+		t.Fatalf("URI = %s", s)
+	}
+	got, err := Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.CID != want.CID || got.Name != want.Name || got.Size != want.Size || got.PiecesRoot != want.PiecesRoot || got.Key != want.Key {
+		t.Fatalf("Parse(String()) = %+v, want %+v", got, want)
+	}
+	if len(got.Peers) != 2 || !got.Peers[1].Equal(relayed) {
+		t.Fatalf("peers = %v", got.Peers)
+	}
+	if infos := got.Providers(); len(infos) != 1 || len(infos[0].Addrs) != 2 {
+		t.Fatalf("providers = %v", infos)
+	}
+}
+
+func TestParseMinimal(t *testing.T) {
+	u, err := Parse("torrentium:?xt=" + testCID)
+	if err != nil || u.CID != testCID || len(u.Peers) != 0 {
+		t.Fatalf("Parse = %+v, %v", u, err)
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	for _, s := range []string{
+		"magnet:?xt=" + testCID,
+		"torrentium:" + testCID,
+		"torrentium:?xt=nope",
+		"torrentium:?xt=" + testCID + "&xl=-1",
+		"torrentium:?xt=" + testCID + "&mh=abc",
+		"torrentium:?xt=" + testCID + "&pr=/ip4/192.0.2.7/tcp/4001",
+	} {
+		if _, err := Parse(s); !errors.Is(err, ErrInvalid) {
+			t.Errorf("Parse(%q): err = %v", s, err)
+		}
+	}
+}